@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -18,13 +20,27 @@ import (
 )
 
 type coreConfig struct {
-	Nick string
-	User string
-	Name string
-	Pass string
+	Nick     string
+	AltNicks []string
+	User     string
+	Name     string
+	Pass     string
 
-	PingFrequency duration
-	PingTimeout   duration
+	NickRecoverInterval Duration
+	NickServPass        string
+	NickServMethod      string
+
+	PingFrequency Duration
+	PingTimeout   Duration
+
+	// ReconnectDelay is how long to wait before reconnecting after the
+	// connection is lost. If it isn't set, ConnectAndRun returns instead.
+	ReconnectDelay Duration
+
+	// DisableCaps skips IRCv3 capability negotiation, for servers which
+	// get it wrong. Plugins then fall back to slower ways of finding
+	// accounts.
+	DisableCaps bool
 
 	Host        string
 	TLS         bool
@@ -37,14 +53,20 @@ type coreConfig struct {
 
 	Plugins []string
 
+	// Admins is a list of hostmasks which are allowed to run admin commands.
+	Admins []string
+
 	Debug bool
 }
 
-type duration struct {
+// Duration is a wrapper around time.Duration which can be decoded from a
+// config file using strings like "5m" or "1h30m".
+type Duration struct {
 	time.Duration
 }
 
-func (d *duration) UnmarshalText(text []byte) error {
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(text []byte) error {
 	var err error
 	d.Duration, err = time.ParseDuration(string(text))
 	return err
@@ -57,15 +79,56 @@ type Bot struct {
 	mux *BasicMux
 
 	// Config stuff
+	confLock   sync.RWMutex
+	confFile   string
 	confValues map[string]toml.Primitive
 	md         toml.MetaData
 	config     coreConfig
 
+	// loadedPlugins is what was loaded from config.Plugins when we
+	// started, which may differ from the config after a reload.
+	loadedPlugins []string
+
 	// Internal things
 	client   *irc.Client
 	registry *plugin.Registry
 	log      *logrus.Entry
 	injector inject.Injector
+	isupport ISupportProvider
+	metrics  *Metrics
+	started  time.Time
+
+	// Nick tracking. This is all protected by nickLock.
+	nickLock    sync.RWMutex
+	currentNick string
+	triedNick   string
+	nickAttempt int
+	registered  bool
+	monitoring  bool
+	altPending  string
+	isonPending bool
+
+	// Callbacks for every message we send. These are kept out of the
+	// BasicMux because messages are usually sent from inside a handler,
+	// while the mux is locked.
+	outgoingLock      sync.RWMutex
+	outgoingCallbacks []HandlerFunc
+
+	// Capabilities the server enabled. This is protected by capLock.
+	capLock     sync.Mutex
+	caps        map[string]bool
+	capsPending int
+
+	// done is closed when the current connection ends so any background
+	// loops can exit.
+	done chan struct{}
+}
+
+// ISupportProvider is anything which can provide the raw ISupport values
+// advertised by the server. The isupport plugin registers itself with the bot
+// so the core can make routing decisions based on things like CHANTYPES.
+type ISupportProvider interface {
+	GetRaw(key string) (string, bool)
 }
 
 // NewBot will return a new Bot given an io.Reader pointing to a
@@ -78,6 +141,8 @@ func NewBot(confReader io.Reader) (*Bot, error) {
 		confValues: make(map[string]toml.Primitive),
 		md:         toml.MetaData{},
 		registry:   plugins.Copy(),
+		metrics:    NewMetrics(),
+		started:    time.Now(),
 	}
 
 	// Decode the file, but leave all the config sections intact so we can
@@ -95,12 +160,7 @@ func NewBot(confReader io.Reader) (*Bot, error) {
 
 	// Set up logging/debugging
 	b.log = logrus.NewEntry(logrus.New())
-
-	if b.config.Debug {
-		b.log.Logger.Level = logrus.DebugLevel
-	} else {
-		b.log.Logger.Level = logrus.InfoLevel
-	}
+	b.SetDebug(b.config.Debug)
 
 	commandMux := NewCommandMux(b.config.Prefix)
 	mentionMux := NewMentionMux()
@@ -116,6 +176,118 @@ func NewBot(confReader io.Reader) (*Bot, error) {
 	return b, nil
 }
 
+// NewBotFromFile will return a new Bot given the filename of a config file.
+// Unlike NewBot, a bot created this way can reload its config.
+func NewBotFromFile(filename string) (*Bot, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b, err := NewBot(f)
+	if err != nil {
+		return nil, err
+	}
+
+	b.confFile = filename
+
+	return b, nil
+}
+
+// ReloadConfig will re-read the core section of the config file this bot was
+// created from, which covers things like admins, debug logging and nick
+// recovery. Plugins read their own sections when they're loaded, so changes
+// to those, the plugin list and the command prefix need a restart. Connection
+// settings will not take effect until the next connection.
+func (b *Bot) ReloadConfig() error {
+	if b.confFile == "" {
+		return errors.New("Bot was not loaded from a config file")
+	}
+
+	f, err := os.Open(b.confFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	confValues := make(map[string]toml.Primitive)
+	md, err := toml.DecodeReader(f, &confValues)
+	if err != nil {
+		return err
+	}
+
+	v, ok := confValues["core"]
+	if !ok {
+		return errors.New("Config section for \"core\" missing")
+	}
+
+	var config coreConfig
+	err = md.PrimitiveDecode(v, &config)
+	if err != nil {
+		return err
+	}
+
+	b.confLock.Lock()
+	b.confValues = confValues
+	b.md = md
+	b.config = config
+	b.confLock.Unlock()
+
+	b.SetDebug(config.Debug)
+
+	b.log.Info("Reloaded config")
+
+	return nil
+}
+
+// SetDebug turns debug logging on or off.
+func (b *Bot) SetDebug(debug bool) {
+	if debug {
+		b.log.Logger.Level = logrus.DebugLevel
+	} else {
+		b.log.Logger.Level = logrus.InfoLevel
+	}
+}
+
+// Debug returns true if debug logging is enabled.
+func (b *Bot) Debug() bool {
+	return b.log.Logger.Level == logrus.DebugLevel
+}
+
+// Plugins returns the names of the plugins which were loaded when the bot
+// started.
+func (b *Bot) Plugins() []string {
+	b.confLock.RLock()
+	defer b.confLock.RUnlock()
+
+	return append([]string(nil), b.loadedPlugins...)
+}
+
+// Registered returns true if the bot is currently connected and has
+// finished registering with the server.
+func (b *Bot) Registered() bool {
+	b.nickLock.RLock()
+	defer b.nickLock.RUnlock()
+
+	return b.registered
+}
+
+// Done returns a channel which is closed when the current connection ends.
+func (b *Bot) Done() <-chan struct{} {
+	return b.done
+}
+
+// Metrics returns the metrics collected by this bot.
+func (b *Bot) Metrics() *Metrics {
+	return b.metrics
+}
+
+// StartTime returns when this bot was created.
+func (b *Bot) StartTime() time.Time {
+	return b.started
+}
+
 // GetLogger grabs the underlying logger for this bot.
 func (b *Bot) GetLogger() *logrus.Entry {
 	return b.log
@@ -123,12 +295,27 @@ func (b *Bot) GetLogger() *logrus.Entry {
 
 // CurrentNick returns the current nick of the bot.
 func (b *Bot) CurrentNick() string {
+	b.nickLock.RLock()
+	defer b.nickLock.RUnlock()
+
+	if b.currentNick != "" {
+		return b.currentNick
+	}
+
+	// We don't have a client until Run is called.
+	if b.client == nil {
+		return ""
+	}
+
 	return b.client.CurrentNick()
 }
 
 // Config will decode the config section for the given name into the given
 // interface{}
 func (b *Bot) Config(name string, c interface{}) error {
+	b.confLock.RLock()
+	defer b.confLock.RUnlock()
+
 	if v, ok := b.confValues[name]; ok {
 		return b.md.PrimitiveDecode(v, c)
 	}
@@ -136,9 +323,10 @@ func (b *Bot) Config(name string, c interface{}) error {
 	return fmt.Errorf("Config section for %q missing", name)
 }
 
-// Send is a simple function to send an IRC event
-func (b *Bot) Send(m *irc.Message) {
-	b.client.WriteMessage(m)
+// Send is a simple function to send an IRC event. An error is returned if
+// the message couldn't be written to the connection.
+func (b *Bot) Send(m *irc.Message) error {
+	return b.client.WriteMessage(m)
 }
 
 // Reply to an irc.Message with a convenience wrapper around fmt.Sprintf
@@ -226,12 +414,6 @@ func (b *Bot) CTCPReply(m *irc.Message, format string, v ...interface{}) error {
 	return nil
 }
 
-func (b *Bot) handshake() {
-	b.client.Writef("CAP END")
-	b.client.Writef("NICK %s", b.config.Nick)
-	b.client.Writef("USER %s 0.0.0.0 0.0.0.0 :%s", b.config.User, b.config.Name)
-}
-
 // Write will write an raw IRC message to the stream
 func (b *Bot) Write(line string) {
 	b.client.Write(line)
@@ -242,12 +424,71 @@ func (b *Bot) Writef(format string, args ...interface{}) {
 	b.client.Writef(format, args...)
 }
 
-// FromChannel is a wrapper around the irc package's FromChannel.
+// SetISupport sets the provider used to look up server ISupport values.
+func (b *Bot) SetISupport(p ISupportProvider) {
+	b.isupport = p
+}
+
+// lookupISupport looks up an ISupport value if we have a provider.
+func (b *Bot) lookupISupport(key string) (string, bool) {
+	if b.isupport == nil {
+		return "", false
+	}
+
+	return b.isupport.GetRaw(key)
+}
+
+// getISupport looks up an ISupport value, falling back to the given default
+// if there is no provider or the server didn't advertise it.
+func (b *Bot) getISupport(key, fallback string) string {
+	if ret, ok := b.lookupISupport(key); ok {
+		return ret
+	}
+
+	return fallback
+}
+
+// ChannelTarget splits a message target into any STATUSMSG prefix (such as
+// the "@" in "@#chan") and the channel name. ok will be false if the target
+// is not a channel.
+func (b *Bot) ChannelTarget(target string) (prefix, channel string, ok bool) {
+	chanTypes := b.getISupport("CHANTYPES", "#&")
+	statusMsg := b.getISupport("STATUSMSG", "")
+
+	i := 0
+	for i < len(target) && strings.IndexByte(statusMsg, target[i]) != -1 {
+		i++
+	}
+
+	if i >= len(target) || strings.IndexByte(chanTypes, target[i]) == -1 {
+		return "", "", false
+	}
+
+	return target[:i], target[i:], true
+}
+
+// FromChannel returns true if the given message was sent to a channel,
+// including STATUSMSG targets like "@#chan". This uses the CHANTYPES and
+// STATUSMSG values advertised by the server if they are known.
 func (b *Bot) FromChannel(m *irc.Message) bool {
-	return b.client.FromChannel(m)
+	if len(m.Params) < 1 {
+		return false
+	}
+
+	_, _, ok := b.ChannelTarget(m.Params[0])
+	return ok
 }
 
 func (b *Bot) handler(c *irc.Client, m *irc.Message) {
+	b.metrics.messageIn()
+
+	// Keep track of our nick before any plugins see the message
+	b.handleNickEvents(m)
+
+	if m.Command == "CAP" {
+		b.capCallback(m)
+	}
+
 	// Handle the event and pass it along
 	if m.Command == "001" {
 		b.log.Info("Connected")
@@ -265,13 +506,96 @@ func (b *Bot) handler(c *irc.Client, m *irc.Message) {
 		}
 	}
 
+	b.dispatch(m)
+}
+
+// dispatch passes the message along to all the registered handlers. It keeps
+// track of how long that took and recovers from any panics so one broken
+// plugin can't take down the whole bot.
+func (b *Bot) dispatch(m *irc.Message) {
+	start := time.Now()
+
+	defer func() {
+		if r := recover(); r != nil {
+			b.metrics.handlerError()
+			b.log.WithField("command", m.Command).Errorf("Recovered from handler panic: %v", r)
+		}
+
+		b.metrics.handlerTime(m.Command, time.Since(start))
+	}()
+
 	b.mux.HandleEvent(b, m)
 }
 
+// RegisterOutgoingCallback registers a callback which is called with every
+// message the bot sends, with the prefix set to our nick, so plugins like
+// loggers can see our side of the conversation. Callbacks may be called from
+// any goroutine, often while another handler is running, and must not send
+// anything themselves.
+func (b *Bot) RegisterOutgoingCallback(f HandlerFunc) {
+	b.outgoingLock.Lock()
+	defer b.outgoingLock.Unlock()
+
+	b.outgoingCallbacks = append(b.outgoingCallbacks, f)
+}
+
+// dispatchOutgoing passes a line we've sent along to the outgoing callbacks.
+func (b *Bot) dispatchOutgoing(line string) {
+	b.outgoingLock.RLock()
+	callbacks := b.outgoingCallbacks
+	b.outgoingLock.RUnlock()
+
+	if len(callbacks) == 0 {
+		return
+	}
+
+	m, err := irc.ParseMessage(strings.Trim(line, "\r\n"))
+	if err != nil {
+		return
+	}
+	m.Prefix = &irc.Prefix{Name: b.CurrentNick()}
+
+	defer func() {
+		if r := recover(); r != nil {
+			b.metrics.handlerError()
+			b.log.WithField("command", m.Command).Errorf("Recovered from outgoing callback panic: %v", r)
+		}
+	}()
+
+	for _, f := range callbacks {
+		f(b, m)
+	}
+}
+
 // ConnectAndRun is a convenience function which will pull the
 // connection information out of the config and connect, then call
-// Run.
+// Run. If ReconnectDelay is set, it will keep reconnecting whenever the
+// connection is lost.
 func (b *Bot) ConnectAndRun() error {
+	// Plugins are only loaded once, so if they fail, there's no point in
+	// trying again.
+	err := b.loadPlugins()
+	if err != nil {
+		return err
+	}
+
+	for {
+		err = b.connectAndRunOnce()
+
+		b.confLock.RLock()
+		delay := b.config.ReconnectDelay.Duration
+		b.confLock.RUnlock()
+
+		if delay <= 0 {
+			return err
+		}
+
+		b.log.WithError(err).WithField("delay", delay).Warn("Connection lost, reconnecting")
+		time.Sleep(delay)
+	}
+}
+
+func (b *Bot) connectAndRunOnce() error {
 	// The ReadWriteCloser will contain either a *net.Conn or *tls.Conn
 	var c io.ReadWriteCloser
 	var err error
@@ -299,21 +623,44 @@ func (b *Bot) ConnectAndRun() error {
 	if err != nil {
 		return err
 	}
+	defer c.Close()
 
 	return b.Run(c)
 }
 
+// loadPlugins loads the plugins from the config the first time it's called.
+// Plugins register their handlers when they're loaded, so this only happens
+// once, no matter how many times we connect.
+func (b *Bot) loadPlugins() error {
+	if b.injector != nil {
+		return nil
+	}
+
+	injector, err := b.registry.Load(b.config.Plugins, nil)
+	if err != nil {
+		return err
+	}
+
+	b.confLock.Lock()
+	b.injector = injector
+	b.loadedPlugins = matchPlugins(b.config.Plugins)
+	b.confLock.Unlock()
+
+	return nil
+}
+
 // Run starts the bot and loops until it dies. It accepts a
 // ReadWriter. If you wish to use the connection feature from the
 // config, use ConnectAndRun.
 func (b *Bot) Run(c io.ReadWriter) error {
 	var err error
 
-	b.injector, err = b.registry.Load(b.config.Plugins, nil)
+	err = b.loadPlugins()
 	if err != nil {
 		return err
 	}
 
+
 	// Create a client from the connection we've just opened
 	rc := irc.ClientConfig{
 		Nick: b.config.Nick,
@@ -329,17 +676,47 @@ func (b *Bot) Run(c io.ReadWriter) error {
 
 	b.client = irc.NewClient(c, rc)
 
+	// Reset the nick state for this connection
+	b.nickLock.Lock()
+	b.currentNick = ""
+	b.triedNick = ""
+	b.nickAttempt = 0
+	b.registered = false
+	b.monitoring = false
+	b.altPending = ""
+	b.isonPending = false
+	b.nickLock.Unlock()
+
+	b.metrics.connected()
+
+	b.done = make(chan struct{})
+	defer func() {
+		b.nickLock.Lock()
+		b.registered = false
+		b.nickLock.Unlock()
+
+		close(b.done)
+	}()
+
 	// Now that we have a client, set up debug callbacks
 	b.client.Reader.DebugCallback = func(line string) {
 		b.log.Debug("<-- ", strings.Trim(line, "\r\n"))
 	}
 	b.client.Writer.DebugCallback = func(line string) {
+		b.metrics.messageOut()
+
 		if len(line) > 512 {
 			b.log.Warnf("Line longer than 512 chars: %s", strings.Trim(line, "\r\n"))
 		}
 		b.log.Debug("--> ", strings.Trim(line, "\r\n"))
+
+		b.dispatchOutgoing(line)
 	}
 
+	// The client sends NICK and USER itself when it starts, so capabilities
+	// have to be requested before that.
+	b.requestCaps()
+
 	// Start the main loop
 	return b.client.Run()
 }
@@ -0,0 +1,41 @@
+package seabird
+
+import (
+	"testing"
+
+	"github.com/go-irc/irc"
+	"github.com/stretchr/testify/assert"
+)
+
+type testISupport map[string]string
+
+func (t testISupport) GetRaw(key string) (string, bool) {
+	ret, ok := t[key]
+	return ret, ok
+}
+
+func TestFromChannel(t *testing.T) {
+	b := &Bot{}
+
+	// Defaults should be used without an isupport provider
+	assert.True(t, b.FromChannel(irc.MustParseMessage(":belak PRIVMSG #hello :hi")))
+	assert.True(t, b.FromChannel(irc.MustParseMessage(":belak PRIVMSG &hello :hi")))
+	assert.False(t, b.FromChannel(irc.MustParseMessage(":belak PRIVMSG bot :hi")))
+	assert.False(t, b.FromChannel(irc.MustParseMessage(":belak PRIVMSG @#hello :hi")))
+	assert.False(t, b.FromChannel(irc.MustParseMessage("PING")))
+
+	b.SetISupport(testISupport{
+		"CHANTYPES": "#",
+		"STATUSMSG": "@+",
+	})
+
+	assert.True(t, b.FromChannel(irc.MustParseMessage(":belak PRIVMSG #hello :hi")))
+	assert.False(t, b.FromChannel(irc.MustParseMessage(":belak PRIVMSG &hello :hi")))
+	assert.True(t, b.FromChannel(irc.MustParseMessage(":belak PRIVMSG @#hello :hi")))
+	assert.False(t, b.FromChannel(irc.MustParseMessage(":belak PRIVMSG @bot :hi")))
+
+	prefix, channel, ok := b.ChannelTarget("@+#hello")
+	assert.True(t, ok)
+	assert.Equal(t, "@+", prefix)
+	assert.Equal(t, "#hello", channel)
+}
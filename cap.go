@@ -0,0 +1,87 @@
+package seabird
+
+import (
+	"strings"
+
+	"github.com/go-irc/irc"
+)
+
+// requestedCaps are the IRCv3 capabilities we ask for while registering.
+// They let plugins know which services account users are logged in to.
+var requestedCaps = []string{
+	"account-notify",
+	"extended-join",
+	"account-tag",
+}
+
+// requestCaps asks the server for the capabilities we want. Each one is
+// requested separately so a server which doesn't support one of them can
+// still give us the others. Servers which support CAP hold registration until
+// we've heard back about all of them and sent CAP END. Servers which don't
+// will just ignore this and register us as usual.
+func (b *Bot) requestCaps() {
+	b.confLock.RLock()
+	disabled := b.config.DisableCaps
+	b.confLock.RUnlock()
+
+	b.capLock.Lock()
+	b.caps = make(map[string]bool)
+	b.capsPending = 0
+	if !disabled {
+		b.capsPending = len(requestedCaps)
+	}
+	b.capLock.Unlock()
+
+	if disabled {
+		return
+	}
+
+	for _, name := range requestedCaps {
+		b.client.Writef("CAP REQ :%s", name)
+	}
+}
+
+// capCallback keeps track of which capabilities the server agreed to and
+// finishes capability negotiation once every request has been answered.
+func (b *Bot) capCallback(m *irc.Message) {
+	if len(m.Params) < 3 {
+		return
+	}
+
+	subcommand := m.Params[1]
+	if subcommand != "ACK" && subcommand != "NAK" {
+		return
+	}
+
+	b.capLock.Lock()
+	for _, name := range strings.Fields(m.Trailing()) {
+		// A leading "-" means the capability was disabled.
+		if subcommand == "ACK" && !strings.HasPrefix(name, "-") {
+			b.caps[name] = true
+		} else {
+			delete(b.caps, strings.TrimPrefix(name, "-"))
+		}
+	}
+
+	finished := false
+	if b.capsPending > 0 {
+		b.capsPending--
+		finished = b.capsPending == 0
+	}
+	b.capLock.Unlock()
+
+	b.log.WithField("caps", m.Trailing()).Debugf("Capabilities %s", subcommand)
+
+	if finished {
+		b.client.Writef("CAP END")
+	}
+}
+
+// HasCap returns true if the server enabled the given capability for this
+// connection.
+func (b *Bot) HasCap(name string) bool {
+	b.capLock.Lock()
+	defer b.capLock.Unlock()
+
+	return b.caps[name]
+}
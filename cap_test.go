@@ -0,0 +1,51 @@
+package seabird
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-irc/irc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapNegotiation(t *testing.T) {
+	buf := &bytes.Buffer{}
+	b := newNickTestBot(buf)
+	defer close(b.done)
+
+	b.requestCaps()
+	assert.Equal(t, "CAP REQ :account-notify\r\nCAP REQ :extended-join\r\nCAP REQ :account-tag\r\n", buf.String())
+	buf.Reset()
+
+	// We shouldn't end negotiation until every request was answered.
+	b.capCallback(irc.MustParseMessage(":server CAP * ACK :account-notify"))
+	b.capCallback(irc.MustParseMessage(":server CAP * NAK :extended-join"))
+	assert.Equal(t, "", buf.String())
+
+	b.capCallback(irc.MustParseMessage(":server CAP * ACK :account-tag"))
+	assert.Equal(t, "CAP END\r\n", buf.String())
+	buf.Reset()
+
+	assert.True(t, b.HasCap("account-notify"))
+	assert.False(t, b.HasCap("extended-join"))
+	assert.True(t, b.HasCap("account-tag"))
+
+	// Later changes are tracked, but negotiation is only ended once.
+	b.capCallback(irc.MustParseMessage(":server CAP seabird ACK :-account-tag"))
+	assert.False(t, b.HasCap("account-tag"))
+	assert.Equal(t, "", buf.String())
+}
+
+func TestCapDisabled(t *testing.T) {
+	buf := &bytes.Buffer{}
+	b := newNickTestBot(buf)
+	b.config.DisableCaps = true
+	defer close(b.done)
+
+	b.requestCaps()
+	assert.Equal(t, "", buf.String())
+
+	// A stray reply shouldn't make us end negotiation we never started.
+	b.capCallback(irc.MustParseMessage(":server CAP * ACK :account-tag"))
+	assert.Equal(t, "", buf.String())
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/belak/go-seabird/plugins"
+)
+
+// runCtl connects to the admin console of a running bot. If a command is
+// given, it will be run and the output printed, otherwise commands will be
+// read from stdin.
+func runCtl(args []string) error {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := flags.String("socket", "seabird.sock", "path to the console socket")
+	addr := flags.String("addr", "", "TCP address of the console, used instead of the socket if set")
+	flags.Parse(args)
+
+	var conn net.Conn
+	var err error
+	if *addr != "" {
+		conn, err = net.Dial("tcp", *addr)
+	} else {
+		conn, err = net.Dial("unix", *socket)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	responses := bufio.NewScanner(conn)
+
+	if flags.NArg() > 0 {
+		ok, err := ctlCommand(conn, responses, strings.Join(flags.Args(), " "))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("Command failed")
+		}
+		return nil
+	}
+
+	input := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("seabird> ")
+		if !input.Scan() {
+			fmt.Println()
+			return input.Err()
+		}
+
+		line := strings.TrimSpace(input.Text())
+		if line == "" {
+			continue
+		} else if line == "quit" || line == "exit" {
+			return nil
+		}
+
+		_, err = ctlCommand(conn, responses, line)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ctlCommand sends a single command to the console and prints the response.
+// It returns false if the console reported an error.
+func ctlCommand(w io.Writer, responses *bufio.Scanner, line string) (bool, error) {
+	_, err := fmt.Fprintln(w, line)
+	if err != nil {
+		return false, err
+	}
+
+	ok := true
+	first := true
+	for responses.Scan() {
+		resp := responses.Text()
+		if resp == plugins.ConsoleEnd {
+			return ok, nil
+		}
+
+		// The first line is the status, which we only print on error.
+		if first {
+			first = false
+			if strings.HasPrefix(resp, "ERR") {
+				ok = false
+			} else if resp == "OK" {
+				continue
+			}
+		}
+
+		fmt.Println(resp)
+	}
+
+	if err = responses.Err(); err != nil {
+		return false, err
+	}
+
+	return false, errors.New("Console closed the connection")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/plugins/extra"
+)
+
+// runDB handles the db subcommands which work directly on the bot's
+// database. The bot should not be running when importing, and with the nut
+// driver the database can't be opened while the bot is running at all, so
+// these will fail after a short wait.
+func runDB(conf string, args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: seabird db <export|import|backup> [flags]")
+	}
+
+	flags := flag.NewFlagSet("db "+args[0], flag.ExitOnError)
+	filename := flags.String("f", "-", "file to read from or write to, - for stdin/stdout")
+	dir := flags.String("dir", "backups", "directory to write backups to")
+	keep := flags.Int("keep", 0, "number of backups to keep, 0 to keep all")
+	flags.Parse(args[1:])
+
+	b, err := seabird.NewBotFromFile(conf)
+	if err != nil {
+		return err
+	}
+
+	// Imports replace everything, so there's no point in migrating first.
+	// The imported data is migrated once it's loaded.
+	open := extra.OpenStore
+	if args[0] == "import" {
+		open = extra.OpenStoreNoMigrate
+	}
+
+	store, err := open(b)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	switch args[0] {
+	case "export":
+		var w io.WriteCloser = os.Stdout
+		if *filename != "-" {
+			w, err = os.Create(*filename)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = store.Export(w)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	case "import":
+		var r io.ReadCloser = os.Stdin
+		if *filename != "-" {
+			r, err = os.Open(*filename)
+			if err != nil {
+				return err
+			}
+		}
+		defer r.Close()
+
+		err = store.Import(r)
+		if err != nil {
+			return err
+		}
+
+		// Older dumps may need to be brought up to date.
+		return store.Migrate()
+	case "backup":
+		name, err := store.Backup(*dir, *keep)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(os.Stderr, "Wrote", name)
+		return nil
+	}
+
+	return fmt.Errorf("Unknown db command %q", args[0])
+}
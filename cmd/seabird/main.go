@@ -25,6 +25,12 @@ func failIfErr(err error, desc string) {
 }
 
 func main() {
+	// The ctl subcommand talks to the console of an already running bot.
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		failIfErr(runCtl(os.Args[2:]), "Console command failed")
+		return
+	}
+
 	// Seed the random number generator for plugins to use.
 	rand.Seed(time.Now().UTC().UnixNano())
 
@@ -35,11 +41,14 @@ func main() {
 		failIfErr(err, "Failed to load config")
 	}
 
-	confReader, err := os.Open(conf)
-	failIfErr(err, "Failed to load config")
+	// The db subcommands work on the database from the config file.
+	if len(os.Args) > 1 && os.Args[1] == "db" {
+		failIfErr(runDB(conf, os.Args[2:]), "Database command failed")
+		return
+	}
 
 	// Create the bot
-	b, err := seabird.NewBot(confReader)
+	b, err := seabird.NewBotFromFile(conf)
 	failIfErr(err, "Failed to create new bot")
 
 	// Run the bot
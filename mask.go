@@ -0,0 +1,64 @@
+package seabird
+
+import (
+	"strings"
+
+	"github.com/go-irc/irc"
+)
+
+// MatchMask checks if the given prefix matches an IRC style hostmask such
+// as "nick!*@*.example.com". The "*" wildcard matches any number of
+// characters and "?" matches exactly one. Matching is case insensitive.
+func MatchMask(mask string, p *irc.Prefix) bool {
+	if p == nil {
+		return false
+	}
+
+	return matchWildcard(strings.ToLower(mask), strings.ToLower(p.String()))
+}
+
+func matchWildcard(pattern, s string) bool {
+	// Track the last star we saw so we can backtrack to it if needed.
+	var px, sx int
+	starIdx, matchIdx := -1, 0
+
+	for sx < len(s) {
+		switch {
+		case px < len(pattern) && (pattern[px] == '?' || pattern[px] == s[sx]):
+			px++
+			sx++
+		case px < len(pattern) && pattern[px] == '*':
+			starIdx = px
+			matchIdx = sx
+			px++
+		case starIdx != -1:
+			px = starIdx + 1
+			matchIdx++
+			sx = matchIdx
+		default:
+			return false
+		}
+	}
+
+	// Any trailing stars can match the empty string
+	for px < len(pattern) && pattern[px] == '*' {
+		px++
+	}
+
+	return px == len(pattern)
+}
+
+// IsAdmin returns true if the sender of the given message matches any of the
+// admin masks in the core config.
+func (b *Bot) IsAdmin(m *irc.Message) bool {
+	b.confLock.RLock()
+	defer b.confLock.RUnlock()
+
+	for _, mask := range b.config.Admins {
+		if MatchMask(mask, m.Prefix) {
+			return true
+		}
+	}
+
+	return false
+}
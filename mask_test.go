@@ -0,0 +1,32 @@
+package seabird
+
+import (
+	"testing"
+
+	"github.com/go-irc/irc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchMask(t *testing.T) {
+	p := irc.ParsePrefix("belak!belak@example.com")
+
+	assert.True(t, MatchMask("belak!belak@example.com", p))
+	assert.True(t, MatchMask("BELAK!*@*", p))
+	assert.True(t, MatchMask("*!*@*.com", p))
+	assert.True(t, MatchMask("bela?!*@example.com", p))
+	assert.True(t, MatchMask("*", p))
+	assert.False(t, MatchMask("jsvana!*@*", p))
+	assert.False(t, MatchMask("*!*@*.org", p))
+	assert.False(t, MatchMask("belak!*@*", nil))
+}
+
+func TestIsAdmin(t *testing.T) {
+	b := &Bot{
+		config: coreConfig{
+			Admins: []string{"belak!*@*"},
+		},
+	}
+
+	assert.True(t, b.IsAdmin(irc.MustParseMessage(":belak!belak@example.com PRIVMSG #hello :hi")))
+	assert.False(t, b.IsAdmin(irc.MustParseMessage(":jsvana!jsvana@example.com PRIVMSG #hello :hi")))
+}
@@ -0,0 +1,152 @@
+package seabird
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics keeps track of basic counters about what the bot is doing. All
+// methods are safe to call on a nil *Metrics, in which case nothing will be
+// recorded.
+type Metrics struct {
+	lock *sync.Mutex
+
+	messagesIn    uint64
+	messagesOut   uint64
+	handlerErrors uint64
+	connections   uint64
+
+	commands map[string]uint64
+	handlers map[string]*HandlerTiming
+}
+
+// HandlerTiming tracks how long it takes to handle a specific IRC command.
+type HandlerTiming struct {
+	Count uint64
+	Total time.Duration
+}
+
+// MetricsSnapshot is a point in time copy of the bot's Metrics.
+type MetricsSnapshot struct {
+	MessagesIn    uint64
+	MessagesOut   uint64
+	HandlerErrors uint64
+	Reconnects    uint64
+
+	Commands map[string]uint64
+	Handlers map[string]HandlerTiming
+}
+
+// NewMetrics returns an empty Metrics object.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		lock:     &sync.Mutex{},
+		commands: make(map[string]uint64),
+		handlers: make(map[string]*HandlerTiming),
+	}
+}
+
+func (m *Metrics) messageIn() {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.messagesIn++
+}
+
+func (m *Metrics) messageOut() {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.messagesOut++
+}
+
+func (m *Metrics) handlerError() {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.handlerErrors++
+}
+
+func (m *Metrics) connected() {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.connections++
+}
+
+func (m *Metrics) commandRun(name string) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.commands[name]++
+}
+
+func (m *Metrics) handlerTime(command string, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	t, ok := m.handlers[command]
+	if !ok {
+		t = &HandlerTiming{}
+		m.handlers[command] = t
+	}
+
+	t.Count++
+	t.Total += d
+}
+
+// Snapshot returns a copy of the current metrics.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	ret := MetricsSnapshot{
+		Commands: make(map[string]uint64),
+		Handlers: make(map[string]HandlerTiming),
+	}
+
+	if m == nil {
+		return ret
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ret.MessagesIn = m.messagesIn
+	ret.MessagesOut = m.messagesOut
+	ret.HandlerErrors = m.handlerErrors
+	if m.connections > 0 {
+		ret.Reconnects = m.connections - 1
+	}
+
+	for k, v := range m.commands {
+		ret.Commands[k] = v
+	}
+
+	for k, v := range m.handlers {
+		ret.Handlers[k] = *v
+	}
+
+	return ret
+}
@@ -0,0 +1,35 @@
+package seabird
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+
+	m.connected()
+	m.messageIn()
+	m.messageIn()
+	m.messageOut()
+	m.commandRun("help")
+	m.handlerTime("PRIVMSG", time.Second)
+	m.handlerTime("PRIVMSG", 2*time.Second)
+
+	snap := m.Snapshot()
+	assert.Equal(t, uint64(2), snap.MessagesIn)
+	assert.Equal(t, uint64(1), snap.MessagesOut)
+	assert.Equal(t, uint64(0), snap.Reconnects)
+	assert.Equal(t, uint64(1), snap.Commands["help"])
+	assert.Equal(t, HandlerTiming{Count: 2, Total: 3 * time.Second}, snap.Handlers["PRIVMSG"])
+
+	m.connected()
+	assert.Equal(t, uint64(1), m.Snapshot().Reconnects)
+
+	// A nil Metrics should be safe to use
+	var nilMetrics *Metrics
+	nilMetrics.messageIn()
+	assert.Equal(t, uint64(0), nilMetrics.Snapshot().MessagesIn)
+}
@@ -42,6 +42,11 @@ func NewCommandMux(prefix string) *CommandMux {
 	return m
 }
 
+// Prefix returns the string commands must start with.
+func (m *CommandMux) Prefix() string {
+	return m.prefix
+}
+
 func (m *CommandMux) help(b *Bot, msg *irc.Message) {
 	cmd := msg.Trailing()
 	if cmd == "" {
@@ -99,6 +104,16 @@ func (h *HelpInfo) format(prefix, command string) []string {
 	return ret
 }
 
+// Commands returns a copy of all the registered commands along with their
+// help info.
+func (m *CommandMux) Commands() map[string]*HelpInfo {
+	ret := make(map[string]*HelpInfo, len(m.cmdHelp))
+	for k, v := range m.cmdHelp {
+		ret[k] = v
+	}
+	return ret
+}
+
 // Event will register a Handler as both a private and public command
 func (m *CommandMux) Event(c string, h HandlerFunc, help *HelpInfo) {
 	m.private.Event(c, h)
@@ -150,6 +165,10 @@ func (m *CommandMux) HandleEvent(b *Bot, msg *irc.Message) {
 		newEvent.Command = newEvent.Command[len(m.prefix):]
 	}
 
+	if _, ok := m.cmdHelp[newEvent.Command]; ok {
+		b.Metrics().commandRun(newEvent.Command)
+	}
+
 	if b.FromChannel(newEvent) {
 		m.public.HandleEvent(b, newEvent)
 	} else {
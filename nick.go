@@ -0,0 +1,313 @@
+package seabird
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-irc/irc"
+)
+
+// defaultNickRecoverInterval is how often we check if our primary nick is
+// available if it isn't specified in the config.
+const defaultNickRecoverInterval = time.Minute
+
+func (b *Bot) handleNickEvents(m *irc.Message) {
+	switch m.Command {
+	case "001":
+		b.nickRegistered(m)
+	case "432", "433", "437":
+		b.nickUnavailable(m)
+	case "NICK":
+		b.nickChanged(m)
+	case "303":
+		b.isonCallback(m)
+	case "731":
+		b.monitorOfflineCallback(m)
+	}
+}
+
+// setNick updates our current nick. Plugins which care, like the MentionMux,
+// look it up with CurrentNick as they need it.
+func (b *Bot) setNick(nick string) {
+	b.nickLock.Lock()
+	oldNick := b.currentNick
+	b.currentNick = nick
+	b.nickLock.Unlock()
+
+	if oldNick == nick {
+		return
+	}
+
+	b.log.WithField("nick", nick).Info("Current nick changed")
+}
+
+// casefold lowercases a nick using the server's CASEMAPPING, so nicks which
+// the server considers the same compare equal.
+func (b *Bot) casefold(nick string) string {
+	var upper, lower string
+	switch b.getISupport("CASEMAPPING", "rfc1459") {
+	case "ascii":
+	case "strict-rfc1459":
+		upper, lower = "[]\\", "{}|"
+	default:
+		upper, lower = "[]\\~", "{}|^"
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		if i := strings.IndexRune(upper, r); i >= 0 {
+			return rune(lower[i])
+		}
+		return r
+	}, nick)
+}
+
+// nickEqual returns true if the server considers both nicks the same.
+func (b *Bot) nickEqual(a, c string) bool {
+	return b.casefold(a) == b.casefold(c)
+}
+
+// isPrimaryNick returns true if we currently have our primary nick.
+func (b *Bot) isPrimaryNick() bool {
+	return b.nickEqual(b.CurrentNick(), b.config.Nick)
+}
+
+// nextNick returns the next nick we should try when the server rejects one
+// as erroneous during registration. We go through the alternate nicks in
+// order, then start appending underscores to the last one we tried.
+func (b *Bot) nextNick() string {
+	b.nickLock.Lock()
+	defer b.nickLock.Unlock()
+
+	if b.triedNick == "" {
+		b.triedNick = b.config.Nick
+	}
+
+	if b.nickAttempt < len(b.config.AltNicks) {
+		b.triedNick = b.config.AltNicks[b.nickAttempt]
+	} else {
+		b.triedNick += "_"
+	}
+
+	b.nickAttempt++
+
+	return b.triedNick
+}
+
+// nextAltNick returns the next alternate nick to try once we're registered
+// with a fallback nick. ok will be false if there are no alternates left
+// which we'd prefer over our current nick.
+func (b *Bot) nextAltNick() (nick string, ok bool) {
+	b.nickLock.Lock()
+	defer b.nickLock.Unlock()
+
+	b.altPending = ""
+
+	// Only alternates listed before our current nick are better than what
+	// we already have.
+	limit := len(b.config.AltNicks)
+	for i, alt := range b.config.AltNicks {
+		if b.nickEqual(alt, b.currentNick) {
+			limit = i
+			break
+		}
+	}
+
+	if b.nickAttempt >= limit {
+		return "", false
+	}
+
+	nick = b.config.AltNicks[b.nickAttempt]
+	b.nickAttempt++
+	b.altPending = nick
+
+	return nick, true
+}
+
+func (b *Bot) nickRegistered(m *irc.Message) {
+	if len(m.Params) < 1 {
+		return
+	}
+
+	b.nickLock.Lock()
+	b.registered = true
+	b.monitoring = false
+	b.nickLock.Unlock()
+
+	b.setNick(m.Params[0])
+
+	if !b.nickEqual(m.Params[0], b.config.Nick) {
+		b.log.WithField("nick", b.config.Nick).Warn("Primary nick unavailable")
+		b.nickServRecover()
+
+		// The irc client falls back to appending underscores, so see if
+		// we can get one of our alternates instead.
+		if nick, ok := b.nextAltNick(); ok {
+			b.Writef("NICK %s", nick)
+		}
+	}
+
+	go b.nickRecoverLoop(b.done)
+}
+
+func (b *Bot) nickUnavailable(m *irc.Message) {
+	var rejected string
+	if len(m.Params) > 1 {
+		rejected = m.Params[1]
+	}
+
+	b.nickLock.RLock()
+	registered := b.registered
+	altPending := b.altPending != "" && b.altPending == rejected
+	b.nickLock.RUnlock()
+
+	if registered {
+		// If one of our alternates was taken, move on to the next one.
+		// Otherwise this is a failed attempt to reclaim our nick, so we just
+		// wait for the next one.
+		if altPending {
+			if nick, ok := b.nextAltNick(); ok {
+				b.Writef("NICK %s", nick)
+			}
+			return
+		}
+
+		b.log.WithField("nick", rejected).Debug("Failed to reclaim nick")
+		return
+	}
+
+	// Before registration, the irc client already retries taken nicks by
+	// appending an underscore. Sending our own NICK as well would race with
+	// it, so we only handle nicks the server considers invalid.
+	if m.Command != "432" {
+		return
+	}
+
+	nick := b.nextNick()
+
+	b.log.WithField("nick", nick).Warn("Nick invalid, trying alternate")
+
+	b.Writef("NICK %s", nick)
+}
+
+func (b *Bot) nickChanged(m *irc.Message) {
+	if len(m.Params) < 1 || !b.nickEqual(m.Prefix.Name, b.CurrentNick()) {
+		return
+	}
+
+	b.setNick(m.Params[0])
+
+	// If we're monitoring our primary nick and we got it back, we can stop.
+	b.nickLock.Lock()
+	monitoring := b.monitoring && b.nickEqual(m.Params[0], b.config.Nick)
+	if monitoring {
+		b.monitoring = false
+	}
+	b.nickLock.Unlock()
+
+	if monitoring {
+		b.Writef("MONITOR - %s", b.config.Nick)
+	}
+}
+
+// nickServRecover will ask NickServ to free up our primary nick if a password
+// was provided.
+func (b *Bot) nickServRecover() {
+	if b.config.NickServPass == "" {
+		return
+	}
+
+	switch strings.ToLower(b.config.NickServMethod) {
+	case "ghost":
+		// GHOST only disconnects the other user, so we rely on the recovery
+		// loop to actually grab the nick.
+		b.Writef("PRIVMSG NickServ :GHOST %s %s", b.config.Nick, b.config.NickServPass)
+	case "", "regain":
+		b.Writef("PRIVMSG NickServ :REGAIN %s %s", b.config.Nick, b.config.NickServPass)
+	default:
+		b.log.WithField("method", b.config.NickServMethod).Warn("Unknown NickServ recovery method")
+	}
+}
+
+// nickRecoverLoop will periodically check if our primary nick is available
+// and try to reclaim it. If the server supports MONITOR, we use that,
+// otherwise we fall back to ISON.
+func (b *Bot) nickRecoverLoop(done <-chan struct{}) {
+	interval := b.config.NickRecoverInterval.Duration
+	if interval <= 0 {
+		interval = defaultNickRecoverInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if b.isPrimaryNick() {
+			continue
+		}
+
+		if _, ok := b.lookupISupport("MONITOR"); !ok {
+			b.nickLock.Lock()
+			b.isonPending = true
+			b.nickLock.Unlock()
+
+			b.Writef("ISON %s", b.config.Nick)
+			continue
+		}
+
+		b.nickLock.Lock()
+		monitoring := b.monitoring
+		b.monitoring = true
+		b.nickLock.Unlock()
+
+		// The server will tell us when the nick goes offline, so we only
+		// need to send this once.
+		if !monitoring {
+			b.Writef("MONITOR + %s", b.config.Nick)
+		}
+	}
+}
+
+func (b *Bot) isonCallback(m *irc.Message) {
+	// Other plugins may send their own ISON, so only look at replies to
+	// ours.
+	b.nickLock.Lock()
+	pending := b.isonPending
+	b.isonPending = false
+	b.nickLock.Unlock()
+
+	if !pending || b.isPrimaryNick() {
+		return
+	}
+
+	for _, nick := range strings.Fields(m.Trailing()) {
+		if b.nickEqual(nick, b.config.Nick) {
+			return
+		}
+	}
+
+	b.Writef("NICK %s", b.config.Nick)
+}
+
+func (b *Bot) monitorOfflineCallback(m *irc.Message) {
+	if b.isPrimaryNick() {
+		return
+	}
+
+	// Targets may be in the form of nick!user@host
+	for _, target := range strings.Split(m.Trailing(), ",") {
+		nick := strings.SplitN(target, "!", 2)[0]
+		if b.nickEqual(nick, b.config.Nick) {
+			b.Writef("NICK %s", b.config.Nick)
+			return
+		}
+	}
+}
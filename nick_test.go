@@ -0,0 +1,148 @@
+package seabird
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-irc/irc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextNick(t *testing.T) {
+	b := &Bot{
+		config: coreConfig{
+			Nick:     "seabird",
+			AltNicks: []string{"seabird2", "seabird3"},
+		},
+	}
+
+	assert.Equal(t, "seabird2", b.nextNick())
+	assert.Equal(t, "seabird3", b.nextNick())
+	assert.Equal(t, "seabird3_", b.nextNick())
+	assert.Equal(t, "seabird3__", b.nextNick())
+
+	// Without any alternate nicks, we should just start adding underscores.
+	b = &Bot{
+		config: coreConfig{
+			Nick: "seabird",
+		},
+	}
+
+	assert.Equal(t, "seabird_", b.nextNick())
+	assert.Equal(t, "seabird__", b.nextNick())
+}
+
+func newNickTestBot(buf *bytes.Buffer) *Bot {
+	b := &Bot{
+		mux: NewBasicMux(),
+		log: logrus.NewEntry(logrus.New()),
+		config: coreConfig{
+			Nick:     "seabird",
+			AltNicks: []string{"seabird2", "seabird3"},
+		},
+		client: irc.NewClient(buf, irc.ClientConfig{Nick: "seabird"}),
+		done:   make(chan struct{}),
+	}
+
+	return b
+}
+
+func TestNickUnavailable(t *testing.T) {
+	buf := &bytes.Buffer{}
+	b := newNickTestBot(buf)
+	defer close(b.done)
+
+	// The irc client retries taken nicks itself before registration, so we
+	// shouldn't send anything.
+	b.handleNickEvents(irc.MustParseMessage(":server 433 * seabird :Nickname is already in use"))
+	b.handleNickEvents(irc.MustParseMessage(":server 437 * seabird :Nick temporarily unavailable"))
+	assert.Equal(t, "", buf.String())
+
+	// Invalid nicks aren't handled by the client, so we try an alternate.
+	b.handleNickEvents(irc.MustParseMessage(":server 432 * seabird :Erroneous nickname"))
+	assert.Equal(t, "NICK seabird2\r\n", buf.String())
+	buf.Reset()
+
+	// Once we're registered with a fallback nick, we should work through
+	// the remaining alternates.
+	b.handleNickEvents(irc.MustParseMessage(":server 001 seabird_ :Welcome"))
+	assert.Equal(t, "NICK seabird3\r\n", buf.String())
+	buf.Reset()
+
+	b.handleNickEvents(irc.MustParseMessage(":server 433 seabird_ seabird3 :Nickname is already in use"))
+	assert.Equal(t, "", buf.String())
+
+	// A failed reclaim shouldn't trigger anything either.
+	b.handleNickEvents(irc.MustParseMessage(":server 433 seabird_ seabird :Nickname is already in use"))
+	assert.Equal(t, "", buf.String())
+}
+
+func TestNickRegisteredAltNick(t *testing.T) {
+	buf := &bytes.Buffer{}
+	b := newNickTestBot(buf)
+	defer close(b.done)
+
+	// We already have our first alternate, so there's nothing better to try
+	// other than the primary nick.
+	b.handleNickEvents(irc.MustParseMessage(":server 001 seabird2 :Welcome"))
+	assert.Equal(t, "", buf.String())
+	assert.Equal(t, "seabird2", b.CurrentNick())
+}
+
+func TestISONCallback(t *testing.T) {
+	buf := &bytes.Buffer{}
+	b := newNickTestBot(buf)
+	defer close(b.done)
+
+	b.handleNickEvents(irc.MustParseMessage(":server 001 seabird3 :Welcome"))
+	buf.Reset()
+
+	// ISON replies we didn't ask for should be ignored.
+	b.handleNickEvents(irc.MustParseMessage(":server 303 seabird3 :"))
+	assert.Equal(t, "", buf.String())
+
+	b.nickLock.Lock()
+	b.isonPending = true
+	b.nickLock.Unlock()
+
+	// Our primary nick is still online.
+	b.handleNickEvents(irc.MustParseMessage(":server 303 seabird3 :seabird"))
+	assert.Equal(t, "", buf.String())
+
+	b.nickLock.Lock()
+	b.isonPending = true
+	b.nickLock.Unlock()
+
+	b.handleNickEvents(irc.MustParseMessage(":server 303 seabird3 :"))
+	assert.Equal(t, "NICK seabird\r\n", buf.String())
+}
+
+func TestNickEqual(t *testing.T) {
+	var tests = []struct {
+		CaseMapping string
+		A, B        string
+		Expected    bool
+	}{
+		{"", "Seabird", "seabird", true},
+		{"", "seabird[m]", "Seabird{M}", true},
+		{"", "sea~bird", "sea^bird", true},
+		{"strict-rfc1459", "sea~bird", "sea^bird", false},
+		{"strict-rfc1459", "sea\\bird", "sea|bird", true},
+		{"ascii", "seabird[m]", "seabird{m}", false},
+		{"ascii", "SEABIRD", "seabird", true},
+		{"", "seabird", "seabird_", false},
+	}
+
+	for _, test := range tests {
+		b := &Bot{}
+		if test.CaseMapping != "" {
+			b.SetISupport(testISupport{"CASEMAPPING": test.CaseMapping})
+		}
+
+		assert.Equal(t, test.Expected, b.nickEqual(test.A, test.B), "%q vs %q with %q", test.A, test.B, test.CaseMapping)
+	}
+
+	// We don't know our nick before we've connected.
+	assert.Equal(t, "", (&Bot{}).CurrentNick())
+}
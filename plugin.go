@@ -1,9 +1,17 @@
 package seabird
 
-import "github.com/belak/go-plugin"
+import (
+	"path"
+
+	"github.com/belak/go-plugin"
+)
 
 var plugins = plugin.NewRegistry()
 
+// pluginNames is every plugin which was registered, so we can tell which ones
+// the config actually loaded.
+var pluginNames []string
+
 // RegisterPlugin registers a PluginFactory for a given name. It will
 // panic if multiple plugins are registered with the same name.
 func RegisterPlugin(name string, factory interface{}) {
@@ -11,4 +19,22 @@ func RegisterPlugin(name string, factory interface{}) {
 	if err != nil {
 		panic(err.Error())
 	}
+
+	pluginNames = append(pluginNames, name)
+}
+
+// matchPlugins returns the registered plugins matching any of the given
+// names, which may be globs like "url/*".
+func matchPlugins(patterns []string) []string {
+	var ret []string
+	for _, name := range pluginNames {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				ret = append(ret, name)
+				break
+			}
+		}
+	}
+
+	return ret
 }
@@ -3,6 +3,7 @@ package plugins
 import (
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/satori/go.uuid"
@@ -17,12 +18,17 @@ func init() {
 
 // Channel is an internal type for representing a channel.
 type Channel struct {
+	Name  string
 	users map[string]bool
+	lock  *sync.RWMutex
 }
 
 // HasUser returns true if the user is in the channel, otherwise
 // false.
 func (c *Channel) HasUser(user string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
 	return c.users[user]
 }
 
@@ -31,10 +37,14 @@ type User struct {
 	channels map[string]map[rune]bool
 	Nick     string
 	UUID     string
+	lock     *sync.RWMutex
 }
 
 // Channels returns which channels the user is currently in.
 func (u *User) Channels() []string {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
 	var ret []string
 	for k := range u.channels {
 		ret = append(ret, k)
@@ -45,6 +55,9 @@ func (u *User) Channels() []string {
 // ModesInChannel returns a mapping of channel modes to a bool indicating if
 // it's on or not for this user in this channel.
 func (u *User) ModesInChannel(channel string) map[rune]bool {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
 	ret, ok := u.channels[channel]
 	if !ok {
 		ret = make(map[rune]bool)
@@ -55,6 +68,9 @@ func (u *User) ModesInChannel(channel string) map[rune]bool {
 // InChannel returns true if the user is in the channel, otherwise
 // false.
 func (u *User) InChannel(channel string) bool {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
 	_, ok := u.channels[channel]
 	return ok
 }
@@ -66,6 +82,11 @@ func (u *User) InChannel(channel string) bool {
 type ChannelTracker struct {
 	isupport *ISupportPlugin
 
+	// lock protects all the state below, including the state in each
+	// Channel and User, because it may be accessed from outside the main
+	// event loop.
+	lock *sync.RWMutex
+
 	// Notes for internal fields. Be very careful when modifying the
 	// state. Because we control all of this, it is valid to make the
 	// assumption that if a user is in p.uuids, it will be possible to
@@ -82,13 +103,15 @@ type ChannelTracker struct {
 	// This simply maps the nick to the uuid
 	uuids map[string]string
 
-	// Session cleanup callbacks
+	// Session cleanup callbacks. These are called with the lock held, so
+	// they must not call back into the ChannelTracker.
 	cleanupCallbacks []func(u *User)
 }
 
 func newChannelTracker(bm *seabird.BasicMux, isupport *ISupportPlugin) *ChannelTracker {
 	p := &ChannelTracker{
 		isupport: isupport,
+		lock:     &sync.RWMutex{},
 		channels: make(map[string]*Channel),
 		users:    make(map[string]*User),
 		uuids:    make(map[string]string),
@@ -118,6 +141,13 @@ func newChannelTracker(bm *seabird.BasicMux, isupport *ISupportPlugin) *ChannelT
 // we don't know about this user. The returned value can be stored and
 // will track this user even if they change nicks.
 func (p *ChannelTracker) LookupUser(user string) *User {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.lookupUser(user)
+}
+
+func (p *ChannelTracker) lookupUser(user string) *User {
 	userUUID, ok := p.uuids[user]
 	if !ok {
 		return nil
@@ -128,7 +158,10 @@ func (p *ChannelTracker) LookupUser(user string) *User {
 // UsersInChannel will return all the users in the given channel name
 // or nil if we're not in that channel.
 func (p *ChannelTracker) UsersInChannel(channel string) []*User {
-	c := p.LookupChannel(channel)
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	c := p.lookupChannel(channel)
 	if c == nil {
 		return nil
 	}
@@ -143,11 +176,21 @@ func (p *ChannelTracker) UsersInChannel(channel string) []*User {
 // LookupChannel will return the Channel object for the given channel
 // name or nil if we're not in that channel.
 func (p *ChannelTracker) LookupChannel(channel string) *Channel {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.lookupChannel(channel)
+}
+
+func (p *ChannelTracker) lookupChannel(channel string) *Channel {
 	return p.channels[channel]
 }
 
 // Channels will return all the channel objects this bot knows about.
 func (p *ChannelTracker) Channels() []*Channel {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
 	var ret []*Channel
 	for _, v := range p.channels {
 		ret = append(ret, v)
@@ -158,12 +201,18 @@ func (p *ChannelTracker) Channels() []*Channel {
 // RegisterSessionCleanupCallback lets you register a function to be
 // called when a session is removed.
 func (p *ChannelTracker) RegisterSessionCleanupCallback(f func(u *User)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
 	p.cleanupCallbacks = append(p.cleanupCallbacks, f)
 }
 
 // Private functions
 
 func (p *ChannelTracker) joinCallback(b *seabird.Bot, m *irc.Message) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
 	user := m.Prefix.Name
 	channel := m.Trailing()
 
@@ -173,6 +222,9 @@ func (p *ChannelTracker) joinCallback(b *seabird.Bot, m *irc.Message) {
 }
 
 func (p *ChannelTracker) partCallback(b *seabird.Bot, m *irc.Message) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
 	user := m.Prefix.Name
 	channel := m.Params[0]
 
@@ -182,6 +234,9 @@ func (p *ChannelTracker) partCallback(b *seabird.Bot, m *irc.Message) {
 }
 
 func (p *ChannelTracker) kickCallback(b *seabird.Bot, m *irc.Message) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
 	//actor := m.Prefix.Name
 	user := m.Params[1]
 	channel := m.Params[0]
@@ -192,6 +247,9 @@ func (p *ChannelTracker) kickCallback(b *seabird.Bot, m *irc.Message) {
 }
 
 func (p *ChannelTracker) quitCallback(b *seabird.Bot, m *irc.Message) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
 	user := m.Prefix.Name
 
 	p.removeUser(b, user)
@@ -200,6 +258,9 @@ func (p *ChannelTracker) quitCallback(b *seabird.Bot, m *irc.Message) {
 }
 
 func (p *ChannelTracker) nickCallback(b *seabird.Bot, m *irc.Message) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
 	oldUser := m.Prefix.Name
 	newUser := m.Params[0]
 
@@ -209,6 +270,9 @@ func (p *ChannelTracker) nickCallback(b *seabird.Bot, m *irc.Message) {
 }
 
 func (p *ChannelTracker) modeCallback(b *seabird.Bot, m *irc.Message) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
 	// We only care about MODE messages where a specific user is
 	// changed.
 	if len(m.Params) < 3 {
@@ -221,8 +285,8 @@ func (p *ChannelTracker) modeCallback(b *seabird.Bot, m *irc.Message) {
 	target := m.Params[2]
 
 	// Ensure we know about this user and this channel
-	u := p.LookupUser(target)
-	c := p.LookupChannel(channel)
+	u := p.lookupUser(target)
+	c := p.lookupChannel(channel)
 	if u == nil || c == nil {
 		logger.Warnf("Got MODE callback for %s on %s but we aren't tracking both", target, channel)
 		return
@@ -235,6 +299,9 @@ func (p *ChannelTracker) modeCallback(b *seabird.Bot, m *irc.Message) {
 }
 
 func (p *ChannelTracker) whoCallback(b *seabird.Bot, m *irc.Message) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
 	// Filter out broken messages
 	if len(m.Params) < 7 {
 		return
@@ -253,8 +320,8 @@ func (p *ChannelTracker) whoCallback(b *seabird.Bot, m *irc.Message) {
 
 	logger := b.GetLogger()
 
-	u := p.LookupUser(nick)
-	c := p.LookupChannel(channel)
+	u := p.lookupUser(nick)
+	c := p.lookupChannel(channel)
 	if u == nil || c == nil {
 		logger.Warnf("Got WHO callback for %s on %s but we aren't tracking both", nick, channel)
 		return
@@ -320,6 +387,9 @@ func (p *ChannelTracker) getSymbolToPrefixMapping(b *seabird.Bot) (map[rune]rune
 }
 
 func (p *ChannelTracker) namesCallback(b *seabird.Bot, m *irc.Message) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
 	prefixes, ok := p.getSymbolToPrefixMapping(b)
 	if !ok {
 		return
@@ -348,7 +418,7 @@ func (p *ChannelTracker) namesCallback(b *seabird.Bot, m *irc.Message) {
 
 		p.addUserToChannel(b, user, channel)
 
-		u := p.LookupUser(user)
+		u := p.lookupUser(user)
 		if u == nil {
 			continue
 		}
@@ -395,12 +465,13 @@ func (p *ChannelTracker) addUserToChannel(b *seabird.Bot, user, channel string)
 		return
 	}
 
-	u := p.LookupUser(user)
+	u := p.lookupUser(user)
 	if u == nil {
 		u = &User{
 			Nick:     user,
 			UUID:     uuid.Must(uuid.NewV4()).String(),
 			channels: make(map[string]map[rune]bool),
+			lock:     p.lock,
 		}
 		p.users[u.UUID] = u
 		p.uuids[user] = u.UUID
@@ -428,7 +499,7 @@ func (p *ChannelTracker) removeUserFromChannel(b *seabird.Bot, user, channel str
 	if user == b.CurrentNick() {
 		p.removeChannel(b, channel)
 	} else {
-		u := p.LookupUser(user)
+		u := p.lookupUser(user)
 		if u == nil {
 			logger.Warn("Can't remove unknown user")
 			return
@@ -462,7 +533,9 @@ func (p *ChannelTracker) addChannel(b *seabird.Bot, channel string) {
 	}
 
 	p.channels[channel] = &Channel{
+		Name:  channel,
 		users: make(map[string]bool),
+		lock:  p.lock,
 	}
 
 	logger.Info("Added channel")
@@ -503,7 +576,7 @@ func (p *ChannelTracker) removeChannel(b *seabird.Bot, channel string) {
 func (p *ChannelTracker) removeUser(b *seabird.Bot, user string) {
 	logger := b.GetLogger().WithField("user", user)
 
-	u := p.LookupUser(user)
+	u := p.lookupUser(user)
 	if u == nil {
 		logger.Warn("User does not exist")
 		return
@@ -535,7 +608,7 @@ func (p *ChannelTracker) renameUser(b *seabird.Bot, oldNick, newNick string) {
 		"newNick": newNick,
 	})
 
-	u := p.LookupUser(oldNick)
+	u := p.lookupUser(oldNick)
 	if u == nil {
 		logger.Warn("Can't rename user that doesn't exist")
 		return
@@ -0,0 +1,316 @@
+package plugins
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/belak/go-seabird"
+)
+
+func init() {
+	seabird.RegisterPlugin("console", newConsolePlugin)
+}
+
+// ConsoleEnd is sent by the console after the output of every command so
+// clients know when a response is complete.
+const ConsoleEnd = "."
+
+type consoleConfig struct {
+	// Socket is the path to a unix socket to listen on. If it isn't set,
+	// Address will be used instead.
+	Socket string
+
+	// Address is a TCP address to listen on. Only localhost addresses are
+	// allowed because there is no authentication.
+	Address string
+}
+
+type consoleCommand struct {
+	usage       string
+	description string
+	handler     func(args string) ([]string, error)
+}
+
+// ConsolePlugin provides an admin console over a local socket which can be
+// used to inspect and control the bot while it's running.
+type ConsolePlugin struct {
+	b       *seabird.Bot
+	cm      *seabird.CommandMux
+	tracker *ChannelTracker
+	log     *logrus.Entry
+
+	listener net.Listener
+	commands map[string]*consoleCommand
+}
+
+func newConsolePlugin(b *seabird.Bot, cm *seabird.CommandMux, tracker *ChannelTracker) (*ConsolePlugin, error) {
+	p := &ConsolePlugin{
+		b:       b,
+		cm:      cm,
+		tracker: tracker,
+		log:     b.GetLogger().WithField("plugin", "console"),
+	}
+
+	cc := &consoleConfig{}
+	err := b.Config("console", cc)
+	if err != nil {
+		return nil, err
+	}
+
+	p.commands = map[string]*consoleCommand{
+		"raw":      {"<line>", "Send a raw line to the server", p.rawCommand},
+		"channels": {"", "List the channels the bot is in", p.channelsCommand},
+		"users":    {"<channel>", "List the users in a channel", p.usersCommand},
+		"plugins":  {"", "List the loaded plugins", p.pluginsCommand},
+		"commands": {"", "List the registered bot commands", p.commandsCommand},
+		"debug":    {"[on|off]", "Show or toggle debug logging", p.debugCommand},
+		"reload":   {"", "Reload the core config section (admins, debug, nicks)", p.reloadCommand},
+	}
+
+	p.listener, err = listenConsole(cc)
+	if err != nil {
+		return nil, err
+	}
+
+	p.log.WithField("addr", p.listener.Addr()).Info("Console listening")
+
+	go p.acceptLoop()
+
+	return p, nil
+}
+
+func listenConsole(cc *consoleConfig) (net.Listener, error) {
+	if cc.Socket != "" {
+		// Clean up a stale socket from a previous run
+		_ = os.Remove(cc.Socket)
+
+		l, err := net.Listen("unix", cc.Socket)
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.Chmod(cc.Socket, 0600)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+
+		return l, nil
+	}
+
+	if cc.Address == "" {
+		return nil, errors.New("Console requires either a socket or address")
+	}
+
+	host, _, err := net.SplitHostPort(cc.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("Console address %q is not a local address", cc.Address)
+	}
+
+	return net.Listen("tcp", cc.Address)
+}
+
+func (p *ConsolePlugin) acceptLoop() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			p.log.WithError(err).Error("Console stopped accepting connections")
+			return
+		}
+
+		go p.handleConn(conn)
+	}
+}
+
+func (p *ConsolePlugin) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	p.log.Info("Console client connected")
+
+	w := bufio.NewWriter(conn)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		for _, out := range p.runCommand(line) {
+			fmt.Fprintln(w, out)
+		}
+		fmt.Fprintln(w, ConsoleEnd)
+
+		if err := w.Flush(); err != nil {
+			break
+		}
+	}
+
+	p.log.Info("Console client disconnected")
+}
+
+func (p *ConsolePlugin) runCommand(line string) []string {
+	split := strings.SplitN(line, " ", 2)
+
+	name := strings.ToLower(split[0])
+	args := ""
+	if len(split) > 1 {
+		args = strings.TrimSpace(split[1])
+	}
+
+	if name == "help" {
+		return p.help()
+	}
+
+	cmd, ok := p.commands[name]
+	if !ok {
+		return []string{fmt.Sprintf("ERR unknown command %q", name)}
+	}
+
+	p.log.WithField("command", line).Debug("Running console command")
+
+	out, err := cmd.handler(args)
+	if err != nil {
+		return []string{"ERR " + err.Error()}
+	}
+
+	return append([]string{"OK"}, out...)
+}
+
+func (p *ConsolePlugin) help() []string {
+	var names []string
+	for k := range p.commands {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	ret := []string{"OK"}
+	for _, name := range names {
+		cmd := p.commands[name]
+		ret = append(ret, strings.TrimSpace(name+" "+cmd.usage)+": "+cmd.description)
+	}
+
+	return ret
+}
+
+func (p *ConsolePlugin) rawCommand(args string) ([]string, error) {
+	if args == "" {
+		return nil, errors.New("Line required")
+	}
+
+	if !p.b.Registered() {
+		return nil, errors.New("Not connected")
+	}
+
+	p.b.Write(args)
+
+	return nil, nil
+}
+
+func (p *ConsolePlugin) channelsCommand(args string) ([]string, error) {
+	var ret []string
+	for _, c := range p.tracker.Channels() {
+		ret = append(ret, fmt.Sprintf("%s (%d users)", c.Name, len(p.tracker.UsersInChannel(c.Name))))
+	}
+
+	sort.Strings(ret)
+
+	return ret, nil
+}
+
+func (p *ConsolePlugin) usersCommand(args string) ([]string, error) {
+	if args == "" {
+		return nil, errors.New("Channel required")
+	}
+
+	if p.tracker.LookupChannel(args) == nil {
+		return nil, fmt.Errorf("Not in channel %s", args)
+	}
+
+	var ret []string
+	for _, u := range p.tracker.UsersInChannel(args) {
+		var modes []string
+		for mode, on := range u.ModesInChannel(args) {
+			if on {
+				modes = append(modes, string(mode))
+			}
+		}
+		sort.Strings(modes)
+
+		if len(modes) > 0 {
+			ret = append(ret, fmt.Sprintf("%s (+%s)", u.Nick, strings.Join(modes, "")))
+		} else {
+			ret = append(ret, u.Nick)
+		}
+	}
+
+	sort.Strings(ret)
+
+	return ret, nil
+}
+
+func (p *ConsolePlugin) pluginsCommand(args string) ([]string, error) {
+	ret := p.b.Plugins()
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (p *ConsolePlugin) commandsCommand(args string) ([]string, error) {
+	commands := p.cm.Commands()
+
+	var names []string
+	for k := range commands {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var ret []string
+	for _, name := range names {
+		help := commands[name]
+		if help == nil || help.Description == "" {
+			ret = append(ret, name)
+		} else {
+			ret = append(ret, name+": "+help.Description)
+		}
+	}
+
+	return ret, nil
+}
+
+func (p *ConsolePlugin) debugCommand(args string) ([]string, error) {
+	switch strings.ToLower(args) {
+	case "":
+		p.b.SetDebug(!p.b.Debug())
+	case "on":
+		p.b.SetDebug(true)
+	case "off":
+		p.b.SetDebug(false)
+	default:
+		return nil, fmt.Errorf("Invalid debug state %q", args)
+	}
+
+	if p.b.Debug() {
+		return []string{"Debug logging enabled"}, nil
+	}
+
+	return []string{"Debug logging disabled"}, nil
+}
+
+func (p *ConsolePlugin) reloadCommand(args string) ([]string, error) {
+	err := p.b.ReloadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{"Core config reloaded"}, nil
+}
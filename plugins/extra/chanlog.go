@@ -0,0 +1,462 @@
+package extra
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/plugins"
+	"github.com/go-irc/irc"
+)
+
+func init() {
+	seabird.RegisterPlugin("chanlog", newChanLogPlugin)
+}
+
+type chanLogConfig struct {
+	// Dir is where logs are written. Each channel gets its own directory
+	// with one file per day.
+	Dir string
+
+	// Format is one of "irssi" (the default), "weechat" or "json".
+	Format string
+
+	// Exclude is a list of channels which should never be logged. Glob
+	// patterns like "#secret-*" are allowed.
+	Exclude []string
+}
+
+type chanLogPlugin struct {
+	tracker *plugins.ChannelTracker
+	config  chanLogConfig
+	format  chanLogFormatter
+
+	lock sync.Mutex
+
+	// channels is what channels each nick was last known to be in. By the
+	// time we see a QUIT, the tracker has already forgotten the user, so
+	// we need to know ahead of time where to log it.
+	channels map[string][]string
+}
+
+// ChanLogEvent is a single line in a channel log.
+type ChanLogEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Channel string    `json:"channel"`
+	Nick    string    `json:"nick"`
+	Host    string    `json:"host,omitempty"`
+	Text    string    `json:"text,omitempty"`
+
+	// Target is the user who was kicked or the new nick for a nick change.
+	Target string `json:"target,omitempty"`
+}
+
+// chanLogFormatter turns an event into a line for the log file, along with
+// the extension log files should use.
+type chanLogFormatter struct {
+	ext    string
+	format func(e *ChanLogEvent) string
+}
+
+var chanLogFormats = map[string]chanLogFormatter{
+	"irssi":   {".log", formatIrssiEvent},
+	"weechat": {".log", formatWeechatEvent},
+	"json":    {".jsonl", formatJSONEvent},
+}
+
+func newChanLogPlugin(b *seabird.Bot, m *seabird.BasicMux, tracker *plugins.ChannelTracker) error {
+	p := &chanLogPlugin{
+		tracker:  tracker,
+		channels: make(map[string][]string),
+	}
+
+	err := b.Config("chanlog", &p.config)
+	if err != nil {
+		return err
+	}
+
+	if p.config.Dir == "" {
+		return errors.New("A log dir is required")
+	}
+
+	if p.config.Format == "" {
+		p.config.Format = "irssi"
+	}
+
+	var ok bool
+	p.format, ok = chanLogFormats[p.config.Format]
+	if !ok {
+		return fmt.Errorf("Unknown log format %q", p.config.Format)
+	}
+
+	m.Event("PRIVMSG", p.msgCallback)
+	m.Event("NOTICE", p.msgCallback)
+	m.Event("CTCP", p.msgCallback)
+	m.Event("JOIN", p.joinCallback)
+	m.Event("PART", p.partCallback)
+	m.Event("KICK", p.kickCallback)
+	m.Event("QUIT", p.quitCallback)
+	m.Event("NICK", p.nickCallback)
+	m.Event("366", p.namesCallback)
+
+	b.RegisterOutgoingCallback(p.outgoingCallback)
+
+	return nil
+}
+
+// channelMatches returns true if the channel matches any of the given glob
+// patterns, ignoring case.
+func channelMatches(patterns []string, channel string) bool {
+	channel = strings.ToLower(channel)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), channel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filename returns where a channel's log for the given day lives.
+// Channel names can contain almost anything, so anything which could escape
+// the log dir is replaced.
+func (p *chanLogPlugin) filename(channel string, t time.Time) string {
+	dir := strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', 0:
+			return '_'
+		}
+		return r
+	}, strings.ToLower(channel))
+
+	if dir == "." || dir == ".." {
+		dir = "_" + dir
+	}
+
+	return filepath.Join(p.config.Dir, dir, t.Format("2006-01-02")+p.format.ext)
+}
+
+// write appends an event to the log for its channel. Files are opened for
+// each write, which keeps rotation simple and means nothing is left open if
+// the connection goes away.
+func (p *chanLogPlugin) write(b *seabird.Bot, e *ChanLogEvent) {
+	if channelMatches(p.config.Exclude, e.Channel) {
+		return
+	}
+
+	e.Time = time.Now()
+	filename := p.filename(e.Channel, e.Time)
+	logger := b.GetLogger().WithField("file", filename)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		logger.WithError(err).Error("Failed to create log dir")
+		return
+	}
+
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.WithError(err).Error("Failed to open channel log")
+		return
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(p.format.format(e) + "\n")
+	if err != nil {
+		logger.WithError(err).Error("Failed to write channel log")
+	}
+}
+
+// remember stores which channels a user is in according to the tracker.
+func (p *chanLogPlugin) remember(nick string) {
+	var channels []string
+	if user := p.tracker.LookupUser(nick); user != nil {
+		channels = user.Channels()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(channels) == 0 {
+		delete(p.channels, strings.ToLower(nick))
+	} else {
+		p.channels[strings.ToLower(nick)] = channels
+	}
+}
+
+// forget removes a user and returns the channels they were in.
+func (p *chanLogPlugin) forget(nick string) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	channels := p.channels[strings.ToLower(nick)]
+	delete(p.channels, strings.ToLower(nick))
+
+	return channels
+}
+
+func prefixHost(prefix *irc.Prefix) string {
+	if prefix.User == "" && prefix.Host == "" {
+		return ""
+	}
+	return prefix.User + "@" + prefix.Host
+}
+
+// logMessage logs a PRIVMSG, NOTICE or CTCP ACTION sent to a channel. Other
+// CTCPs and private messages are ignored.
+func (p *chanLogPlugin) logMessage(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 2 || m.Prefix == nil {
+		return
+	}
+
+	_, channel, ok := b.ChannelTarget(m.Params[0])
+	if !ok {
+		return
+	}
+
+	e := &ChanLogEvent{
+		Type:    "message",
+		Channel: channel,
+		Nick:    m.Prefix.Name,
+		Text:    m.Trailing(),
+	}
+
+	switch m.Command {
+	case "NOTICE":
+		e.Type = "notice"
+	case "CTCP":
+		if !strings.HasPrefix(e.Text, "ACTION ") {
+			return
+		}
+		e.Type = "action"
+		e.Text = strings.TrimPrefix(e.Text, "ACTION ")
+	case "PRIVMSG":
+		// Outgoing actions haven't been unwrapped like incoming ones.
+		if strings.HasPrefix(e.Text, "\x01ACTION ") && strings.HasSuffix(e.Text, "\x01") {
+			e.Type = "action"
+			e.Text = e.Text[len("\x01ACTION ") : len(e.Text)-1]
+		} else if strings.HasPrefix(e.Text, "\x01") {
+			return
+		}
+	}
+
+	p.write(b, e)
+}
+
+func (p *chanLogPlugin) msgCallback(b *seabird.Bot, m *irc.Message) {
+	p.logMessage(b, m)
+}
+
+// outgoingCallback logs what we say. The server doesn't echo our messages
+// back, but it does echo joins, parts and nick changes so those are logged
+// like anyone else's.
+func (p *chanLogPlugin) outgoingCallback(b *seabird.Bot, m *irc.Message) {
+	switch m.Command {
+	case "PRIVMSG", "NOTICE":
+		p.logMessage(b, m)
+	}
+}
+
+func (p *chanLogPlugin) joinCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 1 {
+		return
+	}
+
+	p.write(b, &ChanLogEvent{
+		Type:    "join",
+		Channel: m.Params[0],
+		Nick:    m.Prefix.Name,
+		Host:    prefixHost(m.Prefix),
+	})
+
+	p.remember(m.Prefix.Name)
+}
+
+func (p *chanLogPlugin) partCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 1 {
+		return
+	}
+
+	var reason string
+	if len(m.Params) > 1 {
+		reason = m.Params[1]
+	}
+
+	p.write(b, &ChanLogEvent{
+		Type:    "part",
+		Channel: m.Params[0],
+		Nick:    m.Prefix.Name,
+		Host:    prefixHost(m.Prefix),
+		Text:    reason,
+	})
+
+	p.remember(m.Prefix.Name)
+}
+
+func (p *chanLogPlugin) kickCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 2 {
+		return
+	}
+
+	var reason string
+	if len(m.Params) > 2 {
+		reason = m.Params[2]
+	}
+
+	p.write(b, &ChanLogEvent{
+		Type:    "kick",
+		Channel: m.Params[0],
+		Nick:    m.Prefix.Name,
+		Target:  m.Params[1],
+		Text:    reason,
+	})
+
+	p.remember(m.Params[1])
+}
+
+func (p *chanLogPlugin) quitCallback(b *seabird.Bot, m *irc.Message) {
+	var reason string
+	if len(m.Params) > 0 {
+		reason = m.Params[0]
+	}
+
+	for _, channel := range p.forget(m.Prefix.Name) {
+		p.write(b, &ChanLogEvent{
+			Type:    "quit",
+			Channel: channel,
+			Nick:    m.Prefix.Name,
+			Host:    prefixHost(m.Prefix),
+			Text:    reason,
+		})
+	}
+}
+
+func (p *chanLogPlugin) nickCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 1 {
+		return
+	}
+
+	oldNick := m.Prefix.Name
+	newNick := m.Params[0]
+
+	// The tracker has already seen the rename, so we can look up where the
+	// new nick is.
+	p.forget(oldNick)
+	p.remember(newNick)
+
+	var channels []string
+	if user := p.tracker.LookupUser(newNick); user != nil {
+		channels = user.Channels()
+	}
+
+	for _, channel := range channels {
+		p.write(b, &ChanLogEvent{
+			Type:    "nick",
+			Channel: channel,
+			Nick:    oldNick,
+			Target:  newNick,
+		})
+	}
+}
+
+// namesCallback picks up everyone who was already in a channel when we
+// joined it, so we know where to log their quits.
+func (p *chanLogPlugin) namesCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 2 {
+		return
+	}
+
+	for _, user := range p.tracker.UsersInChannel(m.Params[1]) {
+		p.remember(user.Nick)
+	}
+}
+
+func formatIrssiEvent(e *ChanLogEvent) string {
+	ts := e.Time.Format("15:04:05")
+
+	var host string
+	if e.Host != "" {
+		host = " [" + e.Host + "]"
+	}
+
+	var reason string
+	if e.Text != "" {
+		reason = " [" + e.Text + "]"
+	}
+
+	switch e.Type {
+	case "message":
+		return fmt.Sprintf("%s <%s> %s", ts, e.Nick, e.Text)
+	case "notice":
+		return fmt.Sprintf("%s -%s:%s- %s", ts, e.Nick, e.Channel, e.Text)
+	case "action":
+		return fmt.Sprintf("%s  * %s %s", ts, e.Nick, e.Text)
+	case "join":
+		return fmt.Sprintf("%s -!- %s%s has joined %s", ts, e.Nick, host, e.Channel)
+	case "part":
+		return fmt.Sprintf("%s -!- %s%s has left %s%s", ts, e.Nick, host, e.Channel, reason)
+	case "kick":
+		return fmt.Sprintf("%s -!- %s was kicked from %s by %s%s", ts, e.Target, e.Channel, e.Nick, reason)
+	case "quit":
+		return fmt.Sprintf("%s -!- %s%s has quit%s", ts, e.Nick, host, reason)
+	case "nick":
+		return fmt.Sprintf("%s -!- %s is now known as %s", ts, e.Nick, e.Target)
+	}
+
+	return fmt.Sprintf("%s -!- %s %s %s", ts, e.Nick, e.Type, e.Text)
+}
+
+func formatWeechatEvent(e *ChanLogEvent) string {
+	ts := e.Time.Format("2006-01-02 15:04:05")
+
+	var host string
+	if e.Host != "" {
+		host = " (" + e.Host + ")"
+	}
+
+	var reason string
+	if e.Text != "" {
+		reason = " (" + e.Text + ")"
+	}
+
+	switch e.Type {
+	case "message":
+		return fmt.Sprintf("%s\t%s\t%s", ts, e.Nick, e.Text)
+	case "notice":
+		return fmt.Sprintf("%s\t--\tNotice(%s): %s", ts, e.Nick, e.Text)
+	case "action":
+		return fmt.Sprintf("%s\t *\t%s %s", ts, e.Nick, e.Text)
+	case "join":
+		return fmt.Sprintf("%s\t-->\t%s%s has joined %s", ts, e.Nick, host, e.Channel)
+	case "part":
+		return fmt.Sprintf("%s\t<--\t%s%s has left %s%s", ts, e.Nick, host, e.Channel, reason)
+	case "kick":
+		return fmt.Sprintf("%s\t<--\t%s has kicked %s%s", ts, e.Nick, e.Target, reason)
+	case "quit":
+		return fmt.Sprintf("%s\t<--\t%s%s has quit%s", ts, e.Nick, host, reason)
+	case "nick":
+		return fmt.Sprintf("%s\t--\t%s is now known as %s", ts, e.Nick, e.Target)
+	}
+
+	return fmt.Sprintf("%s\t--\t%s %s %s", ts, e.Nick, e.Type, e.Text)
+}
+
+func formatJSONEvent(e *ChanLogEvent) string {
+	data, err := json.Marshal(e)
+	if err != nil {
+		// Everything in an event can be marshalled, so this shouldn't
+		// happen, but we'd rather have a line than nothing.
+		return fmt.Sprintf(`{"time":%q,"type":"error"}`, e.Time.Format(time.RFC3339))
+	}
+	return string(data)
+}
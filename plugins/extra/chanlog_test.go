@@ -0,0 +1,81 @@
+package extra
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	seabird "github.com/belak/go-seabird"
+	utils "github.com/belak/go-seabird/test-utils"
+	"github.com/go-irc/irc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	seabird.RegisterPlugin("test_reply", func(cm *seabird.CommandMux) {
+		cm.Event("hello", func(b *seabird.Bot, m *irc.Message) {
+			b.MentionReply(m, "hello to you too")
+		}, nil)
+	})
+}
+
+func TestChanLogReply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seabird-chanlog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cs, b := utils.NewTestBot(t, `
+plugins = ["isupport", "channel_track", "chanlog", "test_reply"]
+
+[chanlog]
+dir = "`+dir+`"
+format = "json"
+`)
+
+	cs.SendServerLines([]string{
+		":server 001 seabird :Welcome",
+		":belak!belak@example.com PRIVMSG #seabird :!hello",
+	})
+
+	// Replying from inside a handler used to deadlock when anything was
+	// watching outgoing messages, so make sure we get through this.
+	done := make(chan struct{})
+	go func() {
+		b.Run(cs)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Bot didn't finish handling messages")
+	}
+
+	// CheckLines splits on line endings, so the last line is empty.
+	cs.CheckLines(t, []string{
+		"PASS :password",
+		"NICK :seabird",
+		"USER seabird_user 0.0.0.0 0.0.0.0 :Seabird Bot",
+		"PRIVMSG #seabird :belak: hello to you too",
+		"",
+	})
+
+	// Both sides of the conversation should have been logged.
+	files, err := filepath.Glob(filepath.Join(dir, "#seabird", "*"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	data, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+
+	// The reply goes out before chanlog sees the message it's replying to,
+	// so we don't check the order.
+	logged := string(data)
+	assert.Equal(t, 2, strings.Count(logged, "\n"))
+	assert.Contains(t, logged, `"nick":"belak","text":"!hello"`)
+	assert.Contains(t, logged, `"nick":"seabird","text":"belak: hello to you too"`)
+}
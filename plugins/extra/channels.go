@@ -0,0 +1,431 @@
+package extra
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/storage"
+	"github.com/go-irc/irc"
+)
+
+func init() {
+	seabird.RegisterPlugin("channels", newChannelsPlugin)
+}
+
+type channelsConfig struct {
+	// RejoinDelay is the initial delay before trying to rejoin a channel after
+	// being kicked or failing to join. It doubles with every failed attempt up
+	// to MaxRejoinDelay.
+	RejoinDelay    seabird.Duration
+	MaxRejoinDelay seabird.Duration
+
+	// MaxJoinAttempts is the number of times we'll try to join a channel
+	// before giving up. 0 means we never give up.
+	MaxJoinAttempts int
+
+	RejoinOnKick  bool
+	AcceptInvites bool
+
+	// InviteFrom is a list of hostmasks we'll accept invites from. Admins
+	// are always trusted.
+	InviteFrom []string
+}
+
+// channelEntry is a channel we want to be in. It is used both for the
+// [[channel]] config section and for channels stored in the db.
+type channelEntry struct {
+	Name string
+	Key  string
+
+	// Parted is only used in the db. It marks a channel from the config
+	// which was left with !part, so we don't rejoin it on the next start.
+	Parted bool `toml:"-"`
+}
+
+type managedChannel struct {
+	channelEntry
+
+	// Persisted is true if this channel was added via !join and stored in
+	// the db rather than coming from the config.
+	Persisted bool
+
+	attempts int
+	joined   bool
+	timer    *time.Timer
+}
+
+type channelsPlugin struct {
+	db     *storage.Namespace
+	config channelsConfig
+
+	lock     *sync.Mutex
+	channels map[string]*managedChannel
+
+	// configured is the channels listed in the config.
+	configured map[string]bool
+}
+
+func newChannelsPlugin(b *seabird.Bot, bm *seabird.BasicMux, cm *seabird.CommandMux, store *storage.Store) error {
+	p := &channelsPlugin{
+		db: store.Namespace("channels"),
+		config: channelsConfig{
+			RejoinDelay:    seabird.Duration{Duration: 5 * time.Second},
+			MaxRejoinDelay: seabird.Duration{Duration: 10 * time.Minute},
+			RejoinOnKick:   true,
+		},
+		lock:       &sync.Mutex{},
+		channels:   make(map[string]*managedChannel),
+		configured: make(map[string]bool),
+	}
+
+	// Both of these sections are optional.
+	_ = b.Config("channels", &p.config)
+
+	var configChannels []channelEntry
+	_ = b.Config("channel", &configChannels)
+
+	for _, c := range configChannels {
+		p.channels[p.cleanedName(c.Name)] = &managedChannel{channelEntry: c}
+		p.configured[p.cleanedName(c.Name)] = true
+	}
+
+	err := p.db.EnsureBucket("list")
+	if err != nil {
+		return err
+	}
+
+	err = p.db.View(func(tx storage.Tx) error {
+		v := &channelEntry{}
+		return tx.Bucket("list").ForEach(v, func(key string) error {
+			if v.Parted {
+				delete(p.channels, p.cleanedName(v.Name))
+				return nil
+			}
+
+			p.channels[p.cleanedName(v.Name)] = &managedChannel{
+				channelEntry: *v,
+				Persisted:    true,
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	bm.Event("001", p.connectCallback)
+	bm.Event("JOIN", p.joinCallback)
+	bm.Event("PART", p.partCallback)
+	bm.Event("KICK", p.kickCallback)
+	bm.Event("INVITE", p.inviteCallback)
+
+	// ERR_CHANNELISFULL, ERR_INVITEONLYCHAN, ERR_BANNEDFROMCHAN,
+	// ERR_BADCHANNELKEY
+	bm.Event("471", p.joinErrorCallback)
+	bm.Event("473", p.joinErrorCallback)
+	bm.Event("474", p.joinErrorCallback)
+	bm.Event("475", p.joinErrorCallback)
+
+	cm.Event("join", p.joinCommand, &seabird.HelpInfo{
+		Usage:       "<channel> [key]",
+		Description: "Joins a channel and remembers it. Admin only.",
+	})
+
+	cm.Event("part", p.partCommand, &seabird.HelpInfo{
+		Usage:       "[channel]",
+		Description: "Leaves a channel and forgets it. Admin only.",
+	})
+
+	return nil
+}
+
+func (p *channelsPlugin) cleanedName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func (p *channelsPlugin) sendJoin(b *seabird.Bot, c *managedChannel) {
+	if c.Key != "" {
+		b.Writef("JOIN %s %s", c.Name, c.Key)
+	} else {
+		b.Writef("JOIN %s", c.Name)
+	}
+}
+
+// scheduleJoin will try to join the given channel after an exponential
+// backoff. It must be called with the lock held.
+func (p *channelsPlugin) scheduleJoin(b *seabird.Bot, c *managedChannel) {
+	logger := b.GetLogger().WithFields(logrus.Fields{
+		"channel":  c.Name,
+		"attempts": c.attempts,
+	})
+
+	if p.config.MaxJoinAttempts > 0 && c.attempts >= p.config.MaxJoinAttempts {
+		logger.Warn("Giving up on joining channel")
+		return
+	}
+
+	delay := p.config.RejoinDelay.Duration
+	for i := 0; i < c.attempts && delay < p.config.MaxRejoinDelay.Duration; i++ {
+		delay *= 2
+	}
+	if delay > p.config.MaxRejoinDelay.Duration {
+		delay = p.config.MaxRejoinDelay.Duration
+	}
+
+	c.attempts++
+
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+
+	name := p.cleanedName(c.Name)
+	c.timer = time.AfterFunc(delay, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		// Make sure we still want to be in this channel
+		c, ok := p.channels[name]
+		if !ok || c.joined {
+			return
+		}
+
+		p.sendJoin(b, c)
+	})
+
+	logger.WithField("delay", delay).Info("Scheduled channel join")
+}
+
+func (p *channelsPlugin) connectCallback(b *seabird.Bot, m *irc.Message) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, c := range p.channels {
+		c.joined = false
+		c.attempts = 0
+		p.sendJoin(b, c)
+	}
+}
+
+func (p *channelsPlugin) joinCallback(b *seabird.Bot, m *irc.Message) {
+	if m.Prefix.Name != b.CurrentNick() {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	c, ok := p.channels[p.cleanedName(m.Params[0])]
+	if !ok {
+		return
+	}
+
+	c.joined = true
+	c.attempts = 0
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+func (p *channelsPlugin) partCallback(b *seabird.Bot, m *irc.Message) {
+	if m.Prefix.Name != b.CurrentNick() {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if c, ok := p.channels[p.cleanedName(m.Params[0])]; ok {
+		c.joined = false
+	}
+}
+
+func (p *channelsPlugin) kickCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 2 || m.Params[1] != b.CurrentNick() {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	c, ok := p.channels[p.cleanedName(m.Params[0])]
+	if !ok {
+		return
+	}
+
+	c.joined = false
+
+	b.GetLogger().WithFields(logrus.Fields{
+		"channel": c.Name,
+		"kicker":  m.Prefix.Name,
+		"reason":  m.Trailing(),
+	}).Warn("Kicked from channel")
+
+	if p.config.RejoinOnKick {
+		p.scheduleJoin(b, c)
+	}
+}
+
+func (p *channelsPlugin) joinErrorCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 2 {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	c, ok := p.channels[p.cleanedName(m.Params[1])]
+	if !ok {
+		return
+	}
+
+	b.GetLogger().WithFields(logrus.Fields{
+		"channel": c.Name,
+		"code":    m.Command,
+		"reason":  m.Trailing(),
+	}).Warn("Failed to join channel")
+
+	p.scheduleJoin(b, c)
+}
+
+func (p *channelsPlugin) trustedInviter(b *seabird.Bot, m *irc.Message) bool {
+	if b.IsAdmin(m) {
+		return true
+	}
+
+	for _, mask := range p.config.InviteFrom {
+		if seabird.MatchMask(mask, m.Prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *channelsPlugin) inviteCallback(b *seabird.Bot, m *irc.Message) {
+	if !p.config.AcceptInvites || len(m.Params) < 2 {
+		return
+	}
+
+	channel := m.Params[1]
+
+	logger := b.GetLogger().WithFields(logrus.Fields{
+		"channel": channel,
+		"inviter": m.Prefix.String(),
+	})
+
+	if !p.trustedInviter(b, m) {
+		logger.Info("Ignoring invite from untrusted user")
+		return
+	}
+
+	logger.Info("Accepting invite")
+
+	b.Writef("JOIN %s", channel)
+}
+
+func (p *channelsPlugin) joinCommand(b *seabird.Bot, m *irc.Message) {
+	if !b.IsAdmin(m) {
+		b.MentionReply(m, "Permission denied")
+		return
+	}
+
+	args := strings.Fields(m.Trailing())
+	if len(args) < 1 {
+		b.MentionReply(m, "Channel required")
+		return
+	}
+
+	// STATUSMSG prefixes make sense for messages, but not for joins.
+	if prefix, _, ok := b.ChannelTarget(args[0]); !ok || prefix != "" {
+		b.MentionReply(m, "%q is not a channel", args[0])
+		return
+	}
+
+	entry := channelEntry{Name: args[0]}
+	if len(args) > 1 {
+		entry.Key = args[1]
+	}
+
+	key := p.cleanedName(entry.Name)
+
+	err := p.db.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("list")
+		return bucket.Put(key, &entry)
+	})
+	if err != nil {
+		b.MentionReply(m, "Failed to store channel: %s", err)
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	c, ok := p.channels[key]
+	if !ok {
+		c = &managedChannel{}
+		p.channels[key] = c
+	}
+	c.channelEntry = entry
+	c.Persisted = true
+	c.attempts = 0
+
+	p.sendJoin(b, c)
+
+	b.MentionReply(m, "Joining %s", entry.Name)
+}
+
+func (p *channelsPlugin) partCommand(b *seabird.Bot, m *irc.Message) {
+	if !b.IsAdmin(m) {
+		b.MentionReply(m, "Permission denied")
+		return
+	}
+
+	args := strings.SplitN(m.Trailing(), " ", 2)
+
+	channel := args[0]
+	if channel == "" {
+		if !b.FromChannel(m) {
+			b.MentionReply(m, "Channel required")
+			return
+		}
+
+		_, channel, _ = b.ChannelTarget(m.Params[0])
+	}
+
+	reason := "Leaving"
+	if len(args) > 1 {
+		reason = args[1]
+	}
+
+	key := p.cleanedName(channel)
+
+	// Channels from the config would come back on the next start, so we
+	// remember that we left those.
+	err := p.db.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("list")
+		if p.configured[key] {
+			return bucket.Put(key, &channelEntry{Name: channel, Parted: true})
+		}
+		return bucket.Delete(key)
+	})
+	if err != nil {
+		b.MentionReply(m, "Failed to remove channel: %s", err)
+		return
+	}
+
+	p.lock.Lock()
+	if c, ok := p.channels[key]; ok {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		delete(p.channels, key)
+	}
+	p.lock.Unlock()
+
+	b.Writef("PART %s :%s", channel, reason)
+}
@@ -1,7 +1,10 @@
 package extra
 
 import (
+	"time"
+
 	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/storage"
 	"github.com/belak/nut"
 )
 
@@ -10,20 +13,103 @@ func init() {
 }
 
 type dbConfig struct {
+	// Driver is the storage backend to use. It can be either "nut" (the
+	// default) or "sqlite".
+	Driver   string
 	Filename string
+
+	// If BackupDir is set, the store will be exported there every
+	// BackupInterval (default 24h) and only the newest BackupKeep (default
+	// 7) backups will be kept.
+	BackupDir      string
+	BackupInterval seabird.Duration
+	BackupKeep     int
+}
+
+// newDBPlugin provides the store to other plugins. The raw *nut.DB is also
+// provided for plugins which haven't moved over to the store yet, but it will
+// be nil unless the nut driver is being used.
+func newDBPlugin(b *seabird.Bot) (*storage.Store, *nut.DB, error) {
+	store, err := OpenStore(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dbc := &dbConfig{}
+	err = b.Config("db", dbc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if dbc.BackupDir != "" {
+		if dbc.BackupInterval.Duration <= 0 {
+			dbc.BackupInterval.Duration = 24 * time.Hour
+		}
+		if dbc.BackupKeep == 0 {
+			dbc.BackupKeep = 7
+		}
+
+		go backupLoop(b, store, dbc)
+	}
+
+	return store, storage.NutDB(store.Backend), nil
+}
+
+// OpenStore opens the store described by the bot's db config section and
+// runs any pending migrations. This is used both by the db plugin and by the
+// db subcommands.
+func OpenStore(b *seabird.Bot) (*storage.Store, error) {
+	store, err := OpenStoreNoMigrate(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bring all the plugin data up to date before anything uses it.
+	err = store.Migrate()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return store, nil
 }
 
-func newDBPlugin(b *seabird.Bot) (*nut.DB, error) {
+// OpenStoreNoMigrate is like OpenStore, but it leaves the data as it is. This
+// is meant for imports, which need to migrate after loading the data.
+func OpenStoreNoMigrate(b *seabird.Bot) (*storage.Store, error) {
 	dbc := &dbConfig{}
 	err := b.Config("db", dbc)
 	if err != nil {
 		return nil, err
 	}
 
-	ndb, err := nut.Open(dbc.Filename, 0700)
+	backend, err := storage.Open(dbc.Driver, dbc.Filename)
 	if err != nil {
 		return nil, err
 	}
 
-	return ndb, nil
+	store, err := storage.NewStore(backend)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func backupLoop(b *seabird.Bot, store *storage.Store, dbc *dbConfig) {
+	logger := b.GetLogger().WithField("dir", dbc.BackupDir)
+
+	ticker := time.NewTicker(dbc.BackupInterval.Duration)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		filename, err := store.Backup(dbc.BackupDir, dbc.BackupKeep)
+		if err != nil {
+			logger.WithError(err).Error("Failed to back up database")
+			continue
+		}
+
+		logger.WithField("file", filename).Info("Backed up database")
+	}
 }
@@ -0,0 +1,42 @@
+package extra
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// These are shared by the plugins which take durations from users, like
+// remind and poll.
+var (
+	timeRegexp     = regexp.MustCompile(`\d+[smhd]`)
+	durationRegexp = regexp.MustCompile(`^(\d+[smhd])+$`)
+)
+
+// parseDuration parses durations like "1h30m" with the addition of days.
+func parseDuration(text string) (time.Duration, error) {
+	var ret time.Duration
+
+	for _, match := range timeRegexp.FindAllString(text, -1) {
+		n, err := strconv.Atoi(match[:len(match)-1])
+		if err != nil {
+			return ret, err
+		}
+
+		switch match[len(match)-1] {
+		case 's':
+			ret += time.Duration(n) * time.Second
+		case 'm':
+			ret += time.Duration(n) * time.Minute
+		case 'h':
+			ret += time.Duration(n) * time.Hour
+		case 'd':
+			ret += time.Duration(n) * 24 * time.Hour
+		default:
+			return ret, errors.New("Unknown time type")
+		}
+	}
+
+	return ret, nil
+}
@@ -11,7 +11,7 @@ import (
 	"googlemaps.github.io/maps"
 
 	"github.com/belak/go-seabird"
-	"github.com/belak/nut"
+	"github.com/belak/go-seabird/storage"
 	"github.com/go-irc/irc"
 )
 
@@ -22,7 +22,7 @@ func init() {
 type forecastPlugin struct {
 	Key        string
 	MapsKey    string
-	db         *nut.DB
+	db         *storage.Namespace
 	mapsClient *maps.Client
 	// CacheDuration string
 }
@@ -37,11 +37,11 @@ type ForecastLocation struct {
 	Lon     float64
 }
 
-func newForecastPlugin(b *seabird.Bot, cm *seabird.CommandMux, db *nut.DB) error {
-	p := &forecastPlugin{db: db}
+func newForecastPlugin(b *seabird.Bot, cm *seabird.CommandMux, store *storage.Store) error {
+	p := &forecastPlugin{db: store.Namespace("forecast")}
 
 	// Ensure the table is created if it doesn't exist
-	err := p.db.EnsureBucket("forecast_location")
+	err := p.db.EnsureBucket("location")
 	if err != nil {
 		return err
 	}
@@ -92,8 +92,8 @@ func (p *forecastPlugin) getLocation(m *irc.Message) (*ForecastLocation, error)
 
 	// If it's an empty string, check the cache
 	if l == "" {
-		err := p.db.View(func(tx *nut.Tx) error {
-			bucket := tx.Bucket("forecast_location")
+		err := p.db.View(func(tx storage.Tx) error {
+			bucket := tx.Bucket("location")
 			return bucket.Get(target.Nick, target)
 		})
 		if err != nil {
@@ -122,8 +122,8 @@ func (p *forecastPlugin) getLocation(m *irc.Message) (*ForecastLocation, error)
 		Lon:     res[0].Geometry.Location.Lng,
 	}
 
-	err = p.db.Update(func(tx *nut.Tx) error {
-		bucket := tx.Bucket("forecast_location")
+	err = p.db.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("location")
 		return bucket.Put(newLocation.Nick, newLocation)
 	})
 
@@ -0,0 +1,410 @@
+package extra
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/storage"
+	"github.com/go-irc/irc"
+)
+
+func init() {
+	seabird.RegisterPlugin("history", newHistoryPlugin)
+}
+
+type historyConfig struct {
+	// Exclude is a list of channels which shouldn't be stored, in addition
+	// to any excluded from the chanlog plugin. Glob patterns are allowed.
+	Exclude []string
+
+	// MaxReplies is how many results can be sent to the channel. Anything
+	// longer is pasted if PasteKey is set or sent privately, up to
+	// MaxPrivate lines.
+	MaxReplies int
+	MaxPrivate int
+	PasteKey   string
+
+	// MaxScan is the most lines a search will look through.
+	MaxScan int
+}
+
+type historyPlugin struct {
+	db     *storage.Namespace
+	config historyConfig
+	prefix string
+}
+
+// HistoryLine is a single message said in a channel.
+type HistoryLine struct {
+	ID      string
+	Channel string
+	Nick    string
+	Text    string
+	Time    time.Time
+}
+
+func newHistoryPlugin(b *seabird.Bot, m *seabird.BasicMux, cm *seabird.CommandMux, store *storage.Store) error {
+	p := &historyPlugin{
+		db:     store.Namespace("history"),
+		prefix: cm.Prefix(),
+	}
+
+	p.config.MaxReplies = 3
+	p.config.MaxPrivate = 20
+	p.config.MaxScan = 50000
+	_ = b.Config("history", &p.config)
+
+	// Channels which aren't logged shouldn't be searchable either.
+	clc := &chanLogConfig{}
+	if err := b.Config("chanlog", clc); err == nil {
+		p.config.Exclude = append(p.config.Exclude, clc.Exclude...)
+	}
+
+	for _, name := range []string{"lines", "by_nick"} {
+		if err := p.db.EnsureBucket(name); err != nil {
+			return err
+		}
+	}
+
+	m.Event("PRIVMSG", p.msgCallback)
+
+	cm.Event("grep", p.grepCallback, &seabird.HelpInfo{
+		Usage:       "<regex>",
+		Description: "Searches what has been said in this channel",
+	})
+	cm.Event("quote", p.quoteCallback, &seabird.HelpInfo{
+		Usage:       "<nick>",
+		Description: "Shows a random line someone has said in this channel",
+	})
+	cm.Event("last", p.lastCallback, &seabird.HelpInfo{
+		Usage:       "<nick> [count]",
+		Description: "Shows the last things someone said in this channel",
+	})
+
+	return nil
+}
+
+// historyKeys returns the key for a line and its key in the by-nick index.
+// IDs are inverted so the newest lines come first.
+func historyKeys(line *HistoryLine) (string, string) {
+	id, _ := strconv.ParseUint(line.ID, 10, 64)
+	inverted := fmt.Sprintf("%020d", math.MaxUint64-id)
+	channel := strings.ToLower(line.Channel)
+
+	return channel + "\x00" + inverted,
+		channel + "\x00" + strings.ToLower(line.Nick) + "\x00" + inverted
+}
+
+func (l *HistoryLine) String() string {
+	return fmt.Sprintf("[%s] <%s> %s", l.Time.Format("2006-01-02 15:04"), l.Nick, l.Text)
+}
+
+func (p *historyPlugin) msgCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 2 || !b.FromChannel(m) || m.Prefix.Name == "" {
+		return
+	}
+
+	_, channel, _ := b.ChannelTarget(m.Params[0])
+	if channelMatches(p.config.Exclude, channel) {
+		return
+	}
+
+	// Commands would mostly just match searches for themselves.
+	text := m.Trailing()
+	if strings.HasPrefix(text, p.prefix) {
+		return
+	}
+
+	err := p.db.Update(func(tx storage.Tx) error {
+		lines := tx.Bucket("lines")
+
+		id, err := lines.NextID()
+		if err != nil {
+			return err
+		}
+
+		line := &HistoryLine{
+			ID:      id,
+			Channel: channel,
+			Nick:    m.Prefix.Name,
+			Text:    text,
+			Time:    time.Now(),
+		}
+
+		key, nickKey := historyKeys(line)
+
+		err = lines.Put(key, line)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket("by_nick").Put(nickKey, key)
+	})
+	if err != nil {
+		b.GetLogger().WithError(err).Warn("Failed to store history")
+	}
+}
+
+// historyChannel returns the channel a command was used in, or replies with
+// an error and returns false if history isn't available there.
+func (p *historyPlugin) historyChannel(b *seabird.Bot, m *irc.Message) (string, bool) {
+	_, channel, ok := b.ChannelTarget(m.Params[0])
+	if !ok {
+		b.MentionReply(m, "Must be used in a channel")
+		return "", false
+	}
+
+	if channelMatches(p.config.Exclude, channel) {
+		b.MentionReply(m, "History isn't kept for %s", channel)
+		return "", false
+	}
+
+	return channel, true
+}
+
+// nickLines calls fn with the lines a nick said in a channel, newest first,
+// until fn returns false.
+func nickLines(tx storage.Tx, channel, nick string, fn func(line *HistoryLine) bool) error {
+	lines := tx.Bucket("lines")
+
+	var key string
+	prefix := strings.ToLower(channel) + "\x00" + strings.ToLower(nick) + "\x00"
+	return storage.ForEachPrefix(tx.Bucket("by_nick"), prefix, &key, func(string) bool {
+		line := &HistoryLine{}
+		if err := lines.Get(key, line); err != nil {
+			return true
+		}
+
+		return fn(line)
+	})
+}
+
+// sendResults replies with short results directly. Longer results are
+// pasted if we can, otherwise they're sent privately.
+func (p *historyPlugin) sendResults(b *seabird.Bot, m *irc.Message, results []string, truncated bool) {
+	if len(results) <= p.config.MaxReplies && !truncated {
+		for _, result := range results {
+			b.MentionReply(m, "%s", result)
+		}
+		return
+	}
+
+	if p.config.PasteKey != "" {
+		go func() {
+			url, err := pastebin(p.config.PasteKey, strings.Join(results, "\n"))
+			if err != nil {
+				b.MentionReply(m, "Failed to paste results: %s", err)
+				return
+			}
+
+			b.MentionReply(m, "%d results: %s", len(results), url)
+		}()
+		return
+	}
+
+	if len(results) > p.config.MaxPrivate {
+		results = results[:p.config.MaxPrivate]
+		truncated = true
+	}
+
+	for _, result := range results {
+		b.PrivateReply(m, "%s", result)
+	}
+
+	if truncated {
+		b.MentionReply(m, "Sent you the first %d results", len(results))
+	} else {
+		b.MentionReply(m, "Sent you %d results", len(results))
+	}
+}
+
+func (p *historyPlugin) grepCallback(b *seabird.Bot, m *irc.Message) {
+	channel, ok := p.historyChannel(b, m)
+	if !ok {
+		return
+	}
+
+	expr := strings.TrimSpace(m.Trailing())
+	if expr == "" {
+		b.MentionReply(m, "Search required")
+		return
+	}
+
+	re, err := regexp.Compile("(?i)" + expr)
+	if err != nil {
+		b.MentionReply(m, "Invalid regex: %s", err)
+		return
+	}
+
+	// Collect one more than we can send so we know if there were more.
+	limit := p.config.MaxPrivate
+	if limit < p.config.MaxReplies {
+		limit = p.config.MaxReplies
+	}
+
+	// Only this channel's lines are visited, and every one of them counts
+	// towards MaxScan whether it matched or not.
+	var results []string
+	err = p.db.View(func(tx storage.Tx) error {
+		scanned := 0
+		line := &HistoryLine{}
+		return storage.ForEachPrefix(tx.Bucket("lines"), strings.ToLower(channel)+"\x00", line, func(string) bool {
+			if re.MatchString(line.Text) {
+				results = append(results, line.String())
+			}
+
+			scanned++
+			return len(results) <= limit && scanned < p.config.MaxScan
+		})
+	})
+	if err != nil {
+		b.MentionReply(m, "Failed to search history: %s", err)
+		return
+	}
+
+	if len(results) == 0 {
+		b.MentionReply(m, "No matches")
+		return
+	}
+
+	truncated := len(results) > limit
+	if truncated {
+		results = results[:limit]
+	}
+
+	p.sendResults(b, m, results, truncated)
+}
+
+// pluginLoaded returns true if the named plugin was loaded.
+func pluginLoaded(b *seabird.Bot, name string) bool {
+	for _, loaded := range b.Plugins() {
+		if loaded == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isQuotesArg returns true if arg is a quote ID or one of the quotes plugin's
+// subcommands.
+func isQuotesArg(arg string) bool {
+	switch arg {
+	case "random", "add", "search", "del":
+		return true
+	}
+
+	_, err := strconv.ParseUint(strings.TrimPrefix(arg, "#"), 10, 64)
+	return err == nil
+}
+
+// quoteCallback shows a random line someone said. The quotes plugin also
+// uses !quote, so when it's loaded anything other than a single nick is left
+// for it to handle.
+func (p *historyPlugin) quoteCallback(b *seabird.Bot, m *irc.Message) {
+	args := strings.Fields(m.Trailing())
+	if pluginLoaded(b, "quotes") && (len(args) != 1 || isQuotesArg(args[0])) {
+		return
+	}
+
+	channel, ok := p.historyChannel(b, m)
+	if !ok {
+		return
+	}
+
+	if len(args) != 1 {
+		b.MentionReply(m, "Nick required")
+		return
+	}
+	nick := args[0]
+
+	var chosen *HistoryLine
+	err := p.db.View(func(tx storage.Tx) error {
+		count := 0
+		err := nickLines(tx, channel, nick, func(*HistoryLine) bool {
+			count++
+			return true
+		})
+		if err != nil || count == 0 {
+			return err
+		}
+
+		n := rand.Intn(count)
+		return nickLines(tx, channel, nick, func(line *HistoryLine) bool {
+			if n == 0 {
+				chosen = line
+				return false
+			}
+			n--
+			return true
+		})
+	})
+	if err != nil {
+		b.MentionReply(m, "Failed to look up history: %s", err)
+		return
+	}
+
+	if chosen == nil {
+		b.MentionReply(m, "I haven't seen %s say anything in %s", nick, channel)
+		return
+	}
+
+	b.MentionReply(m, "%s", chosen)
+}
+
+func (p *historyPlugin) lastCallback(b *seabird.Bot, m *irc.Message) {
+	channel, ok := p.historyChannel(b, m)
+	if !ok {
+		return
+	}
+
+	args := strings.Fields(m.Trailing())
+	if len(args) < 1 || len(args) > 2 {
+		b.MentionReply(m, "Usage: <nick> [count]")
+		return
+	}
+
+	count := 1
+	if len(args) == 2 {
+		var err error
+		count, err = strconv.Atoi(args[1])
+		if err != nil || count < 1 {
+			b.MentionReply(m, "Invalid count %q", args[1])
+			return
+		}
+	}
+
+	if count > p.config.MaxPrivate {
+		count = p.config.MaxPrivate
+	}
+
+	var lines []*HistoryLine
+	err := p.db.View(func(tx storage.Tx) error {
+		return nickLines(tx, channel, args[0], func(line *HistoryLine) bool {
+			lines = append(lines, line)
+			return len(lines) < count
+		})
+	})
+	if err != nil {
+		b.MentionReply(m, "Failed to look up history: %s", err)
+		return
+	}
+
+	if len(lines) == 0 {
+		b.MentionReply(m, "I haven't seen %s say anything in %s", args[0], channel)
+		return
+	}
+
+	// Lines come back newest first, but they read better in order.
+	results := make([]string, len(lines))
+	for i, line := range lines {
+		results[len(lines)-1-i] = line.String()
+	}
+
+	p.sendResults(b, m, results, false)
+}
@@ -1,21 +1,69 @@
 package extra
 
 import (
+	"encoding/json"
+	"fmt"
+	"math"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 
 	"github.com/belak/go-seabird"
-	"github.com/belak/nut"
+	"github.com/belak/go-seabird/plugins"
+	"github.com/belak/go-seabird/storage"
 	"github.com/go-irc/irc"
 )
 
 func init() {
 	seabird.RegisterPlugin("karma", newKarmaPlugin)
+
+	storage.RegisterMigration("karma", storage.Migration{
+		Version:     1,
+		Description: "Move karma into namespaced bucket",
+		Buckets:     []string{"karma", "karma_targets"},
+		Migrate: func(tx storage.Tx) error {
+			return storage.MoveBucket(tx, "karma", "karma_targets")
+		},
+	})
+
+	storage.RegisterMigration("karma", storage.Migration{
+		Version:     2,
+		Description: "Build karma score index",
+		Buckets:     []string{"karma_targets", "karma_index_asc", "karma_index_desc"},
+		Migrate: func(tx storage.Tx) error {
+			targets := tx.Bucket("karma_targets")
+			asc := tx.Bucket("karma_index_asc")
+			desc := tx.Bucket("karma_index_desc")
+
+			v := &KarmaTarget{}
+			return targets.ForEach(v, func(key string) error {
+				return putKarmaIndex(asc, desc, globalKarmaScope, v)
+			})
+		},
+	})
 }
 
+const (
+	// globalKarmaScope is the index scope for karma from every channel.
+	// Channel names can't be "*", so this won't conflict.
+	globalKarmaScope = "*"
+
+	defaultKarmaListSize = 5
+	maxKarmaListSize     = 10
+)
+
+var karmaBuckets = []string{"targets", "channel_targets", "index_asc", "index_desc", "history", "history_by_target", "history_by_giver", "aliases"}
+
 type karmaPlugin struct {
-	db *nut.DB
+	db      *storage.Namespace
+	tracker *plugins.ChannelTracker
+	config  karmaConfig
+
+	accountLock *sync.Mutex
+	accounts    map[string]*karmaAccount
 }
 
 // KarmaTarget represents an item with a karma count
@@ -24,14 +72,33 @@ type KarmaTarget struct {
 	Score int
 }
 
-var regex = regexp.MustCompile(`([\w]{2,}|".+?")(\+\++|--+)(?:\s|$)`)
+var (
+	regex = regexp.MustCompile(`([\w]{2,}|".+?")(\+\++|--+)(?:\s|$)`)
 
-func newKarmaPlugin(b *seabird.Bot, m *seabird.BasicMux, cm *seabird.CommandMux, db *nut.DB) error {
-	p := &karmaPlugin{db: db}
+	// reasonRegex matches a reason at the end of a karma message, like
+	// "foo++ # for fixing CI".
+	reasonRegex = regexp.MustCompile(`(?:^|\s)#\s+(.+)$`)
+)
 
-	err := p.db.EnsureBucket("karma")
-	if err != nil {
-		return err
+func newKarmaPlugin(b *seabird.Bot, m *seabird.BasicMux, cm *seabird.CommandMux, store *storage.Store, tracker *plugins.ChannelTracker) error {
+	p := &karmaPlugin{
+		db:      store.Namespace("karma"),
+		tracker: tracker,
+		config: karmaConfig{
+			MaxChange: 5,
+		},
+		accountLock: &sync.Mutex{},
+		accounts:    make(map[string]*karmaAccount),
+	}
+
+	// The karma config section is optional.
+	_ = b.Config("karma", &p.config)
+
+	for _, name := range karmaBuckets {
+		err := p.db.EnsureBucket(name)
+		if err != nil {
+			return err
+		}
 	}
 
 	cm.Event("karma", p.karmaCallback, &seabird.HelpInfo{
@@ -39,18 +106,61 @@ func newKarmaPlugin(b *seabird.Bot, m *seabird.BasicMux, cm *seabird.CommandMux,
 		Description: "Displays karma for given user",
 	})
 
-	/*
-		cm.Event("topkarma", p.topKarmaCallback, &seabird.HelpInfo{
-			Description: "Reports the user with the most karma",
-		})
+	cm.Event("topkarma", p.topKarmaCallback, &seabird.HelpInfo{
+		Usage:       "[n] [channel]",
+		Description: "Reports the targets with the most karma",
+	})
 
-		cm.Event("bottomkarma", p.bottomKarmaCallback, &seabird.HelpInfo{
-			Description: "Reports the user with the least karma",
-		})
-	*/
+	cm.Event("bottomkarma", p.bottomKarmaCallback, &seabird.HelpInfo{
+		Usage:       "[n] [channel]",
+		Description: "Reports the targets with the least karma",
+	})
+
+	cm.Event("karmarank", p.karmaRankCallback, &seabird.HelpInfo{
+		Usage:       "<name> [channel]",
+		Description: "Reports where a target ranks by karma",
+	})
+
+	cm.Event("karmawhy", p.karmaWhyCallback, &seabird.HelpInfo{
+		Usage:       "<name>",
+		Description: "Shows recent reasons given for a target's karma",
+	})
+
+	cm.Event("karmagiven", p.karmaGivenCallback, &seabird.HelpInfo{
+		Usage:       "<nick>",
+		Description: "Shows karma recently given by a user",
+	})
+
+	cm.Event("karmarevert", p.karmaRevertCallback, &seabird.HelpInfo{
+		Usage:       "<nick> [name]",
+		Description: "Reverts karma given by a user, optionally only to one target. Admin only.",
+	})
+
+	cm.Event("karmalink", p.karmaLinkCallback, &seabird.HelpInfo{
+		Usage:       "<alias> <name>",
+		Description: "Makes alias count towards name's karma, merging any existing karma. Admin only.",
+	})
+
+	cm.Event("karmaunlink", p.karmaUnlinkCallback, &seabird.HelpInfo{
+		Usage:       "<alias>",
+		Description: "Stops alias from counting towards another name's karma. Admin only.",
+	})
+
+	cm.Event("karmaaliases", p.karmaAliasesCallback, &seabird.HelpInfo{
+		Usage:       "<name>",
+		Description: "Lists the aliases for a karma target",
+	})
 
 	m.Event("PRIVMSG", p.callback)
 
+	m.Event("330", p.whoisAccountCallback)
+	m.Event("318", p.endOfWhoisCallback)
+	// Nick changes need to be followed before we forget who the user was
+	// identified as.
+	m.Event("NICK", p.followNickCallback)
+	m.Event("NICK", p.forgetAccountCallback)
+	m.Event("QUIT", p.forgetAccountCallback)
+
 	return nil
 }
 
@@ -62,8 +172,9 @@ func (p *karmaPlugin) cleanedName(name string) string {
 func (p *karmaPlugin) GetKarmaFor(name string) int {
 	out := &KarmaTarget{Name: p.cleanedName(name)}
 
-	_ = p.db.View(func(tx *nut.Tx) error {
-		bucket := tx.Bucket("karma")
+	_ = p.db.View(func(tx storage.Tx) error {
+		out.Name = resolveKarmaAlias(tx, out.Name)
+		bucket := tx.Bucket("targets")
 		return bucket.Get(out.Name, out)
 	})
 
@@ -72,18 +183,129 @@ func (p *karmaPlugin) GetKarmaFor(name string) int {
 
 // UpdateKarma will update the karma for a given name and return the new karma value.
 func (p *karmaPlugin) UpdateKarma(name string, diff int) int {
-	out := &KarmaTarget{Name: p.cleanedName(name)}
+	return p.applyKarma(&KarmaChange{Target: name, Delta: diff})
+}
+
+// applyKarma updates the global karma for the change's target, along with
+// the karma for that target in the change's channel if there is one, records
+// the change in the history and returns the new global karma value.
+func (p *karmaPlugin) applyKarma(change *KarmaChange) int {
+	change.Target = p.cleanedName(change.Target)
+	if change.Time.IsZero() {
+		change.Time = time.Now()
+	}
+
+	out := &KarmaTarget{}
+
+	_ = p.db.Update(func(tx storage.Tx) error {
+		change.Target = resolveKarmaAlias(tx, change.Target)
+		out.Name = change.Target
 
-	_ = p.db.Update(func(tx *nut.Tx) error {
-		bucket := tx.Bucket("karma")
-		bucket.Get(out.Name, out)
-		out.Score += diff
-		return bucket.Put(out.Name, out)
+		err := updateKarmaScores(tx, change.Channel, out, change.Delta)
+		if err != nil {
+			return err
+		}
+
+		return recordKarmaChange(tx, change)
 	})
 
 	return out.Score
 }
 
+// updateKarmaScores applies diff to the target's global score and its score
+// in the given channel, if any. target will be filled in with the new global
+// score.
+func updateKarmaScores(tx storage.Tx, channel string, target *KarmaTarget, diff int) error {
+	asc := tx.Bucket("index_asc")
+	desc := tx.Bucket("index_desc")
+
+	err := updateKarmaTarget(tx.Bucket("targets"), asc, desc, globalKarmaScope, target.Name, target, diff)
+	if err != nil || channel == "" {
+		return err
+	}
+
+	return updateKarmaTarget(tx.Bucket("channel_targets"), asc, desc, channel, channel+" "+target.Name, &KarmaTarget{Name: target.Name}, diff)
+}
+
+// updateKarmaTarget applies diff to the target stored under key and moves its
+// entries in the score index.
+func updateKarmaTarget(bucket, asc, desc storage.Bucket, scope, key string, target *KarmaTarget, diff int) error {
+	err := bucket.Get(key, target)
+	if err == nil {
+		err = deleteKarmaIndex(asc, desc, scope, target)
+		if err != nil {
+			return err
+		}
+	}
+
+	target.Score += diff
+
+	err = bucket.Put(key, target)
+	if err != nil {
+		return err
+	}
+
+	return putKarmaIndex(asc, desc, scope, target)
+}
+
+// karmaIndexKeys returns the keys for a target in the ascending and
+// descending score indexes. Scores are offset into unsigned values and zero
+// padded so the keys sort in numeric order.
+func karmaIndexKeys(scope string, target *KarmaTarget) (string, string) {
+	score := uint64(int64(target.Score)) ^ (1 << 63)
+	return fmt.Sprintf("%s %020d %s", scope, score, target.Name),
+		fmt.Sprintf("%s %020d %s", scope, math.MaxUint64-score, target.Name)
+}
+
+func putKarmaIndex(asc, desc storage.Bucket, scope string, target *KarmaTarget) error {
+	ascKey, descKey := karmaIndexKeys(scope, target)
+
+	err := asc.Put(ascKey, target)
+	if err != nil {
+		return err
+	}
+
+	return desc.Put(descKey, target)
+}
+
+func deleteKarmaIndex(asc, desc storage.Bucket, scope string, target *KarmaTarget) error {
+	ascKey, descKey := karmaIndexKeys(scope, target)
+
+	err := asc.Delete(ascKey)
+	if err != nil {
+		return err
+	}
+
+	return desc.Delete(descKey)
+}
+
+// scanKarmaIndex calls fn for every target in the given scope, in index
+// order, until fn returns false. The scan seeks straight to the scope, so
+// other scopes in the index don't slow it down.
+func (p *karmaPlugin) scanKarmaIndex(index, scope string, fn func(target *KarmaTarget) bool) error {
+	return p.db.View(func(tx storage.Tx) error {
+		v := &KarmaTarget{}
+		return storage.ForEachPrefix(tx.Bucket(index), scope+" ", v, func(key string) bool {
+			return fn(v)
+		})
+	})
+}
+
+// karmaScope returns the index scope for a channel, or the global scope if no
+// channel is given.
+func (p *karmaPlugin) karmaScope(b *seabird.Bot, channel string) (string, bool) {
+	if channel == "" {
+		return globalKarmaScope, true
+	}
+
+	_, channel, ok := b.ChannelTarget(channel)
+	if !ok {
+		return "", false
+	}
+
+	return strings.ToLower(channel), true
+}
+
 func (p *karmaPlugin) karmaCallback(b *seabird.Bot, m *irc.Message) {
 	term := strings.TrimSpace(m.Trailing())
 
@@ -95,30 +317,148 @@ func (p *karmaPlugin) karmaCallback(b *seabird.Bot, m *irc.Message) {
 	b.MentionReply(m, "%s's karma is %d", term, p.GetKarmaFor(term))
 }
 
-/*
-func (p *karmaPlugin) karmaCheck(b *seabird.Bot, m *irc.Message, msg string, sort string) {
-	res := &KarmaTarget{}
-	p.db.Order("score " + sort).First(res)
-	b.MentionReply(m, "%s has the %s karma with %d", res.Name, msg, res.Score)
+func (p *karmaPlugin) karmaCheck(b *seabird.Bot, m *irc.Message, msg string, index string) {
+	args := strings.Fields(m.Trailing())
+
+	count := defaultKarmaListSize
+	if len(args) > 0 {
+		if n, err := strconv.Atoi(args[0]); err == nil {
+			count = n
+			args = args[1:]
+		}
+	}
+
+	if count < 1 {
+		count = 1
+	} else if count > maxKarmaListSize {
+		count = maxKarmaListSize
+	}
+
+	var channel string
+	if len(args) > 0 {
+		channel = args[0]
+	}
+
+	scope, ok := p.karmaScope(b, channel)
+	if !ok {
+		b.MentionReply(m, "%q is not a channel", channel)
+		return
+	}
+
+	var results []string
+	err := p.scanKarmaIndex(index, scope, func(target *KarmaTarget) bool {
+		results = append(results, fmt.Sprintf("%s (%d)", target.Name, target.Score))
+		return len(results) < count
+	})
+	if err != nil {
+		b.MentionReply(m, "Error looking up karma")
+		return
+	}
+
+	if len(results) == 0 {
+		b.MentionReply(m, "No karma found")
+		return
+	}
+
+	b.MentionReply(m, "%s karma: %s", msg, strings.Join(results, ", "))
 }
+
 func (p *karmaPlugin) topKarmaCallback(b *seabird.Bot, m *irc.Message) {
-	p.karmaCheck(b, m, "top", "DESC")
+	p.karmaCheck(b, m, "Top", "index_desc")
 }
 
 func (p *karmaPlugin) bottomKarmaCallback(b *seabird.Bot, m *irc.Message) {
-	p.karmaCheck(b, m, "bottom", "ASC")
+	p.karmaCheck(b, m, "Bottom", "index_asc")
+}
+
+func (p *karmaPlugin) karmaRankCallback(b *seabird.Bot, m *irc.Message) {
+	args := strings.Fields(m.Trailing())
+	if len(args) == 0 {
+		args = []string{m.Prefix.Name}
+	}
+
+	var channel string
+	if len(args) > 1 {
+		if _, _, ok := b.ChannelTarget(args[len(args)-1]); ok {
+			channel = args[len(args)-1]
+			args = args[:len(args)-1]
+		}
+	}
+
+	scope, _ := p.karmaScope(b, channel)
+	name := p.canonicalName(strings.Join(args, " "))
+
+	target, rank, err := p.karmaRank(scope, name)
+	if err == storage.ErrNotFound {
+		b.MentionReply(m, "%s has no karma", name)
+		return
+	} else if err != nil {
+		b.MentionReply(m, "Error looking up karma")
+		return
+	}
+
+	b.MentionReply(m, "%s is ranked #%d with %d karma", name, rank, target.Score)
+}
+
+// karmaRank looks up a target in the given scope and returns it along with
+// its rank, starting at 1.
+func (p *karmaPlugin) karmaRank(scope, name string) (*KarmaTarget, int, error) {
+	target := &KarmaTarget{}
+	var ahead int
+	err := p.db.View(func(tx storage.Tx) error {
+		var err error
+		if scope == globalKarmaScope {
+			err = tx.Bucket("targets").Get(name, target)
+		} else {
+			err = tx.Bucket("channel_targets").Get(scope+" "+name, target)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Ties share a rank, so the rank is one more than the number of
+		// targets with a higher score. Those all sort before this score in
+		// the descending index, so only their keys need to be looked at.
+		_, descKey := karmaIndexKeys(scope, target)
+		scorePrefix := descKey[:len(descKey)-len(target.Name)]
+
+		var raw json.RawMessage
+		return storage.ForEachPrefix(tx.Bucket("index_desc"), scope+" ", &raw, func(key string) bool {
+			if key >= scorePrefix {
+				return false
+			}
+
+			ahead++
+			return true
+		})
+	})
+
+	return target, ahead + 1, err
 }
-*/
 
 func (p *karmaPlugin) callback(b *seabird.Bot, m *irc.Message) {
 	if len(m.Params) < 2 || !b.FromChannel(m) {
 		return
 	}
 
+	_, rawChannel, _ := b.ChannelTarget(m.Params[0])
+	channel := strings.ToLower(rawChannel)
+
+	text := m.Trailing()
+
+	// Anything after a "#" is the reason for all the changes in this
+	// message.
+	var reason string
+	if loc := reasonRegex.FindStringSubmatchIndex(text); loc != nil {
+		reason = strings.TrimSpace(text[loc[2]:loc[3]])
+		text = text[:loc[0]]
+	}
+
 	var buzzkillTriggered bool
 	var changes = make(map[string]int)
+	var names []string
 
-	matches := regex.FindAllStringSubmatch(m.Trailing(), -1)
+	matches := regex.FindAllStringSubmatch(text, -1)
 	for _, v := range matches {
 		// If it starts with a ", we know it also ends with a quote so we
 		// can chop them off.
@@ -136,19 +476,59 @@ func (p *karmaPlugin) callback(b *seabird.Bot, m *irc.Message) {
 			diff *= -1
 		}
 
+		if _, ok := changes[v[1]]; !ok {
+			names = append(names, v[1])
+		}
 		changes[v[1]] = changes[v[1]] + diff
 	}
 
-	for name, diff := range changes {
-		if diff > 5 {
+	if len(changes) == 0 {
+		return
+	}
+
+	// Problems with karma are sent privately so they don't clutter up the
+	// channel.
+	if ok, why := p.allowedGiver(b, m, rawChannel); !ok {
+		b.PrivateReply(m, "Karma ignored: %s", why)
+		return
+	}
+
+	giver := p.cleanedName(m.Prefix.Name)
+	now := time.Now()
+
+	if why := p.giverCooldown(giver, now); why != "" {
+		b.PrivateReply(m, "Karma ignored: %s", why)
+		return
+	}
+
+	for _, name := range names {
+		diff := changes[name]
+		if p.config.MaxChange > 0 && diff > p.config.MaxChange {
 			buzzkillTriggered = true
-			diff = 5
+			diff = p.config.MaxChange
 		}
 
-		b.Reply(m, "%s's karma is now %d", name, p.UpdateKarma(name, diff))
+		limited, why := p.limitKarma(giver, p.canonicalName(name), diff, now)
+		if why != "" {
+			b.PrivateReply(m, "Karma for %s ignored: %s", name, why)
+			continue
+		} else if limited != diff {
+			b.PrivateReply(m, "Karma for %s limited to %d by the daily cap", name, limited)
+		}
+
+		score := p.applyKarma(&KarmaChange{
+			Target:  name,
+			Giver:   giver,
+			Mask:    m.Prefix.String(),
+			Channel: channel,
+			Delta:   limited,
+			Reason:  reason,
+		})
+
+		b.Reply(m, "%s's karma is now %d", name, score)
 	}
 
 	if buzzkillTriggered {
-		b.Reply(m, "Buzzkill Mode (tm) enforced a maximum karma change of 5")
+		b.Reply(m, "Buzzkill Mode (tm) enforced a maximum karma change of %d", p.config.MaxChange)
 	}
 }
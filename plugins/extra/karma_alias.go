@@ -0,0 +1,316 @@
+package extra
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/storage"
+	"github.com/go-irc/irc"
+)
+
+// KarmaAlias points an alternate name at the target its karma should count
+// towards.
+type KarmaAlias struct {
+	Alias  string
+	Target string
+}
+
+// resolveKarmaAlias returns the canonical name for a cleaned karma name.
+// Aliases always point directly at a canonical name, so only one lookup is
+// needed.
+func resolveKarmaAlias(tx storage.Tx, name string) string {
+	alias := &KarmaAlias{}
+	if err := tx.Bucket("aliases").Get(name, alias); err == nil && alias.Target != "" {
+		return alias.Target
+	}
+	return name
+}
+
+// canonicalName cleans the given name and resolves any alias.
+func (p *karmaPlugin) canonicalName(name string) string {
+	name = p.cleanedName(name)
+
+	_ = p.db.View(func(tx storage.Tx) error {
+		name = resolveKarmaAlias(tx, name)
+		return nil
+	})
+
+	return name
+}
+
+// linkKarma makes alias count towards target and moves all of alias's
+// existing karma and history over to target.
+func linkKarma(tx storage.Tx, alias, target string) error {
+	target = resolveKarmaAlias(tx, target)
+	if alias == target {
+		return errors.New("Can't link a name to itself")
+	}
+
+	aliases := tx.Bucket("aliases")
+
+	// Anything pointing at the alias needs to point at the new target so we
+	// never have to follow more than one link.
+	var existing []KarmaAlias
+	v := &KarmaAlias{}
+	err := aliases.ForEach(v, func(key string) error {
+		if v.Target == alias {
+			existing = append(existing, *v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, a := range existing {
+		a.Target = target
+		if err = aliases.Put(a.Alias, &a); err != nil {
+			return err
+		}
+	}
+
+	err = aliases.Put(alias, &KarmaAlias{Alias: alias, Target: target})
+	if err != nil {
+		return err
+	}
+
+	err = mergeKarmaScores(tx, alias, target)
+	if err != nil {
+		return err
+	}
+
+	return mergeKarmaHistory(tx, alias, target)
+}
+
+// mergeKarmaScores moves the global and per-channel scores for one name onto
+// another.
+func mergeKarmaScores(tx storage.Tx, from, to string) error {
+	asc := tx.Bucket("index_asc")
+	desc := tx.Bucket("index_desc")
+
+	targets := tx.Bucket("targets")
+	old := &KarmaTarget{}
+	if err := targets.Get(from, old); err == nil {
+		err = deleteKarmaIndex(asc, desc, globalKarmaScope, old)
+		if err != nil {
+			return err
+		}
+
+		err = targets.Delete(from)
+		if err != nil {
+			return err
+		}
+
+		err = updateKarmaTarget(targets, asc, desc, globalKarmaScope, to, &KarmaTarget{Name: to}, old.Score)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Channel scores are keyed by channel first, so we have to look through
+	// all of them.
+	channelTargets := tx.Bucket("channel_targets")
+
+	moved := make(map[string]int)
+	v := &KarmaTarget{}
+	err := channelTargets.ForEach(v, func(key string) error {
+		if v.Name == from && strings.HasSuffix(key, " "+from) {
+			moved[strings.TrimSuffix(key, " "+from)] = v.Score
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for channel, score := range moved {
+		err = deleteKarmaIndex(asc, desc, channel, &KarmaTarget{Name: from, Score: score})
+		if err != nil {
+			return err
+		}
+
+		err = channelTargets.Delete(channel + " " + from)
+		if err != nil {
+			return err
+		}
+
+		err = updateKarmaTarget(channelTargets, asc, desc, channel, channel+" "+to, &KarmaTarget{Name: to}, score)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeKarmaHistory points all the history for one name at another.
+func mergeKarmaHistory(tx storage.Tx, from, to string) error {
+	var changes []*KarmaChange
+	err := karmaChanges(tx, "history_by_target", from, func(change *KarmaChange) bool {
+		changes = append(changes, change)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	byTarget := tx.Bucket("history_by_target")
+	for _, change := range changes {
+		_, targetKey, _ := karmaHistoryKeys(change)
+		err = byTarget.Delete(targetKey)
+		if err != nil {
+			return err
+		}
+
+		change.Target = to
+		err = putKarmaChange(tx, change)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *karmaPlugin) karmaLinkCallback(b *seabird.Bot, m *irc.Message) {
+	if !b.IsAdmin(m) {
+		b.MentionReply(m, "Permission denied")
+		return
+	}
+
+	args := strings.Fields(m.Trailing())
+	if len(args) != 2 {
+		b.MentionReply(m, "Usage: <alias> <name>")
+		return
+	}
+
+	alias := p.cleanedName(args[0])
+	target := p.cleanedName(args[1])
+
+	err := p.db.Update(func(tx storage.Tx) error {
+		if resolveKarmaAlias(tx, alias) != alias {
+			return errors.New(alias + " is already an alias")
+		}
+
+		target = resolveKarmaAlias(tx, target)
+		return linkKarma(tx, alias, target)
+	})
+	if err != nil {
+		b.MentionReply(m, "Failed to link karma: %s", err)
+		return
+	}
+
+	b.MentionReply(m, "%s now counts towards %s, whose karma is %d", alias, target, p.GetKarmaFor(target))
+}
+
+func (p *karmaPlugin) karmaUnlinkCallback(b *seabird.Bot, m *irc.Message) {
+	if !b.IsAdmin(m) {
+		b.MentionReply(m, "Permission denied")
+		return
+	}
+
+	alias := p.cleanedName(m.Trailing())
+	if alias == "" {
+		b.MentionReply(m, "Alias required")
+		return
+	}
+
+	v := &KarmaAlias{}
+	err := p.db.Update(func(tx storage.Tx) error {
+		aliases := tx.Bucket("aliases")
+
+		if err := aliases.Get(alias, v); err != nil {
+			return errors.New(alias + " is not an alias")
+		}
+
+		return aliases.Delete(alias)
+	})
+	if err != nil {
+		b.MentionReply(m, "Failed to unlink karma: %s", err)
+		return
+	}
+
+	// We don't know how much of the target's karma came from the alias, so
+	// merged karma stays where it is and only new karma is affected.
+	b.MentionReply(m, "%s no longer counts towards %s. Karma which was already merged stays with %s.", alias, v.Target, v.Target)
+}
+
+func (p *karmaPlugin) karmaAliasesCallback(b *seabird.Bot, m *irc.Message) {
+	name := p.canonicalName(m.Trailing())
+	if name == "" {
+		b.MentionReply(m, "Name required")
+		return
+	}
+
+	var found []string
+	err := p.db.View(func(tx storage.Tx) error {
+		v := &KarmaAlias{}
+		return tx.Bucket("aliases").ForEach(v, func(key string) error {
+			if v.Target == name {
+				found = append(found, v.Alias)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		b.MentionReply(m, "Error looking up aliases")
+		return
+	}
+
+	if len(found) == 0 {
+		b.MentionReply(m, "%s has no aliases", name)
+		return
+	}
+
+	b.MentionReply(m, "Aliases for %s: %s", name, strings.Join(found, ", "))
+}
+
+// followNickCallback links a user's new nick to their karma when they change
+// nicks so karma given to either nick ends up in the same place. Aliases are
+// permanent, so this is only done for users identified to services. Otherwise
+// anyone who later used a temporary nick like "bob|lunch" would be giving
+// their karma to bob.
+func (p *karmaPlugin) followNickCallback(b *seabird.Bot, m *irc.Message) {
+	if !p.config.FollowNicks || len(m.Params) < 1 {
+		return
+	}
+
+	oldNick := m.Prefix.Name
+	newNick := m.Params[0]
+
+	if !p.knownIdentified(m) {
+		return
+	}
+
+	// We only follow users we share a channel with. The tracker may not
+	// have seen the rename yet, so either nick is fine.
+	if p.tracker != nil && p.tracker.LookupUser(oldNick) == nil && p.tracker.LookupUser(newNick) == nil {
+		return
+	}
+
+	alias := p.cleanedName(newNick)
+
+	err := p.db.Update(func(tx storage.Tx) error {
+		target := resolveKarmaAlias(tx, p.cleanedName(oldNick))
+
+		// If the new nick is already known, we leave it alone. This covers
+		// switching back to a primary nick as well as someone else's nick.
+		if alias == target || resolveKarmaAlias(tx, alias) != alias {
+			return nil
+		}
+		if err := tx.Bucket("targets").Get(alias, &KarmaTarget{}); err == nil {
+			return nil
+		}
+
+		return linkKarma(tx, alias, target)
+	})
+	if err != nil {
+		b.GetLogger().WithError(err).WithFields(logrus.Fields{
+			"old": oldNick,
+			"new": newNick,
+		}).Warn("Failed to follow nick change")
+	}
+}
@@ -0,0 +1,241 @@
+package extra
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/storage"
+	"github.com/go-irc/irc"
+)
+
+const karmaHistorySize = 3
+
+// KarmaChange is a single change to a target's karma, kept so we know who
+// gave karma and why.
+type KarmaChange struct {
+	ID      string
+	Target  string
+	Giver   string
+	Mask    string
+	Channel string
+	Time    time.Time
+	Delta   int
+	Reason  string
+
+	// Reverted is set when an admin has undone this change.
+	Reverted bool
+}
+
+// karmaHistoryKeys returns the key for a change in the history bucket along
+// with its keys in the by-target and by-giver indexes. The history key is
+// zero padded so changes sort in order, while the index keys are inverted so
+// the newest changes come first.
+func karmaHistoryKeys(change *KarmaChange) (string, string, string) {
+	id, _ := strconv.ParseUint(change.ID, 10, 64)
+	inverted := fmt.Sprintf("%020d", math.MaxUint64-id)
+
+	return fmt.Sprintf("%020d", id),
+		change.Target + "\x00" + inverted,
+		change.Giver + "\x00" + inverted
+}
+
+// recordKarmaChange assigns the change an ID and stores it in the history.
+func recordKarmaChange(tx storage.Tx, change *KarmaChange) error {
+	history := tx.Bucket("history")
+
+	id, err := history.NextID()
+	if err != nil {
+		return err
+	}
+	change.ID = id
+
+	return putKarmaChange(tx, change)
+}
+
+func putKarmaChange(tx storage.Tx, change *KarmaChange) error {
+	key, targetKey, giverKey := karmaHistoryKeys(change)
+
+	err := tx.Bucket("history").Put(key, change)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket("history_by_target").Put(targetKey, key)
+	if err != nil {
+		return err
+	}
+
+	if change.Giver == "" {
+		return nil
+	}
+
+	return tx.Bucket("history_by_giver").Put(giverKey, key)
+}
+
+// karmaChanges calls fn with the changes in the given index for a name,
+// newest first, until fn returns false.
+func karmaChanges(tx storage.Tx, index, name string, fn func(change *KarmaChange) bool) error {
+	history := tx.Bucket("history")
+
+	var key string
+	return storage.ForEachPrefix(tx.Bucket(index), name+"\x00", &key, func(string) bool {
+		change := &KarmaChange{}
+		if err := history.Get(key, change); err != nil {
+			return true
+		}
+
+		return fn(change)
+	})
+}
+
+func formatKarmaDelta(delta int) string {
+	if delta > 0 {
+		return "+" + strconv.Itoa(delta)
+	}
+	return strconv.Itoa(delta)
+}
+
+func (p *karmaPlugin) karmaWhyCallback(b *seabird.Bot, m *irc.Message) {
+	name := p.canonicalName(m.Trailing())
+	if name == "" {
+		b.MentionReply(m, "Name required")
+		return
+	}
+
+	var reasons []string
+	err := p.db.View(func(tx storage.Tx) error {
+		return karmaChanges(tx, "history_by_target", name, func(change *KarmaChange) bool {
+			if change.Reverted || change.Reason == "" {
+				return true
+			}
+
+			reasons = append(reasons, fmt.Sprintf(
+				"%s from %s on %s: %s",
+				formatKarmaDelta(change.Delta),
+				change.Giver,
+				formatDate(change.Time),
+				change.Reason))
+
+			return len(reasons) < karmaHistorySize
+		})
+	})
+	if err != nil {
+		b.MentionReply(m, "Error looking up karma history")
+		return
+	}
+
+	if len(reasons) == 0 {
+		b.MentionReply(m, "No reasons given for %s", name)
+		return
+	}
+
+	b.MentionReply(m, "%s", strings.Join(reasons, "; "))
+}
+
+func (p *karmaPlugin) karmaGivenCallback(b *seabird.Bot, m *irc.Message) {
+	nick := p.cleanedName(m.Trailing())
+	if nick == "" {
+		nick = p.cleanedName(m.Prefix.Name)
+	}
+
+	var up, down int
+	var recent []string
+	err := p.db.View(func(tx storage.Tx) error {
+		return karmaChanges(tx, "history_by_giver", nick, func(change *KarmaChange) bool {
+			if change.Reverted {
+				return true
+			}
+
+			if change.Delta > 0 {
+				up += change.Delta
+			} else {
+				down -= change.Delta
+			}
+
+			if len(recent) < karmaHistorySize {
+				recent = append(recent, fmt.Sprintf("%s (%s)", change.Target, formatKarmaDelta(change.Delta)))
+			}
+
+			return true
+		})
+	})
+	if err != nil {
+		b.MentionReply(m, "Error looking up karma history")
+		return
+	}
+
+	if len(recent) == 0 {
+		b.MentionReply(m, "%s hasn't given any karma", nick)
+		return
+	}
+
+	b.MentionReply(m, "%s has given +%d/-%d karma, most recently to %s", nick, up, down, strings.Join(recent, ", "))
+}
+
+func (p *karmaPlugin) karmaRevertCallback(b *seabird.Bot, m *irc.Message) {
+	if !b.IsAdmin(m) {
+		b.MentionReply(m, "Permission denied")
+		return
+	}
+
+	args := strings.SplitN(strings.TrimSpace(m.Trailing()), " ", 2)
+	giver := p.cleanedName(args[0])
+	if giver == "" {
+		b.MentionReply(m, "Nick required")
+		return
+	}
+
+	var target string
+	if len(args) > 1 {
+		target = p.canonicalName(args[1])
+	}
+
+	count, err := p.revertKarma(giver, target)
+	if err != nil {
+		b.MentionReply(m, "Failed to revert karma: %s", err)
+		return
+	}
+
+	b.MentionReply(m, "Reverted %d karma changes from %s", count, giver)
+}
+
+// revertKarma undoes the changes made by a giver, optionally only those to
+// one target, and returns how many were reverted.
+func (p *karmaPlugin) revertKarma(giver, target string) (int, error) {
+	var count int
+	err := p.db.Update(func(tx storage.Tx) error {
+		var changes []*KarmaChange
+		err := karmaChanges(tx, "history_by_giver", giver, func(change *KarmaChange) bool {
+			if !change.Reverted && (target == "" || change.Target == target) {
+				changes = append(changes, change)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, change := range changes {
+			err = updateKarmaScores(tx, change.Channel, &KarmaTarget{Name: change.Target}, -change.Delta)
+			if err != nil {
+				return err
+			}
+
+			change.Reverted = true
+			err = putKarmaChange(tx, change)
+			if err != nil {
+				return err
+			}
+		}
+
+		count = len(changes)
+
+		return nil
+	})
+
+	return count, err
+}
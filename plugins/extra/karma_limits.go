@@ -0,0 +1,271 @@
+package extra
+
+import (
+	"strings"
+	"time"
+
+	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/storage"
+	"github.com/go-irc/irc"
+)
+
+const (
+	// accountCacheTime is how long we trust a WHOIS result for a nick.
+	accountCacheTime = 10 * time.Minute
+
+	// whoisTimeout is how long we wait for a WHOIS reply before sending
+	// another one.
+	whoisTimeout = time.Minute
+)
+
+type karmaConfig struct {
+	// MaxChange is the largest increase one message can make to a target.
+	// Decreases aren't capped.
+	MaxChange int
+
+	// GiverCooldown is the minimum time between karma changes from the
+	// same user and TargetCooldown is the minimum time between changes
+	// from the same user to the same target.
+	GiverCooldown  seabird.Duration
+	TargetCooldown seabird.Duration
+
+	// DailyCap is the most karma a user can give, up or down, in 24 hours.
+	// 0 means there is no limit.
+	DailyCap int
+
+	// RequirePresence ignores karma from users the ChannelTracker doesn't
+	// see in the channel.
+	RequirePresence bool
+
+	// RequireIdentified ignores karma from users who aren't logged in to
+	// services. This uses the account message tag if the server sends it,
+	// otherwise it falls back to WHOIS.
+	RequireIdentified bool
+
+	// FollowNicks links a user's new nick to their karma when they change
+	// nicks, as long as they're identified to services and the new nick
+	// doesn't already have karma.
+	FollowNicks bool
+}
+
+type karmaAccount struct {
+	Account string
+	Checked time.Time
+	pending bool
+}
+
+// karmaLimits is what a giver has done recently, pulled from the history.
+type karmaLimits struct {
+	lastGiven  time.Time
+	lastTarget time.Time
+	dailyTotal int
+}
+
+// recentKarma looks through the giver's history to find out what they've
+// given recently.
+func (p *karmaPlugin) recentKarma(giver, target string, now time.Time) (*karmaLimits, error) {
+	ret := &karmaLimits{}
+
+	window := p.config.GiverCooldown.Duration
+	if p.config.TargetCooldown.Duration > window {
+		window = p.config.TargetCooldown.Duration
+	}
+	if p.config.DailyCap > 0 && window < 24*time.Hour {
+		window = 24 * time.Hour
+	}
+
+	if window <= 0 {
+		return ret, nil
+	}
+
+	cutoff := now.Add(-window)
+	dayCutoff := now.Add(-24 * time.Hour)
+
+	err := p.db.View(func(tx storage.Tx) error {
+		return karmaChanges(tx, "history_by_giver", giver, func(change *KarmaChange) bool {
+			if change.Time.Before(cutoff) {
+				return false
+			}
+
+			if ret.lastGiven.IsZero() {
+				ret.lastGiven = change.Time
+			}
+
+			if ret.lastTarget.IsZero() && change.Target == target {
+				ret.lastTarget = change.Time
+			}
+
+			if !change.Reverted && change.Time.After(dayCutoff) {
+				if change.Delta < 0 {
+					ret.dailyTotal -= change.Delta
+				} else {
+					ret.dailyTotal += change.Delta
+				}
+			}
+
+			return true
+		})
+	})
+
+	return ret, err
+}
+
+// formatWait rounds a wait up to the next second so it reads nicely.
+func formatWait(d time.Duration) string {
+	return ((d + time.Second - 1) / time.Second * time.Second).String()
+}
+
+// giverCooldown checks the giver cooldown. It's checked once per message
+// rather than once per target so "foo++ bar++" counts as a single change. If
+// the giver has to wait, a reason is returned.
+func (p *karmaPlugin) giverCooldown(giver string, now time.Time) string {
+	cooldown := p.config.GiverCooldown.Duration
+	if cooldown <= 0 {
+		return ""
+	}
+
+	recent, err := p.recentKarma(giver, "", now)
+	if err != nil {
+		return "unable to check karma history"
+	}
+
+	if !recent.lastGiven.IsZero() {
+		if wait := recent.lastGiven.Add(cooldown).Sub(now); wait > 0 {
+			return "you need to wait " + formatWait(wait) + " before giving more karma"
+		}
+	}
+
+	return ""
+}
+
+// limitKarma checks a change against the target cooldown and daily cap. It
+// returns the allowed change, which may be smaller than what was requested,
+// or a reason if the change isn't allowed at all.
+func (p *karmaPlugin) limitKarma(giver, target string, diff int, now time.Time) (int, string) {
+	recent, err := p.recentKarma(giver, target, now)
+	if err != nil {
+		return 0, "unable to check karma history"
+	}
+
+	if cooldown := p.config.TargetCooldown.Duration; cooldown > 0 && !recent.lastTarget.IsZero() {
+		if wait := recent.lastTarget.Add(cooldown).Sub(now); wait > 0 {
+			return 0, "you need to wait " + formatWait(wait) + " before changing " + target + "'s karma again"
+		}
+	}
+
+	if p.config.DailyCap > 0 {
+		remaining := p.config.DailyCap - recent.dailyTotal
+		if remaining <= 0 {
+			return 0, "you've reached the daily karma limit"
+		}
+
+		if diff > remaining {
+			diff = remaining
+		} else if diff < -remaining {
+			diff = -remaining
+		}
+	}
+
+	return diff, ""
+}
+
+// allowedGiver checks that the sender of a message is allowed to give karma
+// at all. If they aren't, a reason is returned.
+func (p *karmaPlugin) allowedGiver(b *seabird.Bot, m *irc.Message, channel string) (bool, string) {
+	if p.config.RequirePresence && p.tracker != nil && p.tracker.LookupChannel(channel) != nil {
+		u := p.tracker.LookupUser(m.Prefix.Name)
+		if u == nil || !u.InChannel(channel) {
+			return false, "you need to be in " + channel + " to give karma"
+		}
+	}
+
+	if p.config.RequireIdentified {
+		identified, known := p.identified(b, m)
+		if !known {
+			return false, "checking if you're identified to services, please try again in a moment"
+		} else if !identified {
+			return false, "you need to be identified to services to give karma"
+		}
+	}
+
+	return true, ""
+}
+
+// identified returns whether the sender of a message is logged in to
+// services, and whether we actually know. If we don't know, a WHOIS will be
+// sent so we will next time.
+func (p *karmaPlugin) identified(b *seabird.Bot, m *irc.Message) (bool, bool) {
+	if account, ok := m.Tags.GetTag("account"); ok {
+		return account != "" && account != "*", true
+	}
+
+	nick := strings.ToLower(m.Prefix.Name)
+
+	p.accountLock.Lock()
+	defer p.accountLock.Unlock()
+
+	a, ok := p.accounts[nick]
+	if ok && a.pending && time.Since(a.Checked) < whoisTimeout {
+		return false, false
+	} else if ok && !a.pending && time.Since(a.Checked) < accountCacheTime {
+		return a.Account != "", true
+	}
+
+	p.accounts[nick] = &karmaAccount{Checked: time.Now(), pending: true}
+	b.Writef("WHOIS %s", m.Prefix.Name)
+
+	return false, false
+}
+
+// knownIdentified returns true if we already know the sender of a message is
+// logged in to services. Unlike identified, this never sends a WHOIS.
+func (p *karmaPlugin) knownIdentified(m *irc.Message) bool {
+	if account, ok := m.Tags.GetTag("account"); ok {
+		return account != "" && account != "*"
+	}
+
+	p.accountLock.Lock()
+	defer p.accountLock.Unlock()
+
+	a, ok := p.accounts[strings.ToLower(m.Prefix.Name)]
+	return ok && !a.pending && a.Account != "" && time.Since(a.Checked) < accountCacheTime
+}
+
+// whoisAccountCallback handles RPL_WHOISACCOUNT (330).
+func (p *karmaPlugin) whoisAccountCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 3 {
+		return
+	}
+
+	p.accountLock.Lock()
+	defer p.accountLock.Unlock()
+
+	if a, ok := p.accounts[strings.ToLower(m.Params[1])]; ok {
+		a.Account = m.Params[2]
+	}
+}
+
+// endOfWhoisCallback handles RPL_ENDOFWHOIS (318). If we didn't get an
+// account by now, the user isn't identified.
+func (p *karmaPlugin) endOfWhoisCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 2 {
+		return
+	}
+
+	p.accountLock.Lock()
+	defer p.accountLock.Unlock()
+
+	if a, ok := p.accounts[strings.ToLower(m.Params[1])]; ok && a.pending {
+		a.pending = false
+		a.Checked = time.Now()
+	}
+}
+
+// forgetAccountCallback drops what we know about a nick when it changes or
+// leaves, as the next user of that nick may not be the same person.
+func (p *karmaPlugin) forgetAccountCallback(b *seabird.Bot, m *irc.Message) {
+	p.accountLock.Lock()
+	defer p.accountLock.Unlock()
+
+	delete(p.accounts, strings.ToLower(m.Prefix.Name))
+}
@@ -0,0 +1,271 @@
+package extra
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/belak/go-seabird/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKarmaPlugin(t *testing.T) *karmaPlugin {
+	store, err := storage.NewStore(storage.NewMemoryBackend())
+	require.NoError(t, err)
+
+	p := &karmaPlugin{
+		db:          store.Namespace("karma"),
+		accountLock: &sync.Mutex{},
+		accounts:    make(map[string]*karmaAccount),
+	}
+
+	for _, name := range karmaBuckets {
+		require.NoError(t, p.db.EnsureBucket(name))
+	}
+
+	return p
+}
+
+func TestKarmaIndexKeys(t *testing.T) {
+	scores := []int{-1 << 40, -100, -1, 0, 1, 5, 100, 1 << 40}
+
+	var ascKeys, descKeys []string
+	for _, score := range scores {
+		asc, desc := karmaIndexKeys("#seabird", &KarmaTarget{Name: "target", Score: score})
+		assert.Regexp(t, `^#seabird \d{20} target$`, asc)
+		assert.Regexp(t, `^#seabird \d{20} target$`, desc)
+
+		ascKeys = append(ascKeys, asc)
+		descKeys = append(descKeys, desc)
+	}
+
+	// The scores are in order, so the ascending keys should already be
+	// sorted and the descending keys should be sorted in reverse.
+	assert.True(t, sort.StringsAreSorted(ascKeys), "ascending keys out of order: %v", ascKeys)
+	assert.True(t, sort.IsSorted(sort.Reverse(sort.StringSlice(descKeys))), "descending keys out of order: %v", descKeys)
+}
+
+func TestKarmaRank(t *testing.T) {
+	p := newTestKarmaPlugin(t)
+
+	changes := []KarmaChange{
+		{Target: "alpha", Channel: "#a", Delta: 3},
+		{Target: "beta", Channel: "#a", Delta: -2},
+		{Target: "gamma", Channel: "#b", Delta: 3},
+		{Target: "delta", Channel: "#a", Delta: 1},
+		{Target: "delta", Channel: "#b", Delta: 5},
+	}
+	for i := range changes {
+		p.applyKarma(&changes[i])
+	}
+
+	var tests = []struct {
+		Scope string
+		Name  string
+		Score int
+		Rank  int
+	}{
+		{globalKarmaScope, "delta", 6, 1},
+		{globalKarmaScope, "alpha", 3, 2},
+		{globalKarmaScope, "gamma", 3, 2},
+		{globalKarmaScope, "beta", -2, 4},
+		{"#a", "alpha", 3, 1},
+		{"#a", "delta", 1, 2},
+		{"#a", "beta", -2, 3},
+		{"#b", "delta", 5, 1},
+		{"#b", "gamma", 3, 2},
+	}
+
+	for _, test := range tests {
+		target, rank, err := p.karmaRank(test.Scope, test.Name)
+		if assert.NoError(t, err, "%s in %s", test.Name, test.Scope) {
+			assert.Equal(t, test.Score, target.Score, "%s in %s", test.Name, test.Scope)
+			assert.Equal(t, test.Rank, rank, "%s in %s", test.Name, test.Scope)
+		}
+	}
+
+	_, _, err := p.karmaRank(globalKarmaScope, "epsilon")
+	assert.Equal(t, storage.ErrNotFound, err)
+	_, _, err = p.karmaRank("#b", "beta")
+	assert.Equal(t, storage.ErrNotFound, err)
+
+	// The index scan should only see the requested scope, in score order.
+	var scans = []struct {
+		Index    string
+		Scope    string
+		Expected []string
+	}{
+		{"index_desc", globalKarmaScope, []string{"delta", "alpha", "gamma", "beta"}},
+		{"index_asc", globalKarmaScope, []string{"beta", "alpha", "gamma", "delta"}},
+		{"index_desc", "#a", []string{"alpha", "delta", "beta"}},
+		{"index_asc", "#b", []string{"gamma", "delta"}},
+	}
+
+	for _, test := range scans {
+		var names []string
+		err := p.scanKarmaIndex(test.Index, test.Scope, func(target *KarmaTarget) bool {
+			names = append(names, target.Name)
+			return true
+		})
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.Expected, names, "%s in %s", test.Index, test.Scope)
+		}
+	}
+}
+
+func TestKarmaHistoryKeys(t *testing.T) {
+	var tests = []struct {
+		ID        string
+		Key       string
+		TargetKey string
+		GiverKey  string
+	}{
+		{"1", "00000000000000000001", "alpha\x0018446744073709551614", "bob\x0018446744073709551614"},
+		{"2", "00000000000000000002", "alpha\x0018446744073709551613", "bob\x0018446744073709551613"},
+		{"10", "00000000000000000010", "alpha\x0018446744073709551605", "bob\x0018446744073709551605"},
+	}
+
+	for _, test := range tests {
+		key, targetKey, giverKey := karmaHistoryKeys(&KarmaChange{ID: test.ID, Target: "alpha", Giver: "bob"})
+		assert.Equal(t, test.Key, key, test.ID)
+		assert.Equal(t, test.TargetKey, targetKey, test.ID)
+		assert.Equal(t, test.GiverKey, giverKey, test.ID)
+	}
+}
+
+func TestKarmaRevert(t *testing.T) {
+	p := newTestKarmaPlugin(t)
+
+	changes := []KarmaChange{
+		{Target: "alpha", Giver: "bob", Channel: "#a", Delta: 3},
+		{Target: "beta", Giver: "bob", Channel: "#a", Delta: -1},
+		{Target: "alpha", Giver: "carol", Channel: "#a", Delta: 2},
+		{Target: "beta", Giver: "bob", Delta: 4},
+	}
+	for i := range changes {
+		p.applyKarma(&changes[i])
+	}
+
+	// Changes should come back newest first.
+	var deltas []int
+	err := p.db.View(func(tx storage.Tx) error {
+		return karmaChanges(tx, "history_by_giver", "bob", func(change *KarmaChange) bool {
+			deltas = append(deltas, change.Delta)
+			return true
+		})
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int{4, -1, 3}, deltas)
+
+	var tests = []struct {
+		Giver    string
+		Target   string
+		Reverted int
+		Scores   map[string]int
+	}{
+		// Reverting only touches the given target.
+		{"bob", "beta", 2, map[string]int{"alpha": 5, "beta": 0}},
+		// Changes which were already reverted aren't reverted again.
+		{"bob", "", 1, map[string]int{"alpha": 2, "beta": 0}},
+		{"bob", "", 0, map[string]int{"alpha": 2, "beta": 0}},
+		{"carol", "", 1, map[string]int{"alpha": 0, "beta": 0}},
+	}
+
+	for _, test := range tests {
+		count, err := p.revertKarma(test.Giver, test.Target)
+		if !assert.NoError(t, err) {
+			continue
+		}
+
+		assert.Equal(t, test.Reverted, count, "%s %s", test.Giver, test.Target)
+		for name, score := range test.Scores {
+			assert.Equal(t, score, p.GetKarmaFor(name), "%s after reverting %s %s", name, test.Giver, test.Target)
+		}
+	}
+
+	// Channel scores should be reverted along with the global ones.
+	for _, name := range []string{"alpha", "beta"} {
+		target, _, err := p.karmaRank("#a", name)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, 0, target.Score, name)
+		}
+	}
+}
+
+func TestKarmaLink(t *testing.T) {
+	p := newTestKarmaPlugin(t)
+
+	changes := []KarmaChange{
+		{Target: "go-lang", Giver: "bob", Channel: "#a", Delta: 2},
+		{Target: "golang", Giver: "bob", Channel: "#a", Delta: 3},
+		{Target: "go", Giver: "carol", Channel: "#b", Delta: 1},
+	}
+	for i := range changes {
+		p.applyKarma(&changes[i])
+	}
+
+	var tests = []struct {
+		Alias  string
+		Target string
+		Scores map[string]int
+		// Channels maps each channel to the targets its index should have,
+		// highest score first.
+		Channels map[string][]string
+	}{
+		{
+			"go-lang", "golang",
+			map[string]int{"go-lang": 5, "golang": 5, "go": 1},
+			map[string][]string{globalKarmaScope: {"golang", "go"}, "#a": {"golang"}, "#b": {"go"}},
+		},
+		// Linking the target of an existing alias moves the alias along
+		// with it.
+		{
+			"golang", "go",
+			map[string]int{"go-lang": 6, "golang": 6, "go": 6},
+			map[string][]string{globalKarmaScope: {"go"}, "#a": {"go"}, "#b": {"go"}},
+		},
+	}
+
+	for _, test := range tests {
+		err := p.db.Update(func(tx storage.Tx) error {
+			return linkKarma(tx, test.Alias, test.Target)
+		})
+		if !assert.NoError(t, err, "%s -> %s", test.Alias, test.Target) {
+			continue
+		}
+
+		for name, score := range test.Scores {
+			assert.Equal(t, score, p.GetKarmaFor(name), name)
+		}
+
+		for scope, expected := range test.Channels {
+			var names []string
+			err := p.scanKarmaIndex("index_desc", scope, func(target *KarmaTarget) bool {
+				names = append(names, target.Name)
+				return true
+			})
+			if assert.NoError(t, err) {
+				assert.Equal(t, expected, names, "index for %s", scope)
+			}
+		}
+	}
+
+	assert.Equal(t, "go", p.canonicalName("Go-Lang"))
+
+	// All the history should have followed the merges.
+	var targets []string
+	err := p.db.View(func(tx storage.Tx) error {
+		return karmaChanges(tx, "history_by_target", "go", func(change *KarmaChange) bool {
+			targets = append(targets, change.Target)
+			return true
+		})
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"go", "go", "go"}, targets)
+
+	err = p.db.Update(func(tx storage.Tx) error {
+		return linkKarma(tx, "go", "golang")
+	})
+	assert.Error(t, err)
+}
@@ -2,20 +2,41 @@ package extra
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/belak/go-seabird"
-	"github.com/belak/nut"
+	"github.com/belak/go-seabird/plugins"
+	"github.com/belak/go-seabird/storage"
 	"github.com/go-irc/irc"
 )
 
 func init() {
 	seabird.RegisterPlugin("lastseen", newLastSeenPlugin)
+
+	storage.RegisterMigration("lastseen", storage.Migration{
+		Version:     1,
+		Description: "Move last seen data into namespaced bucket",
+		Buckets:     []string{"lastseen", "lastseen_channels"},
+		Migrate: func(tx storage.Tx) error {
+			return storage.MoveBucket(tx, "lastseen", "lastseen_channels")
+		},
+	})
 }
 
 type lastSeenPlugin struct {
-	db *nut.DB
+	db      *storage.Namespace
+	tracker *plugins.ChannelTracker
+}
+
+// LastSeen is the last thing a user was seen doing.
+type LastSeen struct {
+	Nick    string
+	Action  string
+	Channel string
+	Text    string
+	Time    time.Time
 }
 
 type lastSeenChannelBucket struct {
@@ -23,12 +44,16 @@ type lastSeenChannelBucket struct {
 	Nicks map[string]time.Time
 }
 
-func newLastSeenPlugin(m *seabird.BasicMux, cm *seabird.CommandMux, db *nut.DB) error {
-	p := &lastSeenPlugin{db: db}
+func newLastSeenPlugin(m *seabird.BasicMux, cm *seabird.CommandMux, store *storage.Store, tracker *plugins.ChannelTracker) error {
+	p := &lastSeenPlugin{
+		db:      store.Namespace("lastseen"),
+		tracker: tracker,
+	}
 
-	err := p.db.EnsureBucket("lastseen")
-	if err != nil {
-		return err
+	for _, name := range []string{"channels", "seen", "optout"} {
+		if err := p.db.EnsureBucket(name); err != nil {
+			return err
+		}
 	}
 
 	cm.Event("active", p.activeCallback, &seabird.HelpInfo{
@@ -36,7 +61,18 @@ func newLastSeenPlugin(m *seabird.BasicMux, cm *seabird.CommandMux, db *nut.DB)
 		Description: "Reports the last time user was seen",
 	})
 
+	cm.Event("seen", p.seenCallback, &seabird.HelpInfo{
+		Usage:       "<nick> | optout | optin",
+		Description: "Reports what a user was last seen doing. Use optout to stop being tracked.",
+	})
+
 	m.Event("PRIVMSG", p.msgCallback)
+	m.Event("CTCP", p.actionCallback)
+	m.Event("JOIN", p.joinCallback)
+	m.Event("PART", p.partCallback)
+	m.Event("KICK", p.kickCallback)
+	m.Event("QUIT", p.quitCallback)
+	m.Event("NICK", p.nickCallback)
 
 	return nil
 }
@@ -48,7 +84,11 @@ func (p *lastSeenPlugin) activeCallback(b *seabird.Bot, m *irc.Message) {
 		return
 	}
 
-	channel := m.Params[0]
+	_, channel, ok := b.ChannelTarget(m.Params[0])
+	if !ok {
+		b.MentionReply(m, "Must be used in a channel")
+		return
+	}
 
 	b.MentionReply(m, "%s", p.getLastSeen(nick, channel))
 }
@@ -60,8 +100,8 @@ func (p *lastSeenPlugin) getLastSeen(rawNick, rawChannel string) string {
 		Key: strings.ToLower(rawChannel),
 	}
 
-	err := p.db.View(func(tx *nut.Tx) error {
-		bucket := tx.Bucket("lastseen")
+	err := p.db.View(func(tx storage.Tx) error {
+		bucket := tx.Bucket("channels")
 		return bucket.Get(channelBucket.Key, channelBucket)
 	})
 	if err != nil {
@@ -85,15 +125,303 @@ func formatDate(t time.Time) string {
 	return fmt.Sprintf("%d %s %d", t.Day(), t.Month().String(), t.Year())
 }
 
+// formatRoughDuration describes a duration using the largest unit which fits,
+// like "3 hours".
+func formatRoughDuration(d time.Duration) string {
+	units := []struct {
+		name string
+		size time.Duration
+	}{
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+	}
+
+	for _, unit := range units {
+		if d < unit.size {
+			continue
+		}
+
+		n := int(d / unit.size)
+		if n == 1 {
+			return "1 " + unit.name
+		}
+		return strconv.Itoa(n) + " " + unit.name + "s"
+	}
+
+	return "less than a minute"
+}
+
+// formatAgo describes how long ago something happened, like "3 hours ago".
+func formatAgo(t time.Time) string {
+	d := time.Since(t)
+	if d < time.Minute {
+		return "just now"
+	}
+	return formatRoughDuration(d) + " ago"
+}
+
+// describe turns what a user was doing into a sentence.
+func (s *LastSeen) describe() string {
+	var what string
+	switch s.Action {
+	case "said", "action":
+		if s.Text == "" {
+			what = "talking in " + s.Channel
+		} else if s.Action == "said" {
+			what = fmt.Sprintf("saying %q in %s", s.Text, s.Channel)
+		} else {
+			what = fmt.Sprintf("in %s: * %s %s", s.Channel, s.Nick, s.Text)
+		}
+	case "joined":
+		what = "joining " + s.Channel
+	case "parted":
+		what = "leaving " + s.Channel
+	case "kicked":
+		what = "being kicked from " + s.Channel
+	case "quit":
+		what = "quitting"
+	case "nick":
+		what = "changing their nick to " + s.Text
+	case "renamed":
+		what = "changing their nick from " + s.Text
+	default:
+		what = "doing something"
+	}
+
+	// Parts, kicks and quits have their reason in Text.
+	switch s.Action {
+	case "parted", "kicked", "quit":
+		if s.Text != "" {
+			what += fmt.Sprintf(" (%s)", s.Text)
+		}
+	}
+
+	return s.Nick + " was last seen " + formatAgo(s.Time) + " " + what
+}
+
+func (p *lastSeenPlugin) seenCallback(b *seabird.Bot, m *irc.Message) {
+	arg := strings.TrimSpace(m.Trailing())
+
+	switch arg {
+	case "":
+		b.MentionReply(m, "Nick required")
+		return
+	case "optout":
+		p.setOptOut(b, m, true)
+		return
+	case "optin":
+		p.setOptOut(b, m, false)
+		return
+	}
+
+	nick := strings.ToLower(arg)
+	if strings.EqualFold(arg, m.Prefix.Name) {
+		b.MentionReply(m, "You're right here")
+		return
+	}
+
+	var optedOut bool
+	seen := &LastSeen{}
+	err := p.db.View(func(tx storage.Tx) error {
+		if tx.Bucket("optout").Get(nick, &LastSeen{}) == nil {
+			optedOut = true
+			return nil
+		}
+
+		return tx.Bucket("seen").Get(nick, seen)
+	})
+
+	switch {
+	case optedOut:
+		b.MentionReply(m, "%s has asked me not to keep track of them", arg)
+	case err != nil:
+		b.MentionReply(m, "I haven't seen %s", arg)
+	default:
+		// What was said in a channel is only shared with people who
+		// could have seen it themselves.
+		if seen.Channel != "" && !p.inChannel(m.Prefix.Name, seen.Channel) {
+			seen.Channel = "another channel"
+			seen.Text = ""
+		}
+
+		b.MentionReply(m, "%s", seen.describe())
+	}
+}
+
+// inChannel returns true if the nick is currently in the given channel.
+func (p *lastSeenPlugin) inChannel(nick, channel string) bool {
+	if p.tracker == nil {
+		return false
+	}
+
+	user := p.tracker.LookupUser(nick)
+	return user != nil && user.InChannel(channel)
+}
+
+func (p *lastSeenPlugin) setOptOut(b *seabird.Bot, m *irc.Message, optOut bool) {
+	nick := strings.ToLower(m.Prefix.Name)
+
+	err := p.db.Update(func(tx storage.Tx) error {
+		if !optOut {
+			return tx.Bucket("optout").Delete(nick)
+		}
+
+		// Anything we already know goes away along with the opt out.
+		err := tx.Bucket("seen").Delete(nick)
+		if err != nil {
+			return err
+		}
+
+		err = forgetChannelActivity(tx.Bucket("channels"), nick)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket("optout").Put(nick, &LastSeen{Nick: m.Prefix.Name, Time: time.Now()})
+	})
+	if err != nil {
+		b.MentionReply(m, "Failed to update your settings: %s", err)
+		return
+	}
+
+	if optOut {
+		b.MentionReply(m, "I won't keep track of when I last saw you")
+	} else {
+		b.MentionReply(m, "I'll keep track of when I last saw you")
+	}
+}
+
+// record stores what a user was last seen doing, unless they've opted out.
+func (p *lastSeenPlugin) record(seen *LastSeen) {
+	nick := strings.ToLower(seen.Nick)
+	seen.Time = time.Now()
+
+	_ = p.db.Update(func(tx storage.Tx) error {
+		if tx.Bucket("optout").Get(nick, &LastSeen{}) == nil {
+			return nil
+		}
+
+		return tx.Bucket("seen").Put(nick, seen)
+	})
+}
+
 func (p *lastSeenPlugin) msgCallback(b *seabird.Bot, m *irc.Message) {
 	if len(m.Params) < 2 || !b.FromChannel(m) || m.Prefix.Name == "" {
 		return
 	}
 
 	nick := m.Prefix.Name
-	channel := m.Params[0]
+	_, channel, _ := b.ChannelTarget(m.Params[0])
+
+	p.updateLastSeen(nick, channel)
+	p.record(&LastSeen{Nick: nick, Action: "said", Channel: channel, Text: m.Trailing()})
+}
+
+func (p *lastSeenPlugin) actionCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 2 || !b.FromChannel(m) || m.Prefix.Name == "" {
+		return
+	}
+
+	text := m.Trailing()
+	if !strings.HasPrefix(text, "ACTION ") {
+		return
+	}
+
+	nick := m.Prefix.Name
+	_, channel, _ := b.ChannelTarget(m.Params[0])
 
 	p.updateLastSeen(nick, channel)
+	p.record(&LastSeen{Nick: nick, Action: "action", Channel: channel, Text: strings.TrimPrefix(text, "ACTION ")})
+}
+
+func (p *lastSeenPlugin) joinCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 1 || m.Prefix.Name == b.CurrentNick() {
+		return
+	}
+
+	p.record(&LastSeen{Nick: m.Prefix.Name, Action: "joined", Channel: m.Params[0]})
+}
+
+func (p *lastSeenPlugin) partCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 1 || m.Prefix.Name == b.CurrentNick() {
+		return
+	}
+
+	var reason string
+	if len(m.Params) > 1 {
+		reason = m.Params[1]
+	}
+
+	p.record(&LastSeen{Nick: m.Prefix.Name, Action: "parted", Channel: m.Params[0], Text: reason})
+}
+
+func (p *lastSeenPlugin) kickCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 2 || m.Params[1] == b.CurrentNick() {
+		return
+	}
+
+	var reason string
+	if len(m.Params) > 2 {
+		reason = m.Params[2]
+	}
+
+	p.record(&LastSeen{Nick: m.Params[1], Action: "kicked", Channel: m.Params[0], Text: reason})
+}
+
+func (p *lastSeenPlugin) quitCallback(b *seabird.Bot, m *irc.Message) {
+	if m.Prefix.Name == b.CurrentNick() {
+		return
+	}
+
+	var reason string
+	if len(m.Params) > 0 {
+		reason = m.Params[0]
+	}
+
+	p.record(&LastSeen{Nick: m.Prefix.Name, Action: "quit", Text: reason})
+}
+
+func (p *lastSeenPlugin) nickCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 1 || m.Params[0] == b.CurrentNick() {
+		return
+	}
+
+	oldNick := m.Prefix.Name
+	newNick := m.Params[0]
+
+	p.record(&LastSeen{Nick: oldNick, Action: "nick", Text: newNick})
+	p.record(&LastSeen{Nick: newNick, Action: "renamed", Text: oldNick})
+}
+
+// forgetChannelActivity removes a nick from the last active times of every
+// channel.
+func forgetChannelActivity(bucket storage.Bucket, nick string) error {
+	var changed []*lastSeenChannelBucket
+
+	v := &lastSeenChannelBucket{}
+	err := bucket.ForEach(v, func(key string) error {
+		if _, ok := v.Nicks[nick]; ok {
+			delete(v.Nicks, nick)
+			changed = append(changed, &lastSeenChannelBucket{Key: key, Nicks: v.Nicks})
+		}
+
+		// Decoding merges into an existing map, so each channel needs a
+		// fresh one.
+		v.Nicks = nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, channelBucket := range changed {
+		if err = bucket.Put(channelBucket.Key, channelBucket); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // Thanks to @belak for the comments
@@ -105,8 +433,12 @@ func (p *lastSeenPlugin) updateLastSeen(rawNick, rawChannel string) {
 		Nicks: make(map[string]time.Time),
 	}
 
-	_ = p.db.Update(func(tx *nut.Tx) error {
-		bucket := tx.Bucket("lastseen")
+	_ = p.db.Update(func(tx storage.Tx) error {
+		if tx.Bucket("optout").Get(nick, &LastSeen{}) == nil {
+			return nil
+		}
+
+		bucket := tx.Bucket("channels")
 
 		bucket.Get(channelBucket.Key, channelBucket)
 		channelBucket.Nicks[nick] = time.Now()
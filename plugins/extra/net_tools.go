@@ -135,8 +135,14 @@ func (p *netToolsPlugin) Ping(b *seabird.Bot, m *irc.Message) {
 }
 
 func (p *netToolsPlugin) pasteData(data string) (string, error) {
+	return pastebin(p.Key, data)
+}
+
+// pastebin uploads data to pastebin with the given API key and returns the
+// URL of the new paste.
+func pastebin(key, data string) (string, error) {
 	resp, err := http.PostForm("http://pastebin.com/api/api_post.php", url.Values{
-		"api_dev_key":    {p.Key},
+		"api_dev_key":    {key},
 		"api_option":     {"paste"},
 		"api_paste_code": {data},
 	})
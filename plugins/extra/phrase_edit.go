@@ -0,0 +1,267 @@
+package extra
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/storage"
+	"github.com/go-irc/irc"
+)
+
+type phrasesConfig struct {
+	// OwnerOnly restricts changing a key to the user who first set it,
+	// matched by their user and host. Keys set before owners were tracked
+	// by host only have a nick, which is a courtesy rather than protection.
+	// Admins can always change keys.
+	OwnerOnly bool
+
+	// EditLimit is how many changes a user can make in EditWindow. 0 means
+	// there is no limit.
+	EditLimit  int
+	EditWindow seabird.Duration
+}
+
+// owner returns the nick which owns this key.
+func (r *phraseBucket) owner() string {
+	if r.Owner != "" {
+		return r.Owner
+	}
+
+	if len(r.Entries) > 0 {
+		return r.Entries[0].Submitter
+	}
+
+	return ""
+}
+
+// ownerMask returns the mask used to recognize the sender of m as the owner
+// of a key.
+func ownerMask(m *irc.Message) string {
+	return "*!" + m.Prefix.User + "@" + m.Prefix.Host
+}
+
+// isOwner returns true if the sender of m owns this key.
+func (r *phraseBucket) isOwner(m *irc.Message) bool {
+	if r.OwnerMask != "" {
+		return seabird.MatchMask(r.OwnerMask, m.Prefix)
+	}
+
+	return strings.EqualFold(r.owner(), m.Prefix.Name)
+}
+
+// checkEditAllowed returns an error if the sender of m isn't allowed to
+// change the given key.
+func (p *phrasesPlugin) checkEditAllowed(b *seabird.Bot, m *irc.Message, row *phraseBucket) error {
+	if b.IsAdmin(m) {
+		return nil
+	}
+
+	if row.Locked {
+		return fmt.Errorf("%s is locked", row.Key)
+	}
+
+	// Keys which have been forgotten are up for grabs.
+	owner := row.owner()
+	if p.config.OwnerOnly && owner != "" && row.current() != nil && !row.isOwner(m) {
+		return fmt.Errorf("%s belongs to %s", row.Key, owner)
+	}
+
+	return nil
+}
+
+// checkEditRate records an edit for the sender of m and returns an error if
+// they have made too many recently.
+func (p *phrasesPlugin) checkEditRate(b *seabird.Bot, m *irc.Message) error {
+	if p.config.EditLimit <= 0 || b.IsAdmin(m) {
+		return nil
+	}
+
+	nick := strings.ToLower(m.Prefix.Name)
+	now := time.Now()
+	cutoff := now.Add(-p.config.EditWindow.Duration)
+
+	p.editLock.Lock()
+	defer p.editLock.Unlock()
+
+	var recent []time.Time
+	for _, t := range p.edits[nick] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+
+	if len(recent) >= p.config.EditLimit {
+		p.edits[nick] = recent
+		return errors.New("Too many phrase changes, try again later")
+	}
+
+	p.edits[nick] = append(recent, now)
+
+	return nil
+}
+
+// editPhrase runs the common checks for changing a key, then appends the
+// entry returned by fn and updates the search index.
+func (p *phrasesPlugin) editPhrase(b *seabird.Bot, m *irc.Message, key string, fn func(row *phraseBucket) (*phrase, error)) error {
+	return p.db.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("keys")
+
+		row := &phraseBucket{Key: key}
+		bucket.Get(key, row)
+
+		err := p.checkEditAllowed(b, m, row)
+		if err != nil {
+			return err
+		}
+
+		entry, err := fn(row)
+		if err != nil {
+			return err
+		}
+
+		err = p.checkEditRate(b, m)
+		if err != nil {
+			return err
+		}
+
+		// Setting a new or forgotten key makes you the owner.
+		old := row.current()
+		if old == nil && !entry.Deleted {
+			row.Owner = entry.Submitter
+			row.OwnerMask = ownerMask(m)
+		} else if row.Owner == "" {
+			row.Owner = row.owner()
+		}
+
+		row.Entries = append(row.Entries, *entry)
+
+		err = updatePhraseIndex(tx.Bucket("index"), key, old, row.current())
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(key, row)
+	})
+}
+
+func (p *phrasesPlugin) lockPhrase(b *seabird.Bot, m *irc.Message, key string, locked bool) {
+	if !b.IsAdmin(m) {
+		b.MentionReply(m, "Permission denied")
+		return
+	}
+
+	if key == "" {
+		b.MentionReply(m, "No key provided")
+		return
+	}
+
+	err := p.setPhraseLock(key, m.Prefix.Name, locked)
+	if err != nil {
+		b.MentionReply(m, "%s", err.Error())
+		return
+	}
+
+	if locked {
+		b.MentionReply(m, "Locked %s", key)
+	} else {
+		b.MentionReply(m, "Unlocked %s", key)
+	}
+}
+
+// setPhraseLock locks or unlocks a key.
+func (p *phrasesPlugin) setPhraseLock(key, by string, locked bool) error {
+	return p.db.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("keys")
+
+		row := &phraseBucket{}
+		if err := bucket.Get(key, row); err != nil {
+			return errors.New("No results for given key")
+		}
+
+		row.Locked = locked
+		row.LockedBy = ""
+		if locked {
+			row.LockedBy = by
+		}
+
+		return bucket.Put(key, row)
+	})
+}
+
+// revertPhrase restores an old entry for a key. Entries are numbered as in
+// the history command. If no entry is given, the most recent value before the
+// current one is restored.
+func (p *phrasesPlugin) revertPhrase(b *seabird.Bot, m *irc.Message, arg string) {
+	split := strings.Fields(arg)
+	if len(split) == 0 {
+		b.MentionReply(m, "No key provided")
+		return
+	}
+
+	// The entry number is optional and keys can have spaces in them, so
+	// only treat the last word as a number if there's more than one.
+	n := 0
+	if len(split) > 1 {
+		if parsed, err := strconv.Atoi(split[len(split)-1]); err == nil {
+			n = parsed
+			split = split[:len(split)-1]
+		}
+	}
+
+	key := p.cleanedName(strings.Join(split, " "))
+
+	restored, err := p.revertKey(b, m, key, n)
+	if err != nil {
+		b.MentionReply(m, "%s", err.Error())
+		return
+	}
+
+	b.MentionReply(m, "%s reverted to %s", key, restored.Value)
+}
+
+// revertKey restores entry n of a key, or the previous value if n is 0, and
+// returns the new entry.
+func (p *phrasesPlugin) revertKey(b *seabird.Bot, m *irc.Message, key string, n int) (*phrase, error) {
+	var restored *phrase
+	err := p.editPhrase(b, m, key, func(row *phraseBucket) (*phrase, error) {
+		if len(row.Entries) == 0 {
+			return nil, errors.New("No results for given key")
+		}
+
+		var entry *phrase
+		if n == 0 {
+			for i := len(row.Entries) - 2; i >= 0; i-- {
+				if !row.Entries[i].Deleted {
+					entry = &row.Entries[i]
+					break
+				}
+			}
+
+			if entry == nil {
+				return nil, errors.New("No previous value to revert to")
+			}
+		} else {
+			if n < 1 || n > len(row.Entries) {
+				return nil, fmt.Errorf("%s only has %d entries", key, len(row.Entries))
+			}
+
+			entry = &row.Entries[n-1]
+			if entry.Deleted {
+				return nil, fmt.Errorf("Entry %d is a deletion", n)
+			}
+		}
+
+		restored = &phrase{
+			Submitter: m.Prefix.Name,
+			Value:     entry.Value,
+		}
+
+		return restored, nil
+	})
+
+	return restored, err
+}
@@ -0,0 +1,140 @@
+package extra
+
+import (
+	"bytes"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/plugins"
+	"github.com/belak/go-seabird/plugins/url"
+	"github.com/go-irc/irc"
+)
+
+const (
+	phraseReplyMode  = "<reply>"
+	phraseActionMode = "<action>"
+
+	// phraseAlternativeSep separates values which should be picked from
+	// randomly.
+	phraseAlternativeSep = "||"
+)
+
+// phrasePlaceholderRegex matches the placeholders which can be used in phrase
+// values:
+//
+// - $who - the nick of the person who asked for the phrase
+// - $to - the nick the phrase was given to, or $who if it wasn't given
+// - $channel - the channel the phrase was asked for in
+// - $bot - the bot's current nick
+// - $args - everything after the key
+// - $1 through $9 - single words after the key
+// - $random_nick - a random nick from the channel
+var phrasePlaceholderRegex = regexp.MustCompile(`\$(random_nick|who|to|channel|bot|args|[1-9])\b`)
+
+// phraseRequest is everything needed to render a phrase.
+type phraseRequest struct {
+	Key   string
+	Value string
+	Args  []string
+
+	// To is who the phrase is being given to, if anyone.
+	To string
+}
+
+// compilePhrase turns a phrase value into a template. Placeholders become
+// template actions and everything else is escaped, so nothing a user sets can
+// run template code.
+func compilePhrase(value string) string {
+	var out bytes.Buffer
+
+	last := 0
+	for _, loc := range phrasePlaceholderRegex.FindAllStringSubmatchIndex(value, -1) {
+		out.WriteString(escapePhraseText(value[last:loc[0]]))
+
+		name := value[loc[2]:loc[3]]
+		if _, err := strconv.Atoi(name); err == nil {
+			name = "arg" + name
+		}
+		out.WriteString("{{ ." + name + " }}")
+
+		last = loc[1]
+	}
+	out.WriteString(escapePhraseText(value[last:]))
+
+	return out.String()
+}
+
+// escapePhraseText escapes anything which could be treated as a template
+// action. Every brace is escaped rather than just pairs so text next to a
+// placeholder can't run into its delimiters.
+func escapePhraseText(text string) string {
+	return strings.Replace(text, "{", `{{"{"}}`, -1)
+}
+
+// renderPhrase picks one of a phrase's alternatives, fills in placeholders and
+// sends it as a reply, a plain message or an action depending on its mode.
+func renderPhrase(b *seabird.Bot, m *irc.Message, tracker *plugins.ChannelTracker, req *phraseRequest) error {
+	alternatives := strings.Split(req.Value, phraseAlternativeSep)
+	value := strings.TrimSpace(alternatives[rand.Intn(len(alternatives))])
+
+	mode := ""
+	for _, prefix := range []string{phraseReplyMode, phraseActionMode} {
+		if strings.HasPrefix(strings.ToLower(value), prefix) {
+			mode = prefix
+			value = strings.TrimSpace(value[len(prefix):])
+			break
+		}
+	}
+
+	vars := map[string]interface{}{
+		"who":         m.Prefix.Name,
+		"to":          m.Prefix.Name,
+		"channel":     "",
+		"bot":         b.CurrentNick(),
+		"args":        strings.Join(req.Args, " "),
+		"random_nick": m.Prefix.Name,
+	}
+
+	if req.To != "" {
+		vars["to"] = req.To
+	}
+
+	for i := 1; i <= 9; i++ {
+		var arg string
+		if i <= len(req.Args) {
+			arg = req.Args[i-1]
+		}
+		vars["arg"+strconv.Itoa(i)] = arg
+	}
+
+	if _, channel, ok := b.ChannelTarget(m.Params[0]); ok {
+		vars["channel"] = channel
+
+		if tracker != nil {
+			if users := tracker.UsersInChannel(channel); len(users) > 0 {
+				vars["random_nick"] = users[rand.Intn(len(users))].Nick
+			}
+		}
+	}
+
+	out, err := url.RenderTemplate(url.TemplateMustCompile(req.Key, compilePhrase(value)), vars)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case mode == phraseActionMode:
+		b.Reply(m, "\x01ACTION %s\x01", out)
+	case mode == phraseReplyMode:
+		b.Reply(m, "%s", out)
+	case req.To != "":
+		b.Reply(m, "%s: %s", req.To, out)
+	default:
+		b.MentionReply(m, "%s", out)
+	}
+
+	return nil
+}
@@ -2,25 +2,96 @@ package extra
 
 import (
 	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 
 	"github.com/belak/go-seabird"
-	"github.com/belak/nut"
+	"github.com/belak/go-seabird/plugins"
+	"github.com/belak/go-seabird/storage"
 	"github.com/go-irc/irc"
 )
 
 func init() {
 	seabird.RegisterPlugin("phrases", newPhrasesPlugin)
+
+	storage.RegisterMigration("phrases", storage.Migration{
+		Version:     1,
+		Description: "Move phrases into namespaced bucket",
+		Buckets:     []string{"phrases", "phrases_keys"},
+		Migrate: func(tx storage.Tx) error {
+			return storage.MoveBucket(tx, "phrases", "phrases_keys")
+		},
+	})
+
+	storage.RegisterMigration("phrases", storage.Migration{
+		Version:     2,
+		Description: "Build phrase search index",
+		Buckets:     []string{"phrases_keys", "phrases_index"},
+		Migrate: func(tx storage.Tx) error {
+			var rows []phraseBucket
+			row := &phraseBucket{}
+			err := tx.Bucket("phrases_keys").ForEach(row, func(key string) error {
+				rows = append(rows, *row)
+
+				// Decoding reuses the entries slice, so start fresh to
+				// keep it from overwriting the row we just saved.
+				*row = phraseBucket{}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			index := tx.Bucket("phrases_index")
+			for _, row := range rows {
+				err = updatePhraseIndex(index, row.Key, nil, row.current())
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	})
 }
 
+const (
+	phraseSearchResults = 10
+	phraseListResults   = 20
+)
+
+var phraseWordRegex = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
 type phrasesPlugin struct {
-	db *nut.DB
+	db      *storage.Namespace
+	tracker *plugins.ChannelTracker
+	config  phrasesConfig
+
+	editLock *sync.Mutex
+	edits    map[string][]time.Time
 }
 
 type phraseBucket struct {
 	Key     string
 	Entries []phrase
+
+	// Owner is the nick which first set this key. Older keys won't have an
+	// owner set, so the first submitter is used instead.
+	Owner string
+
+	// OwnerMask is a "*!user@host" mask for the owner. Ownership is checked
+	// against this rather than the nick, since anyone can take a nick.
+	OwnerMask string
+
+	// Locked keys can only be changed by admins.
+	Locked   bool
+	LockedBy string
 }
 
 type phrase struct {
@@ -29,12 +100,99 @@ type phrase struct {
 	Deleted   bool
 }
 
-func newPhrasesPlugin(cm *seabird.CommandMux, db *nut.DB) error {
-	p := &phrasesPlugin{db: db}
+// current returns the latest entry for this key, or nil if there isn't one
+// or it has been deleted.
+func (r *phraseBucket) current() *phrase {
+	if len(r.Entries) == 0 {
+		return nil
+	}
 
-	err := p.db.EnsureBucket("phrases")
-	if err != nil {
-		return err
+	entry := r.Entries[len(r.Entries)-1]
+	if entry.Deleted {
+		return nil
+	}
+
+	return &entry
+}
+
+// phraseWords returns the unique, lowercased words in a key and value, which
+// is what the search index is built from.
+func phraseWords(key, value string) []string {
+	seen := make(map[string]bool)
+
+	var ret []string
+	for _, word := range phraseWordRegex.FindAllString(strings.ToLower(key+" "+value), -1) {
+		if !seen[word] {
+			seen[word] = true
+			ret = append(ret, word)
+		}
+	}
+
+	return ret
+}
+
+// phraseHasWords returns true if every query word is the start of one of the
+// phrase's words.
+func phraseHasWords(phraseWords, query []string) bool {
+	for _, q := range query {
+		found := false
+		for _, word := range phraseWords {
+			if strings.HasPrefix(word, q) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// updatePhraseIndex removes the words from a key's old entry from the index
+// and adds the words from the new one. Either entry may be nil.
+func updatePhraseIndex(index storage.Bucket, key string, oldEntry, newEntry *phrase) error {
+	if oldEntry != nil {
+		for _, word := range phraseWords(key, oldEntry.Value) {
+			if err := index.Delete(word + "\x00" + key); err != nil {
+				return err
+			}
+		}
+	}
+
+	if newEntry != nil {
+		for _, word := range phraseWords(key, newEntry.Value) {
+			if err := index.Put(word+"\x00"+key, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func newPhrasesPlugin(b *seabird.Bot, cm *seabird.CommandMux, store *storage.Store, tracker *plugins.ChannelTracker) error {
+	p := &phrasesPlugin{
+		db:      store.Namespace("phrases"),
+		tracker: tracker,
+		config: phrasesConfig{
+			EditLimit:  10,
+			EditWindow: seabird.Duration{Duration: 10 * time.Minute},
+		},
+		editLock: &sync.Mutex{},
+		edits:    make(map[string][]time.Time),
+	}
+
+	// The phrases config section is optional.
+	_ = b.Config("phrases", &p.config)
+
+	for _, name := range []string{"keys", "index"} {
+		err := p.db.EnsureBucket(name)
+		if err != nil {
+			return err
+		}
 	}
 
 	cm.Event("forget", p.forgetCallback, &seabird.HelpInfo{
@@ -43,12 +201,12 @@ func newPhrasesPlugin(cm *seabird.CommandMux, db *nut.DB) error {
 	})
 
 	cm.Event("get", p.getCallback, &seabird.HelpInfo{
-		Usage:       "<key>",
+		Usage:       "<key> [args]",
 		Description: "Look up a phrase",
 	})
 
 	cm.Event("give", p.giveCallback, &seabird.HelpInfo{
-		Usage:       "<user> <key>",
+		Usage:       "<user> <key> [args]",
 		Description: "Mentions a user with a given phrase",
 	})
 
@@ -57,9 +215,14 @@ func newPhrasesPlugin(cm *seabird.CommandMux, db *nut.DB) error {
 		Description: "Look up history for a key",
 	})
 
+	cm.Event("phrase", p.phraseCallback, &seabird.HelpInfo{
+		Usage:       "search <text> | random | list [prefix] | count | lock <key> | unlock <key> | revert <key> [n]",
+		Description: "Search, list and manage phrases. Locking is admin only.",
+	})
+
 	cm.Event("set", p.setCallback, &seabird.HelpInfo{
 		Usage:       "<key> <phrase>",
-		Description: "Remembers a phrase",
+		Description: "Remembers a phrase. Phrases can use $who, $to, $channel, $bot, $args, $1-$9 and $random_nick, start with <reply> or <action>, and have alternatives separated by ||",
 	})
 
 	return nil
@@ -75,8 +238,8 @@ func (p *phrasesPlugin) getKey(key string) (*phrase, error) {
 		return nil, errors.New("No key provided")
 	}
 
-	err := p.db.View(func(tx *nut.Tx) error {
-		bucket := tx.Bucket("phrases")
+	err := p.db.View(func(tx storage.Tx) error {
+		bucket := tx.Bucket("keys")
 		return bucket.Get(row.Key, row)
 	})
 
@@ -95,26 +258,21 @@ func (p *phrasesPlugin) getKey(key string) (*phrase, error) {
 }
 
 func (p *phrasesPlugin) forgetCallback(b *seabird.Bot, m *irc.Message) {
-	row := &phraseBucket{Key: p.cleanedName(m.Trailing())}
-	if len(row.Key) == 0 {
+	key := p.cleanedName(m.Trailing())
+	if len(key) == 0 {
 		b.MentionReply(m, "No key supplied")
+		return
 	}
 
-	entry := phrase{
-		Submitter: m.Prefix.Name,
-		Deleted:   true,
-	}
-
-	err := p.db.Update(func(tx *nut.Tx) error {
-		bucket := tx.Bucket("phrases")
-		err := bucket.Get(row.Key, row)
-		if err != nil {
-			return errors.New("No results for given key")
+	err := p.editPhrase(b, m, key, func(row *phraseBucket) (*phrase, error) {
+		if len(row.Entries) == 0 {
+			return nil, errors.New("No results for given key")
 		}
 
-		row.Entries = append(row.Entries, entry)
-
-		return bucket.Put(row.Key, row)
+		return &phrase{
+			Submitter: m.Prefix.Name,
+			Deleted:   true,
+		}, nil
 	})
 
 	if err != nil {
@@ -122,17 +280,47 @@ func (p *phrasesPlugin) forgetCallback(b *seabird.Bot, m *irc.Message) {
 		return
 	}
 
-	b.MentionReply(m, "Forgot %s", row.Key)
+	b.MentionReply(m, "Forgot %s", key)
+}
+
+// lookupPhrase finds the phrase for the given text. If the whole text isn't
+// a key, the first word is used as the key and the rest are arguments.
+func (p *phrasesPlugin) lookupPhrase(text string) (*phraseRequest, error) {
+	text = strings.TrimSpace(text)
+
+	row, err := p.getKey(text)
+	if err == nil {
+		return &phraseRequest{Key: p.cleanedName(text), Value: row.Value}, nil
+	}
+
+	split := strings.Fields(text)
+	if len(split) < 2 {
+		return nil, err
+	}
+
+	row, argErr := p.getKey(split[0])
+	if argErr != nil {
+		return nil, err
+	}
+
+	return &phraseRequest{
+		Key:   p.cleanedName(split[0]),
+		Value: row.Value,
+		Args:  split[1:],
+	}, nil
 }
 
 func (p *phrasesPlugin) getCallback(b *seabird.Bot, m *irc.Message) {
-	row, err := p.getKey(m.Trailing())
+	req, err := p.lookupPhrase(m.Trailing())
 	if err != nil {
 		b.MentionReply(m, "%s", err.Error())
 		return
 	}
 
-	b.MentionReply(m, "%s", row.Value)
+	err = renderPhrase(b, m, p.tracker, req)
+	if err != nil {
+		b.MentionReply(m, "%s", err.Error())
+	}
 }
 
 func (p *phrasesPlugin) giveCallback(b *seabird.Bot, m *irc.Message) {
@@ -142,13 +330,18 @@ func (p *phrasesPlugin) giveCallback(b *seabird.Bot, m *irc.Message) {
 		return
 	}
 
-	row, err := p.getKey(split[1])
+	req, err := p.lookupPhrase(split[1])
 	if err != nil {
 		b.MentionReply(m, "%s", err.Error())
 		return
 	}
 
-	b.Reply(m, "%s: %s", split[0], row.Value)
+	req.To = split[0]
+
+	err = renderPhrase(b, m, p.tracker, req)
+	if err != nil {
+		b.MentionReply(m, "%s", err.Error())
+	}
 }
 
 func (p *phrasesPlugin) historyCallback(b *seabird.Bot, m *irc.Message) {
@@ -158,8 +351,8 @@ func (p *phrasesPlugin) historyCallback(b *seabird.Bot, m *irc.Message) {
 		return
 	}
 
-	err := p.db.View(func(tx *nut.Tx) error {
-		bucket := tx.Bucket("phrases")
+	err := p.db.View(func(tx storage.Tx) error {
+		bucket := tx.Bucket("keys")
 		return bucket.Get(row.Key, row)
 	})
 	if err != nil {
@@ -167,11 +360,11 @@ func (p *phrasesPlugin) historyCallback(b *seabird.Bot, m *irc.Message) {
 		return
 	}
 
-	for _, entry := range row.Entries {
+	for i, entry := range row.Entries {
 		if entry.Deleted {
-			b.MentionReply(m, "%s deleted by %s", row.Key, entry.Submitter)
+			b.MentionReply(m, "#%d %s deleted by %s", i+1, row.Key, entry.Submitter)
 		} else {
-			b.MentionReply(m, "%s set by %s to %s", row.Key, entry.Submitter, entry.Value)
+			b.MentionReply(m, "#%d %s set by %s to %s", i+1, row.Key, entry.Submitter, entry.Value)
 		}
 	}
 }
@@ -183,30 +376,214 @@ func (p *phrasesPlugin) setCallback(b *seabird.Bot, m *irc.Message) {
 		return
 	}
 
-	row := &phraseBucket{Key: p.cleanedName(split[0])}
-	if len(row.Key) == 0 {
+	key := p.cleanedName(split[0])
+	if len(key) == 0 {
 		b.MentionReply(m, "No key provided")
 		return
 	}
 
-	entry := phrase{
+	entry := &phrase{
 		Submitter: m.Prefix.Name,
 		Value:     split[1],
 	}
 
-	err := p.db.Update(func(tx *nut.Tx) error {
-		bucket := tx.Bucket("phrases")
-		bucket.Get(row.Key, row)
+	err := p.editPhrase(b, m, key, func(row *phraseBucket) (*phrase, error) {
+		return entry, nil
+	})
+
+	if err != nil {
+		b.MentionReply(m, "%s", err.Error())
+		return
+	}
+
+	b.MentionReply(m, "%s set to %s", key, entry.Value)
+}
+
+func (p *phrasesPlugin) phraseCallback(b *seabird.Bot, m *irc.Message) {
+	split := strings.SplitN(strings.TrimSpace(m.Trailing()), " ", 2)
+
+	var arg string
+	if len(split) > 1 {
+		arg = strings.TrimSpace(split[1])
+	}
+
+	switch split[0] {
+	case "search":
+		p.searchPhrases(b, m, arg)
+	case "random":
+		p.randomPhrase(b, m)
+	case "list":
+		p.listPhrases(b, m, p.cleanedName(arg))
+	case "count":
+		p.countPhrases(b, m)
+	case "lock":
+		p.lockPhrase(b, m, p.cleanedName(arg), true)
+	case "unlock":
+		p.lockPhrase(b, m, p.cleanedName(arg), false)
+	case "revert":
+		p.revertPhrase(b, m, arg)
+	default:
+		b.MentionReply(m, "Usage: search <text> | random | list [prefix] | count | lock <key> | unlock <key> | revert <key> [n]")
+	}
+}
+
+// searchPhrases finds keys where every word in the query is the start of a
+// word in the key or value.
+func (p *phrasesPlugin) searchPhrases(b *seabird.Bot, m *irc.Message, query string) {
+	words := phraseWords(query, "")
+	if len(words) == 0 {
+		b.MentionReply(m, "Search text required")
+		return
+	}
+
+	keys, err := p.findPhrases(words)
+	if err != nil {
+		b.MentionReply(m, "%s", err.Error())
+		return
+	}
+
+	if len(keys) == 0 {
+		b.MentionReply(m, "No phrases found")
+		return
+	}
 
-		row.Entries = append(row.Entries, entry)
+	b.MentionReply(m, "%s", formatPhraseKeys(keys, phraseSearchResults))
+}
 
-		return bucket.Put(row.Key, row)
+// findPhrases returns the sorted keys which match all the given words.
+func (p *phrasesPlugin) findPhrases(words []string) ([]string, error) {
+	// Longer words match fewer entries, so the longest one is looked up in
+	// the index and the rest are only checked against what it found.
+	sort.Slice(words, func(i, j int) bool {
+		return len(words[i]) > len(words[j])
 	})
 
+	results := make(map[string]bool)
+	err := p.db.View(func(tx storage.Tx) error {
+		var key string
+		err := storage.ForEachPrefix(tx.Bucket("index"), words[0], &key, func(string) bool {
+			results[key] = true
+			return true
+		})
+		if err != nil || len(words) == 1 {
+			return err
+		}
+
+		keys := tx.Bucket("keys")
+		for key := range results {
+			row := &phraseBucket{}
+			if err := keys.Get(key, row); err != nil {
+				return err
+			}
+
+			entry := row.current()
+			if entry == nil || !phraseHasWords(phraseWords(key, entry.Value), words[1:]) {
+				delete(results, key)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for key := range results {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (p *phrasesPlugin) randomPhrase(b *seabird.Bot, m *irc.Message) {
+	var chosen *phraseBucket
+	var seen int
+
+	// Reservoir sampling means we only need to keep one phrase around no
+	// matter how many there are.
+	err := p.db.View(func(tx storage.Tx) error {
+		row := &phraseBucket{}
+		return tx.Bucket("keys").ForEach(row, func(key string) error {
+			if row.current() == nil {
+				return nil
+			}
+
+			seen++
+			if rand.Intn(seen) == 0 {
+				copied := *row
+				chosen = &copied
+
+				// Decoding reuses the entries slice, so start fresh to
+				// keep it from overwriting the chosen phrase.
+				*row = phraseBucket{}
+			}
+
+			return nil
+		})
+	})
 	if err != nil {
 		b.MentionReply(m, "%s", err.Error())
 		return
 	}
 
-	b.MentionReply(m, "%s set to %s", row.Key, entry.Value)
+	if chosen == nil {
+		b.MentionReply(m, "No phrases found")
+		return
+	}
+
+	b.MentionReply(m, "%s: %s", chosen.Key, chosen.current().Value)
+}
+
+func (p *phrasesPlugin) listPhrases(b *seabird.Bot, m *irc.Message, prefix string) {
+	var keys []string
+	err := p.db.View(func(tx storage.Tx) error {
+		row := &phraseBucket{}
+		return storage.ForEachPrefix(tx.Bucket("keys"), prefix, row, func(key string) bool {
+			if row.current() != nil {
+				keys = append(keys, key)
+			}
+			return true
+		})
+	})
+	if err != nil {
+		b.MentionReply(m, "%s", err.Error())
+		return
+	}
+
+	if len(keys) == 0 {
+		b.MentionReply(m, "No phrases found")
+		return
+	}
+
+	b.MentionReply(m, "%s", formatPhraseKeys(keys, phraseListResults))
+}
+
+func (p *phrasesPlugin) countPhrases(b *seabird.Bot, m *irc.Message) {
+	var count int
+	err := p.db.View(func(tx storage.Tx) error {
+		row := &phraseBucket{}
+		return tx.Bucket("keys").ForEach(row, func(key string) error {
+			if row.current() != nil {
+				count++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		b.MentionReply(m, "%s", err.Error())
+		return
+	}
+
+	b.MentionReply(m, "There are %d phrases", count)
+}
+
+// formatPhraseKeys joins up to max keys, noting how many were left off.
+func formatPhraseKeys(keys []string, max int) string {
+	if len(keys) <= max {
+		return strings.Join(keys, ", ")
+	}
+
+	return fmt.Sprintf("%s and %d more", strings.Join(keys[:max], ", "), len(keys)-max)
 }
@@ -0,0 +1,230 @@
+package extra
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	seabird "github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/storage"
+	utils "github.com/belak/go-seabird/test-utils"
+	"github.com/go-irc/irc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPhrasesPlugin(t *testing.T) (*phrasesPlugin, *seabird.Bot) {
+	_, b := utils.NewTestBot(t, `admins = ["admin!*@admin.example.com"]`)
+
+	store, err := storage.NewStore(storage.NewMemoryBackend())
+	require.NoError(t, err)
+
+	p := &phrasesPlugin{
+		db:       store.Namespace("phrases"),
+		editLock: &sync.Mutex{},
+		edits:    make(map[string][]time.Time),
+	}
+
+	for _, name := range []string{"keys", "index"} {
+		require.NoError(t, p.db.EnsureBucket(name))
+	}
+
+	return p, b
+}
+
+// testPhraseMessage returns a message from the given prefix.
+func testPhraseMessage(prefix string) *irc.Message {
+	return irc.MustParseMessage(":" + prefix + " PRIVMSG #seabird :!phrase")
+}
+
+func setTestPhrase(p *phrasesPlugin, b *seabird.Bot, prefix, key, value string) error {
+	m := testPhraseMessage(prefix)
+	return p.editPhrase(b, m, key, func(row *phraseBucket) (*phrase, error) {
+		return &phrase{Submitter: m.Prefix.Name, Value: value, Deleted: value == ""}, nil
+	})
+}
+
+func TestPhraseWords(t *testing.T) {
+	var tests = []struct {
+		Key, Value string
+		Expected   []string
+	}{
+		{"go", "Go is a language", []string{"go", "is", "a", "language"}},
+		{"hello", "Hello, world! Héllo again, world.", []string{"hello", "world", "héllo", "again"}},
+		{"answer", "42 (forty-two)", []string{"answer", "42", "forty", "two"}},
+		{"", "", nil},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.Expected, phraseWords(test.Key, test.Value), test.Value)
+	}
+}
+
+func TestPhraseSearch(t *testing.T) {
+	p, b := newTestPhrasesPlugin(t)
+
+	phrases := [][2]string{
+		{"golang", "a fun language with gophers"},
+		{"python", "another fun language"},
+		{"rust", "a language with crabs"},
+		// Changing and forgetting keys should update the index.
+		{"python", "snakes"},
+		{"rust", ""},
+	}
+	for _, v := range phrases {
+		require.NoError(t, setTestPhrase(p, b, "belak!belak@example.com", v[0], v[1]))
+	}
+
+	var tests = []struct {
+		Query    string
+		Expected []string
+	}{
+		{"language", []string{"golang"}},
+		{"lang FUN", []string{"golang"}},
+		{"go", []string{"golang"}},
+		{"snake", []string{"python"}},
+		{"python snakes", []string{"python"}},
+		{"fun snakes", nil},
+		{"crabs", nil},
+		{"rust", nil},
+	}
+
+	for _, test := range tests {
+		keys, err := p.findPhrases(phraseWords(test.Query, ""))
+		if assert.NoError(t, err, test.Query) {
+			assert.Equal(t, test.Expected, keys, test.Query)
+		}
+	}
+}
+
+func TestPhraseIndexMigration(t *testing.T) {
+	store, err := storage.NewStore(storage.NewMemoryBackend())
+	require.NoError(t, err)
+
+	// Phrases from before the store was namespaced or indexed.
+	require.NoError(t, store.EnsureBucket("phrases"))
+	err = store.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("phrases")
+		for _, row := range []phraseBucket{
+			{Key: "golang", Entries: []phrase{{Value: "gophers"}, {Value: "a fun language"}}},
+			{Key: "python", Entries: []phrase{{Value: "a language"}, {Value: "snakes"}}},
+		} {
+			if innerErr := bucket.Put(row.Key, &row); innerErr != nil {
+				return innerErr
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, store.Migrate())
+
+	p := &phrasesPlugin{db: store.Namespace("phrases")}
+	for query, expected := range map[string][]string{
+		"fun":      {"golang"},
+		"snakes":   {"python"},
+		"language": {"golang"},
+		"gophers":  nil,
+	} {
+		keys, err := p.findPhrases(phraseWords(query, ""))
+		if assert.NoError(t, err, query) {
+			assert.Equal(t, expected, keys, query)
+		}
+	}
+}
+
+func TestPhraseOwner(t *testing.T) {
+	var tests = []struct {
+		Row      phraseBucket
+		Prefix   string
+		Expected bool
+	}{
+		{phraseBucket{Owner: "belak", OwnerMask: "*!belak@example.com"}, "belak!belak@example.com", true},
+		{phraseBucket{Owner: "belak", OwnerMask: "*!belak@example.com"}, "belak_!belak@example.com", true},
+		{phraseBucket{Owner: "belak", OwnerMask: "*!belak@example.com"}, "belak!belak@other.example.com", false},
+		{phraseBucket{Owner: "belak", OwnerMask: "*!belak@example.com"}, "other!other@example.com", false},
+
+		// Keys from before owner masks were stored only have a nick.
+		{phraseBucket{Owner: "belak"}, "BELAK!anyone@anywhere", true},
+		{phraseBucket{Entries: []phrase{{Submitter: "belak"}}}, "belak!anyone@anywhere", true},
+		{phraseBucket{Owner: "belak"}, "other!belak@example.com", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.Expected, test.Row.isOwner(testPhraseMessage(test.Prefix)), "%+v %s", test.Row, test.Prefix)
+	}
+}
+
+func TestPhraseLockAndRevert(t *testing.T) {
+	p, b := newTestPhrasesPlugin(t)
+	p.config.OwnerOnly = true
+
+	const (
+		owner = "belak!belak@example.com"
+		other = "other!other@other.example.com"
+		admin = "admin!admin@admin.example.com"
+	)
+
+	var tests = []struct {
+		Prefix     string
+		Action     string
+		Value      string
+		N          int
+		ShouldFail bool
+
+		// Expected is the value afterwards, or "" if the key is forgotten.
+		Expected string
+	}{
+		{Prefix: owner, Action: "set", Value: "gophers", Expected: "gophers"},
+		{Prefix: owner, Action: "set", Value: "a language", Expected: "a language"},
+		{Prefix: other, Action: "set", Value: "mine", ShouldFail: true, Expected: "a language"},
+		{Prefix: "belak!belak@other.example.com", Action: "set", Value: "mine", ShouldFail: true, Expected: "a language"},
+		{Prefix: "belak_!belak@example.com", Action: "set", Value: "renamed", Expected: "renamed"},
+
+		// Only admins can change locked keys.
+		{Prefix: admin, Action: "lock", Expected: "renamed"},
+		{Prefix: owner, Action: "set", Value: "locked", ShouldFail: true, Expected: "renamed"},
+		{Prefix: owner, Action: "revert", ShouldFail: true, Expected: "renamed"},
+		{Prefix: admin, Action: "set", Value: "admin", Expected: "admin"},
+		{Prefix: admin, Action: "unlock", Expected: "admin"},
+
+		// Entries are numbered from 1, and 0 means the previous value.
+		{Prefix: owner, Action: "revert", Expected: "renamed"},
+		{Prefix: owner, Action: "revert", N: 1, Expected: "gophers"},
+		{Prefix: owner, Action: "revert", N: 10, ShouldFail: true, Expected: "gophers"},
+
+		// Forgotten keys are up for grabs, and reverting skips deletions.
+		{Prefix: owner, Action: "forget"},
+		{Prefix: owner, Action: "revert", N: 7, ShouldFail: true},
+		{Prefix: other, Action: "set", Value: "mine", Expected: "mine"},
+		{Prefix: owner, Action: "set", Value: "yours", ShouldFail: true, Expected: "mine"},
+		{Prefix: other, Action: "revert", Expected: "gophers"},
+	}
+
+	for i, test := range tests {
+		var err error
+		switch test.Action {
+		case "set":
+			err = setTestPhrase(p, b, test.Prefix, "go", test.Value)
+		case "forget":
+			err = setTestPhrase(p, b, test.Prefix, "go", "")
+		case "lock", "unlock":
+			err = p.setPhraseLock("go", test.Prefix, test.Action == "lock")
+		case "revert":
+			_, err = p.revertKey(b, testPhraseMessage(test.Prefix), "go", test.N)
+		}
+
+		if test.ShouldFail {
+			assert.Error(t, err, "step %d", i+1)
+		} else {
+			assert.NoError(t, err, "step %d", i+1)
+		}
+
+		entry, err := p.getKey("go")
+		if test.Expected == "" {
+			assert.Error(t, err, "step %d", i+1)
+		} else if assert.NoError(t, err, "step %d", i+1) {
+			assert.Equal(t, test.Expected, entry.Value, "step %d", i+1)
+		}
+	}
+}
@@ -0,0 +1,561 @@
+package extra
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/plugins"
+	"github.com/belak/go-seabird/storage"
+	"github.com/go-irc/irc"
+)
+
+func init() {
+	seabird.RegisterPlugin("poll", newPollPlugin)
+}
+
+const pollMaxOptions = 10
+
+// pollRetryDelay is how long to wait before trying to close a poll whose
+// results couldn't be sent again.
+const pollRetryDelay = 30 * time.Second
+
+type pollConfig struct {
+	// Duration is how long polls run if they don't say. MaxDuration is the
+	// longest a poll can run.
+	Duration    seabird.Duration
+	MaxDuration seabird.Duration
+}
+
+type pollPlugin struct {
+	db      *storage.Namespace
+	tracker *plugins.ChannelTracker
+	config  pollConfig
+	prefix  string
+
+	// Singly buffered channel
+	updateChan chan struct{}
+
+	// accounts maps tracker session IDs to the services account they're
+	// logged in to, as far as we've seen.
+	accountLock sync.Mutex
+	accounts    map[string]string
+}
+
+// Poll is a question asked in a channel. There can only be one open poll per
+// channel.
+type Poll struct {
+	Channel  string
+	Question string
+	Options  []string
+	Creator  string
+	Started  time.Time
+	Ends     time.Time
+
+	// Votes maps each voter to the index of the option they picked.
+	Votes map[string]int
+}
+
+func newPollPlugin(b *seabird.Bot, m *seabird.BasicMux, cm *seabird.CommandMux, store *storage.Store, tracker *plugins.ChannelTracker) error {
+	p := &pollPlugin{
+		db:         store.Namespace("poll"),
+		tracker:    tracker,
+		prefix:     cm.Prefix(),
+		updateChan: make(chan struct{}, 1),
+		accounts:   make(map[string]string),
+	}
+
+	// The poll config section is optional.
+	p.config.Duration.Duration = 5 * time.Minute
+	p.config.MaxDuration.Duration = 24 * time.Hour
+	_ = b.Config("poll", &p.config)
+
+	err := p.db.EnsureBucket("polls")
+	if err != nil {
+		return err
+	}
+
+	tracker.RegisterSessionCleanupCallback(p.cleanupSession)
+
+	m.Event("001", p.startLoop)
+	m.Event("JOIN", p.accountCallback)
+	m.Event("ACCOUNT", p.accountCallback)
+
+	cm.Event("poll", p.pollCallback, &seabird.HelpInfo{
+		Usage:       "[\"question\" <option> <option>... [--for <duration>] | close]",
+		Description: "Starts a poll in this channel, or shows the current one",
+	})
+	cm.Event("vote", p.voteCallback, &seabird.HelpInfo{
+		Usage:       "<number|option>",
+		Description: "Votes in this channel's poll",
+	})
+
+	return nil
+}
+
+// notify wakes up the poll loop so it can pick up changes.
+func (p *pollPlugin) notify() {
+	select {
+	case p.updateChan <- struct{}{}:
+	default:
+	}
+}
+
+// splitQuoted splits text on whitespace, keeping anything in double quotes
+// together.
+func splitQuoted(text string) ([]string, error) {
+	var ret []string
+	var cur bytes.Buffer
+	inQuotes, hasWord := false, false
+
+	for _, r := range text {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			hasWord = true
+		case !inQuotes && (r == ' ' || r == '\t'):
+			if hasWord {
+				ret = append(ret, cur.String())
+				cur.Reset()
+				hasWord = false
+			}
+		default:
+			cur.WriteRune(r)
+			hasWord = true
+		}
+	}
+
+	if inQuotes {
+		return nil, errors.New("Unterminated quote")
+	}
+
+	if hasWord {
+		ret = append(ret, cur.String())
+	}
+
+	return ret, nil
+}
+
+// parsePoll parses the arguments to the poll command into a new poll.
+func (p *pollPlugin) parsePoll(text string) (*Poll, error) {
+	args, err := splitQuoted(text)
+	if err != nil {
+		return nil, err
+	}
+
+	dur := p.config.Duration.Duration
+	var words []string
+	for i := 0; i < len(args); i++ {
+		if args[i] != "--for" {
+			words = append(words, args[i])
+			continue
+		}
+
+		if i+1 >= len(args) || !durationRegexp.MatchString(args[i+1]) {
+			return nil, errors.New("--for needs a duration like 10m")
+		}
+
+		dur, err = parseDuration(args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		i++
+	}
+
+	if len(words) < 3 {
+		return nil, errors.New("A poll needs a question and at least 2 options")
+	}
+
+	if len(words)-1 > pollMaxOptions {
+		return nil, fmt.Errorf("Polls can have at most %d options", pollMaxOptions)
+	}
+
+	if dur <= 0 || dur > p.config.MaxDuration.Duration {
+		return nil, fmt.Errorf("Polls can run for at most %s", p.config.MaxDuration.Duration)
+	}
+
+	now := time.Now()
+	return &Poll{
+		Question: words[0],
+		Options:  words[1:],
+		Started:  now,
+		Ends:     now.Add(dur),
+		Votes:    make(map[string]int),
+	}, nil
+}
+
+// tally returns the number of votes for each option.
+func (poll *Poll) tally() []int {
+	ret := make([]int, len(poll.Options))
+	for _, option := range poll.Votes {
+		if option >= 0 && option < len(ret) {
+			ret[option]++
+		}
+	}
+	return ret
+}
+
+// summary lists the options along with their votes.
+func (poll *Poll) summary() string {
+	counts := poll.tally()
+
+	var parts []string
+	for i, option := range poll.Options {
+		parts = append(parts, fmt.Sprintf("%d) %s: %d", i+1, option, counts[i]))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// results describes the winner of a poll.
+func (poll *Poll) results() string {
+	counts := poll.tally()
+
+	best := 0
+	var winners []string
+	for i, count := range counts {
+		switch {
+		case count > best:
+			best = count
+			winners = []string{poll.Options[i]}
+		case count == best && count > 0:
+			winners = append(winners, poll.Options[i])
+		}
+	}
+
+	switch len(winners) {
+	case 0:
+		return "Nobody voted"
+	case 1:
+		return fmt.Sprintf("Winner: %s with %d votes", winners[0], best)
+	default:
+		return fmt.Sprintf("Tie between %s with %d votes each", strings.Join(winners, ", "), best)
+	}
+}
+
+func (p *pollPlugin) pollCallback(b *seabird.Bot, m *irc.Message) {
+	_, channel, ok := b.ChannelTarget(m.Params[0])
+	if !ok {
+		b.MentionReply(m, "Must be used in a channel")
+		return
+	}
+
+	text := strings.TrimSpace(m.Trailing())
+
+	switch text {
+	case "":
+		p.showPoll(b, m, channel)
+		return
+	case "close":
+		p.closeCommand(b, m, channel)
+		return
+	}
+
+	poll, err := p.parsePoll(text)
+	if err != nil {
+		b.MentionReply(m, "%s", err)
+		return
+	}
+
+	poll.Channel = channel
+	poll.Creator = m.Prefix.Name
+
+	err = p.db.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("polls")
+
+		if bucket.Get(strings.ToLower(channel), &Poll{}) == nil {
+			return errors.New("There's already a poll running here")
+		}
+
+		return bucket.Put(strings.ToLower(channel), poll)
+	})
+	if err != nil {
+		b.MentionReply(m, "%s", err)
+		return
+	}
+
+	b.Reply(m, "Poll: %s %s. Vote with %svote <number>, closes in %s", poll.Question, poll.summary(), p.prefix, formatRoughDuration(poll.Ends.Sub(poll.Started)))
+
+	p.notify()
+}
+
+func (p *pollPlugin) showPoll(b *seabird.Bot, m *irc.Message, channel string) {
+	poll := &Poll{}
+	err := p.db.View(func(tx storage.Tx) error {
+		return tx.Bucket("polls").Get(strings.ToLower(channel), poll)
+	})
+	if err != nil {
+		b.MentionReply(m, "There's no poll running here")
+		return
+	}
+
+	b.MentionReply(m, "Poll: %s %s. Closes in %s", poll.Question, poll.summary(), formatRoughDuration(time.Until(poll.Ends)))
+}
+
+func (p *pollPlugin) closeCommand(b *seabird.Bot, m *irc.Message, channel string) {
+	poll := &Poll{}
+	err := p.db.View(func(tx storage.Tx) error {
+		return tx.Bucket("polls").Get(strings.ToLower(channel), poll)
+	})
+	if err != nil {
+		b.MentionReply(m, "There's no poll running here")
+		return
+	}
+
+	if !strings.EqualFold(poll.Creator, m.Prefix.Name) && !b.IsAdmin(m) {
+		b.MentionReply(m, "Only %s can close this poll", poll.Creator)
+		return
+	}
+
+	p.finish(b, poll)
+}
+
+func (p *pollPlugin) accountCallback(b *seabird.Bot, m *irc.Message) {
+	p.updateAccount(m)
+}
+
+// updateAccount remembers the account for the sender of m and returns the
+// best guess at which account they're logged in to.
+func (p *pollPlugin) updateAccount(m *irc.Message) string {
+	account, ok := messageAccount(m)
+
+	user := p.tracker.LookupUser(m.Prefix.Name)
+	if user == nil {
+		return account
+	}
+
+	p.accountLock.Lock()
+	defer p.accountLock.Unlock()
+
+	if !ok {
+		return p.accounts[user.UUID]
+	}
+
+	if account == "" {
+		delete(p.accounts, user.UUID)
+	} else {
+		p.accounts[user.UUID] = account
+	}
+
+	return account
+}
+
+// cleanupSession is called by the tracker with its lock held, so it must not
+// call back into it.
+func (p *pollPlugin) cleanupSession(u *plugins.User) {
+	p.accountLock.Lock()
+	defer p.accountLock.Unlock()
+
+	delete(p.accounts, u.UUID)
+}
+
+// voterKey returns who is voting, so everyone only gets one vote. Accounts
+// are used if we've seen which one the voter is logged in to, from
+// extended-join, account-notify or account-tag. Otherwise it's one vote per
+// host, which stops people from voting again under another nick.
+func (p *pollPlugin) voterKey(m *irc.Message) string {
+	if account := p.updateAccount(m); account != "" {
+		return "account:" + strings.ToLower(account)
+	}
+
+	if m.Prefix.Host != "" {
+		return "host:" + strings.ToLower(m.Prefix.Host)
+	}
+
+	return "nick:" + strings.ToLower(m.Prefix.Name)
+}
+
+func (p *pollPlugin) voteCallback(b *seabird.Bot, m *irc.Message) {
+	_, channel, ok := b.ChannelTarget(m.Params[0])
+	if !ok {
+		b.MentionReply(m, "Must be used in a channel")
+		return
+	}
+
+	// Only people actually in the channel get a say.
+	if user := p.tracker.LookupUser(m.Prefix.Name); user == nil || !user.InChannel(channel) {
+		b.MentionReply(m, "You need to be in %s to vote", channel)
+		return
+	}
+
+	choice := strings.TrimSpace(m.Trailing())
+	if choice == "" {
+		b.MentionReply(m, "Vote required")
+		return
+	}
+
+	voter := p.voterKey(m)
+
+	var picked string
+	err := p.db.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("polls")
+
+		poll := &Poll{}
+		if err := bucket.Get(strings.ToLower(channel), poll); err != nil || time.Now().After(poll.Ends) {
+			return errors.New("There's no poll running here")
+		}
+
+		option := -1
+		if n, err := strconv.Atoi(choice); err == nil {
+			option = n - 1
+		} else {
+			for i, o := range poll.Options {
+				if strings.EqualFold(o, choice) {
+					option = i
+					break
+				}
+			}
+		}
+
+		if option < 0 || option >= len(poll.Options) {
+			return fmt.Errorf("Pick a number from 1 to %d", len(poll.Options))
+		}
+
+		if poll.Votes == nil {
+			poll.Votes = make(map[string]int)
+		}
+
+		// Voting again changes your vote.
+		poll.Votes[voter] = option
+		picked = poll.Options[option]
+
+		return bucket.Put(strings.ToLower(channel), poll)
+	})
+	if err != nil {
+		b.MentionReply(m, "%s", err)
+		return
+	}
+
+	b.MentionReply(m, "Voted for %s", picked)
+}
+
+// finish removes a poll and announces its results. The poll is removed
+// first so if it's closed by hand just as it ends, only one of them announces
+// it. If the results can't be sent, the poll is put back for the loop to try
+// again.
+func (p *pollPlugin) finish(b *seabird.Bot, poll *Poll) bool {
+	logger := b.GetLogger().WithField("channel", poll.Channel)
+
+	if !b.Registered() {
+		return false
+	}
+
+	key := strings.ToLower(poll.Channel)
+
+	// Use what's stored rather than what we were given so the results
+	// include any votes since it was looked up.
+	removed := &Poll{}
+	err := p.db.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("polls")
+		if err := bucket.Get(key, removed); err != nil || !removed.Started.Equal(poll.Started) {
+			removed = nil
+			return nil
+		}
+
+		return bucket.Delete(key)
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to remove poll")
+		return false
+	}
+
+	p.notify()
+
+	// Someone else already closed it.
+	if removed == nil {
+		return true
+	}
+
+	err = b.Send(&irc.Message{
+		Prefix:  &irc.Prefix{},
+		Command: "PRIVMSG",
+		Params: []string{removed.Channel, fmt.Sprintf(
+			"Poll closed: %s %s. %s", removed.Question, removed.summary(), removed.results())},
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to announce poll results")
+
+		err = p.db.Update(func(tx storage.Tx) error {
+			bucket := tx.Bucket("polls")
+
+			// Don't clobber a poll which was started in the meantime.
+			if bucket.Get(key, &Poll{}) == nil {
+				return nil
+			}
+
+			return bucket.Put(key, removed)
+		})
+		if err != nil {
+			logger.WithError(err).Error("Failed to restore poll")
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// nextPoll returns the poll which will close first.
+func (p *pollPlugin) nextPoll() (*Poll, error) {
+	var next *Poll
+
+	err := p.db.View(func(tx storage.Tx) error {
+		v := &Poll{}
+		return tx.Bucket("polls").ForEach(v, func(key string) error {
+			if next == nil || v.Ends.Before(next.Ends) {
+				tmp := *v
+				next = &tmp
+			}
+			return nil
+		})
+	})
+
+	return next, err
+}
+
+// startLoop starts closing polls for as long as this connection lasts.
+// Polls are stored, so any which ended while we were gone are closed as soon
+// as we're back.
+func (p *pollPlugin) startLoop(b *seabird.Bot, m *irc.Message) {
+	go p.pollLoop(b, b.Done())
+}
+
+func (p *pollPlugin) pollLoop(b *seabird.Bot, done <-chan struct{}) {
+	logger := b.GetLogger()
+
+	for {
+		poll, err := p.nextPoll()
+		if err != nil {
+			logger.WithError(err).Error("Transaction failure. Exiting loop.")
+			return
+		}
+
+		var timer <-chan time.Time
+		if poll != nil {
+			waitDur := time.Until(poll.Ends)
+			if waitDur <= 0 {
+				if p.finish(b, poll) {
+					continue
+				}
+
+				waitDur = pollRetryDelay
+			}
+
+			timer = time.After(waitDur)
+		}
+
+		select {
+		case <-timer:
+			continue
+		case <-p.updateChan:
+			continue
+		case <-done:
+			return
+		}
+	}
+}
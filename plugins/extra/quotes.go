@@ -0,0 +1,333 @@
+package extra
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/storage"
+	"github.com/go-irc/irc"
+)
+
+func init() {
+	seabird.RegisterPlugin("quotes", newQuotesPlugin)
+}
+
+// quoteSearchLimit is how many matching IDs are listed by a search.
+const quoteSearchLimit = 10
+
+// quoteNickRegex pulls the nick out of quotes pasted like "<nick> text".
+var quoteNickRegex = regexp.MustCompile(`^<[~&@%+]?([^>\s]+)>`)
+
+type quotesPlugin struct {
+	db       *storage.Namespace
+	lastSeen *storage.Namespace
+}
+
+// Quote is a line someone thought was worth keeping.
+type Quote struct {
+	ID        string
+	Text      string
+	Nick      string
+	Submitter string
+	Channel   string
+	Time      time.Time
+}
+
+func newQuotesPlugin(cm *seabird.CommandMux, store *storage.Store) error {
+	p := &quotesPlugin{
+		db:       store.Namespace("quotes"),
+		lastSeen: store.Namespace("lastseen"),
+	}
+
+	err := p.db.EnsureBucket("quotes")
+	if err != nil {
+		return err
+	}
+
+	// Grabbing uses what the lastseen plugin has recorded, but that may
+	// not be loaded.
+	err = p.lastSeen.EnsureBucket("seen")
+	if err != nil {
+		return err
+	}
+
+	cm.Event("quote", p.quoteCallback, &seabird.HelpInfo{
+		Usage:       "[<id> | random [nick] | add <text> | search <text> | del <id>]",
+		Description: "Saves and shows quotes. With the history plugin, \"quote <nick>\" shows a random line they said.",
+	})
+	cm.Event("grab", p.grabCallback, &seabird.HelpInfo{
+		Usage:       "<nick>",
+		Description: "Saves the last thing someone said in this channel as a quote",
+	})
+
+	return nil
+}
+
+// quoteKey zero pads IDs so quotes are kept in order.
+func quoteKey(id string) string {
+	n, _ := strconv.ParseUint(id, 10, 64)
+	return fmt.Sprintf("%020d", n)
+}
+
+func (q *Quote) String() string {
+	return fmt.Sprintf("#%s: %s (added by %s on %s)", q.ID, q.Text, q.Submitter, formatDate(q.Time))
+}
+
+func (p *quotesPlugin) quoteCallback(b *seabird.Bot, m *irc.Message) {
+	split := strings.SplitN(strings.TrimSpace(m.Trailing()), " ", 2)
+
+	var arg string
+	if len(split) > 1 {
+		arg = strings.TrimSpace(split[1])
+	}
+
+	switch split[0] {
+	case "", "random":
+		p.randomQuote(b, m, arg)
+	case "add":
+		p.addQuote(b, m, arg)
+	case "search":
+		p.searchQuotes(b, m, arg)
+	case "del":
+		p.deleteQuote(b, m, arg)
+	default:
+		p.showQuote(b, m, split[0])
+	}
+}
+
+// storeQuote assigns the quote an ID and saves it.
+func (p *quotesPlugin) storeQuote(q *Quote) error {
+	return p.db.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("quotes")
+
+		id, err := bucket.NextID()
+		if err != nil {
+			return err
+		}
+		q.ID = id
+
+		return bucket.Put(quoteKey(q.ID), q)
+	})
+}
+
+func (p *quotesPlugin) addQuote(b *seabird.Bot, m *irc.Message, text string) {
+	if text == "" {
+		b.MentionReply(m, "Quote required")
+		return
+	}
+
+	q := &Quote{
+		Text:      text,
+		Submitter: m.Prefix.Name,
+		Time:      time.Now(),
+	}
+
+	if match := quoteNickRegex.FindStringSubmatch(text); match != nil {
+		q.Nick = match[1]
+	}
+
+	if _, channel, ok := b.ChannelTarget(m.Params[0]); ok {
+		q.Channel = channel
+	}
+
+	err := p.storeQuote(q)
+	if err != nil {
+		b.MentionReply(m, "Failed to store quote: %s", err)
+		return
+	}
+
+	b.MentionReply(m, "Added quote #%s", q.ID)
+}
+
+func (p *quotesPlugin) grabCallback(b *seabird.Bot, m *irc.Message) {
+	_, channel, ok := b.ChannelTarget(m.Params[0])
+	if !ok {
+		b.MentionReply(m, "Must be used in a channel")
+		return
+	}
+
+	nick := strings.TrimSpace(m.Trailing())
+	if nick == "" {
+		b.MentionReply(m, "Nick required")
+		return
+	}
+
+	if strings.EqualFold(nick, m.Prefix.Name) {
+		b.MentionReply(m, "You can't grab yourself")
+		return
+	}
+
+	seen := &LastSeen{}
+	err := p.lastSeen.View(func(tx storage.Tx) error {
+		return tx.Bucket("seen").Get(strings.ToLower(nick), seen)
+	})
+
+	// Only lines from this channel make sense to grab.
+	if err != nil || !strings.EqualFold(seen.Channel, channel) || (seen.Action != "said" && seen.Action != "action") {
+		b.MentionReply(m, "I don't know what %s last said here", nick)
+		return
+	}
+
+	text := "<" + seen.Nick + "> " + seen.Text
+	if seen.Action == "action" {
+		text = "* " + seen.Nick + " " + seen.Text
+	}
+
+	q := &Quote{
+		Text:      text,
+		Nick:      seen.Nick,
+		Submitter: m.Prefix.Name,
+		Channel:   channel,
+		Time:      time.Now(),
+	}
+
+	err = p.storeQuote(q)
+	if err != nil {
+		b.MentionReply(m, "Failed to store quote: %s", err)
+		return
+	}
+
+	b.MentionReply(m, "Grabbed quote #%s: %s", q.ID, q.Text)
+}
+
+// showQuote shows the quote with the given ID. The history plugin handles
+// "quote <nick>", so anything which isn't an ID is left to it when it's
+// loaded.
+func (p *quotesPlugin) showQuote(b *seabird.Bot, m *irc.Message, id string) {
+	id = strings.TrimPrefix(id, "#")
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		if !pluginLoaded(b, "history") {
+			b.MentionReply(m, "Invalid quote ID %q", id)
+		}
+		return
+	}
+
+	q := &Quote{}
+	err := p.db.View(func(tx storage.Tx) error {
+		return tx.Bucket("quotes").Get(quoteKey(id), q)
+	})
+	if err != nil {
+		b.MentionReply(m, "No quote #%s", id)
+		return
+	}
+
+	b.MentionReply(m, "%s", q)
+}
+
+// eachQuote calls fn for each quote, oldest first, until it returns false.
+func (p *quotesPlugin) eachQuote(fn func(q *Quote) bool) error {
+	return p.db.View(func(tx storage.Tx) error {
+		q := &Quote{}
+		return storage.ForEachPrefix(tx.Bucket("quotes"), "", q, func(string) bool {
+			return fn(q)
+		})
+	})
+}
+
+func (p *quotesPlugin) randomQuote(b *seabird.Bot, m *irc.Message, nick string) {
+	// Pick uniformly without holding every quote in memory.
+	var chosen Quote
+	count := 0
+	err := p.eachQuote(func(q *Quote) bool {
+		if nick != "" && !strings.EqualFold(q.Nick, nick) {
+			return true
+		}
+
+		count++
+		if rand.Intn(count) == 0 {
+			chosen = *q
+		}
+		return true
+	})
+	if err != nil {
+		b.MentionReply(m, "Failed to look up quotes: %s", err)
+		return
+	}
+
+	if count == 0 {
+		if nick != "" {
+			b.MentionReply(m, "No quotes from %s", nick)
+		} else {
+			b.MentionReply(m, "No quotes yet")
+		}
+		return
+	}
+
+	b.MentionReply(m, "%s", &chosen)
+}
+
+func (p *quotesPlugin) searchQuotes(b *seabird.Bot, m *irc.Message, text string) {
+	if text == "" {
+		b.MentionReply(m, "Search required")
+		return
+	}
+
+	text = strings.ToLower(text)
+
+	var first Quote
+	var ids []string
+	total := 0
+	err := p.eachQuote(func(q *Quote) bool {
+		if !strings.Contains(strings.ToLower(q.Text), text) {
+			return true
+		}
+
+		if total == 0 {
+			first = *q
+		}
+		if len(ids) < quoteSearchLimit {
+			ids = append(ids, "#"+q.ID)
+		}
+		total++
+		return true
+	})
+	if err != nil {
+		b.MentionReply(m, "Failed to search quotes: %s", err)
+		return
+	}
+
+	switch {
+	case total == 0:
+		b.MentionReply(m, "No matching quotes")
+	case total == 1:
+		b.MentionReply(m, "%s", &first)
+	case total > len(ids):
+		b.MentionReply(m, "%d matches: %s and %d more", total, strings.Join(ids, ", "), total-len(ids))
+	default:
+		b.MentionReply(m, "%d matches: %s", total, strings.Join(ids, ", "))
+	}
+}
+
+func (p *quotesPlugin) deleteQuote(b *seabird.Bot, m *irc.Message, id string) {
+	if !b.IsAdmin(m) {
+		b.MentionReply(m, "Permission denied")
+		return
+	}
+
+	id = strings.TrimPrefix(id, "#")
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		b.MentionReply(m, "Quote ID required")
+		return
+	}
+
+	err := p.db.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("quotes")
+
+		if err := bucket.Get(quoteKey(id), &Quote{}); err != nil {
+			return fmt.Errorf("No quote #%s", id)
+		}
+
+		return bucket.Delete(quoteKey(id))
+	})
+	if err != nil {
+		b.MentionReply(m, "%s", err)
+		return
+	}
+
+	b.MentionReply(m, "Deleted quote #%s", id)
+}
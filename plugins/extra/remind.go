@@ -1,14 +1,14 @@
 package extra
 
 import (
-	"errors"
-	"regexp"
+	"fmt"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/belak/go-seabird"
-	"github.com/belak/nut"
+	"github.com/belak/go-seabird/plugins"
+	"github.com/belak/go-seabird/storage"
 	"github.com/go-irc/irc"
 )
 
@@ -16,14 +16,43 @@ func init() {
 	seabird.RegisterPlugin("remind", newreminderPlugin)
 }
 
-var timeRegexp = regexp.MustCompile(`\d+[smhd]`)
+// reminderRetryDelay is how long to wait before trying a reminder which
+// couldn't be sent again.
+const reminderRetryDelay = 30 * time.Second
+
+type remindConfig struct {
+	// Timezone is used for absolute times when a user hasn't set their
+	// own. It defaults to the system timezone.
+	Timezone string
+
+	// MaxPending is the most reminders a user can have waiting. 0 means
+	// there is no limit.
+	MaxPending int
+
+	// JoinGrace is how long a channel reminder waits for the bot to be in
+	// the channel before it's sent to the author instead.
+	JoinGrace seabird.Duration
+
+	// LateThreshold is how overdue a reminder has to be before it comes
+	// with an apology, like after the bot was down for a while.
+	LateThreshold seabird.Duration
+}
 
 type reminderPlugin struct {
-	db *nut.DB
+	db       *storage.Namespace
+	tracker  *plugins.ChannelTracker
+	location *time.Location
+	config   remindConfig
 
 	roomLock *sync.Mutex
 	rooms    map[string]bool
 
+	// waiting is the lowercased nicks with reminders waiting for them to
+	// show up. It's rebuilt whenever the remind loop looks for the next
+	// reminder, so it's only ever a superset of what's in the db.
+	waitingLock *sync.Mutex
+	waiting     map[string]bool
+
 	// Singly buffered channel
 	updateChan chan struct{}
 }
@@ -33,6 +62,11 @@ type targetType int
 const (
 	channelTarget targetType = iota
 	privateTarget
+
+	// userTarget reminders are for someone other than the author. They are
+	// delivered in Channel if the user is there when they are due, otherwise
+	// when the user next speaks or joins.
+	userTarget
 )
 
 type reminder struct {
@@ -41,29 +75,77 @@ type reminder struct {
 	TargetType   targetType
 	Content      string
 	ReminderTime time.Time
+
+	// Author is the nick which created the reminder.
+	Author string
+
+	// Schedule is a cron expression or "@every <duration>" for recurring
+	// reminders. It is empty for reminders which only fire once. Location
+	// is the timezone the schedule is in.
+	Schedule string
+	Location string
+
+	// Channel is where a userTarget reminder was created. Waiting is set
+	// once it's due but the user hasn't been seen yet.
+	Channel string
+	Waiting bool
+
+	// Fired is when a one-time reminder was sent. It is only used for
+	// reminders kept around so they can be snoozed.
+	Fired time.Time
+}
+
+// reminderTimezone is a user's preferred timezone.
+type reminderTimezone struct {
+	Nick     string
+	Location string
 }
 
-func newreminderPlugin(m *seabird.BasicMux, cm *seabird.CommandMux, db *nut.DB) error {
+func newreminderPlugin(b *seabird.Bot, m *seabird.BasicMux, cm *seabird.CommandMux, store *storage.Store, tracker *plugins.ChannelTracker) error {
 	p := &reminderPlugin{
-		db:         db,
+		db:         store.Namespace("remind"),
+		tracker:    tracker,
+		location:   time.Local,
 		roomLock:   &sync.Mutex{},
 		rooms:      make(map[string]bool),
 		updateChan: make(chan struct{}, 1),
+
+		waitingLock: &sync.Mutex{},
+		waiting:     make(map[string]bool),
 	}
 
-	err := p.db.EnsureBucket("remind_reminders")
-	if err != nil {
-		return err
+	// The remind config section is optional.
+	p.config.MaxPending = 25
+	p.config.JoinGrace.Duration = 10 * time.Minute
+	p.config.LateThreshold.Duration = time.Minute
+	_ = b.Config("remind", &p.config)
+
+	if p.config.Timezone != "" {
+		loc, err := time.LoadLocation(p.config.Timezone)
+		if err != nil {
+			return err
+		}
+		p.location = loc
+	}
+
+	for _, name := range []string{"reminders", "timezones", "fired"} {
+		err := p.db.EnsureBucket(name)
+		if err != nil {
+			return err
+		}
 	}
 
 	m.Event("001", p.InitialDispatch)
 	m.Event("JOIN", p.joinHandler)
 	m.Event("PART", p.partHandler)
 	m.Event("KICK", p.kickHandler)
+	m.Event("JOIN", p.deliverHandler)
+	m.Event("PRIVMSG", p.deliverHandler)
+	m.Event("NICK", p.nickHandler)
 
 	cm.Event("remind", p.RemindCommand, &seabird.HelpInfo{
-		Usage:       "<duration> <message>",
-		Description: "Remind yourself to do something.",
+		Usage:       "[nick] <duration|at <time>|on <date> [time]|every <schedule>|cron <expr>> <message> | list | cancel <id> | snooze <id> <duration> | tz [zone]",
+		Description: "Remind yourself or someone else to do something, once or on a schedule. Times use your timezone, set with tz.",
 	})
 
 	return nil
@@ -78,7 +160,7 @@ func (p *reminderPlugin) joinHandler(b *seabird.Bot, m *irc.Message) {
 	defer p.roomLock.Unlock()
 	p.rooms[m.Params[0]] = true
 
-	p.updateChan <- struct{}{}
+	p.notify()
 }
 
 func (p *reminderPlugin) partHandler(b *seabird.Bot, m *irc.Message) {
@@ -90,7 +172,7 @@ func (p *reminderPlugin) partHandler(b *seabird.Bot, m *irc.Message) {
 	defer p.roomLock.Unlock()
 	delete(p.rooms, m.Params[0])
 
-	p.updateChan <- struct{}{}
+	p.notify()
 }
 
 func (p *reminderPlugin) kickHandler(b *seabird.Bot, m *irc.Message) {
@@ -102,52 +184,82 @@ func (p *reminderPlugin) kickHandler(b *seabird.Bot, m *irc.Message) {
 	defer p.roomLock.Unlock()
 	delete(p.rooms, m.Params[0])
 
-	p.updateChan <- struct{}{}
+	p.notify()
 }
 
-func (p *reminderPlugin) nextReminder() (*reminder, error) {
+// notify wakes up the remind loop so it can pick up changes. The channel is
+// buffered, so if a wake up is already pending there's nothing to do.
+func (p *reminderPlugin) notify() {
+	select {
+	case p.updateChan <- struct{}{}:
+	default:
+	}
+}
+
+// nextReminder returns the next reminder which needs to be handled along
+// with when that should happen.
+func (p *reminderPlugin) nextReminder(b *seabird.Bot) (*reminder, time.Time, error) {
 	// Find the next reminder we'll have to send
 	var r *reminder
+	var due time.Time
+	waiting := make(map[string]bool)
 
-	err := p.db.View(func(tx *nut.Tx) error {
+	err := p.db.View(func(tx storage.Tx) error {
 		// Grab the room lock for this transaction
 		p.roomLock.Lock()
 		defer p.roomLock.Unlock()
 
-		bucket := tx.Bucket("remind_reminders")
-		cursor := bucket.Cursor()
-
 		v := &reminder{}
-		for _, err := cursor.First(v); err == nil; _, err = cursor.Next(v) {
-			// If it's a channel target and we're not in the room,
-			// we need to skip it
-			if v.TargetType == channelTarget && !p.rooms[v.Target] {
-				continue
+		return tx.Bucket("reminders").ForEach(v, func(key string) error {
+			// Reminders waiting on a user to show up are handled
+			// elsewhere.
+			if v.Waiting {
+				waiting[strings.ToLower(v.Target)] = true
+				return nil
+			}
+
+			// If it's a channel target and we're not in the room, we
+			// give the bot a chance to join before falling back to
+			// the author.
+			vDue := v.ReminderTime
+			if v.TargetType == channelTarget {
+				if _, channel, _ := b.ChannelTarget(v.Target); !p.rooms[channel] {
+					vDue = vDue.Add(p.config.JoinGrace.Duration)
+				}
 			}
 
 			// If we don't currently have a reminder or the new
-			// reminder should be sent before our current one, we
+			// reminder should be handled before our current one, we
 			// update it.
-			if r == nil || v.ReminderTime.Before(r.ReminderTime) {
+			if r == nil || vDue.Before(due) {
 				// Make absolutely sure that we have a copy of the
-				// data because as soon as we call Next, it will go
-				// away.
+				// data because as soon as we move on to the next
+				// value, it will go away.
 				tmp := *v
 				r = &tmp
+				due = vDue
 			}
-		}
 
-		return nil
+			return nil
+		})
 	})
 
-	return r, err
+	if err == nil {
+		p.waitingLock.Lock()
+		p.waiting = waiting
+		p.waitingLock.Unlock()
+	}
+
+	return r, due, err
 }
 
-func (p *reminderPlugin) remindLoop(b *seabird.Bot) {
+// remindLoop sends reminders as they come due until the connection it was
+// started for ends.
+func (p *reminderPlugin) remindLoop(b *seabird.Bot, done <-chan struct{}) {
 	logger := b.GetLogger()
 
 	for {
-		r, err := p.nextReminder()
+		r, due, err := p.nextReminder(b)
 		if err != nil {
 			logger.WithError(err).Error("Transaction failure. Exiting loop.")
 			return
@@ -157,10 +269,15 @@ func (p *reminderPlugin) remindLoop(b *seabird.Bot) {
 		if r != nil {
 			logger.WithField("reminder", r).Debug("Next reminder")
 
-			waitDur := r.ReminderTime.Sub(time.Now())
+			waitDur := due.Sub(time.Now())
 			if waitDur <= 0 {
-				p.dispatch(b, r)
-				continue
+				if p.dispatch(b, r) {
+					continue
+				}
+
+				// If it couldn't be sent, the connection is most likely
+				// going away, so we wait for that or try again later.
+				waitDur = reminderRetryDelay
 			}
 
 			timer = time.After(waitDur)
@@ -168,101 +285,282 @@ func (p *reminderPlugin) remindLoop(b *seabird.Bot) {
 
 		select {
 		case <-timer:
-			p.dispatch(b, r)
+			continue
 		case <-p.updateChan:
 			continue
+		case <-done:
+			logger.Debug("Connection closed, stopping reminders")
+			return
+		}
+	}
+}
+
+// dispatch handles a reminder which is due. It returns false if the
+// reminder couldn't be handled and should be retried.
+func (p *reminderPlugin) dispatch(b *seabird.Bot, r *reminder) bool {
+	logger := b.GetLogger().WithField("reminder", r)
+
+	switch r.TargetType {
+	case userTarget:
+		// Reminders for other users only go out if they're around,
+		// otherwise they wait until the user shows up.
+		if p.userPresent(r.Target, r.Channel) {
+			return p.deliver(b, r, r.Channel, "")
+		}
+
+		r.Waiting = true
+
+		err := p.db.Update(func(tx storage.Tx) error {
+			return tx.Bucket("reminders").Put(r.Key, r)
+		})
+		if err != nil {
+			logger.WithError(err).Error("Failed to update reminder")
+			return false
+		}
+
+		logger.Debug("Reminder waiting for user")
+		return true
+	case channelTarget:
+		_, channel, _ := b.ChannelTarget(r.Target)
+
+		p.roomLock.Lock()
+		inRoom := p.rooms[channel]
+		p.roomLock.Unlock()
+
+		// If we still haven't made it into the channel, the author gets
+		// it instead so it isn't lost.
+		if !inRoom {
+			logger.Warn("Not in channel, sending reminder to author")
+			return p.deliver(b, r, r.Author, "I couldn't get into "+channel+" to remind you: ")
 		}
 	}
+
+	return p.deliver(b, r, r.Target, "")
 }
 
-func (p *reminderPlugin) dispatch(b *seabird.Bot, r *reminder) {
+// deliver sends a reminder to the given target and then reschedules or
+// removes it. The reminder is only considered delivered if we're connected
+// and the message could be written, otherwise it's left for next time.
+func (p *reminderPlugin) deliver(b *seabird.Bot, r *reminder, target, prefix string) bool {
 	logger := b.GetLogger().WithField("reminder", r)
 
+	if !b.Registered() {
+		logger.Debug("Not connected, holding reminder")
+		return false
+	}
+
+	// Reminders which were waiting on a user aren't late, the user just
+	// wasn't around.
+	text := prefix + r.Content
+	if late := time.Since(r.ReminderTime); late > p.config.LateThreshold.Duration && !r.Waiting {
+		text += " (sorry, this is " + formatRoughDuration(late) + " late)"
+	}
+
 	// Send the message
-	b.Send(&irc.Message{
+	err := b.Send(&irc.Message{
 		Prefix:  &irc.Prefix{},
 		Command: "PRIVMSG",
-		Params:  []string{r.Target, r.Content},
+		Params:  []string{target, text},
 	})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to send reminder")
+		return false
+	}
+
+	// Recurring reminders are moved to their next time and everything else
+	// is moved out of the way now that it's been sent, where it can still be
+	// snoozed for a while.
+	err = p.db.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("reminders")
 
-	// Nuke the reminder now that it's been sent
-	err := p.db.Update(func(tx *nut.Tx) error {
-		bucket := tx.Bucket("remind_reminders")
-		return bucket.Delete(r.Key)
+		if r.Schedule == "" {
+			err := bucket.Delete(r.Key)
+			if err != nil {
+				return err
+			}
+
+			fired := tx.Bucket("fired")
+			err = pruneFired(fired)
+			if err != nil {
+				return err
+			}
+
+			r.Waiting = false
+			r.Fired = time.Now()
+			return fired.Put(r.Key, r)
+		}
+
+		next, innerErr := p.nextTime(r)
+		if innerErr != nil {
+			// If the schedule is broken, there's nothing we can do but
+			// drop it.
+			logger.WithError(innerErr).Warn("Dropping reminder with invalid schedule")
+			return bucket.Delete(r.Key)
+		}
+
+		r.ReminderTime = next
+		r.Waiting = false
+		return bucket.Put(r.Key, r)
 	})
 
 	if err != nil {
-		logger.WithError(err).Error("Failed to remove reminder")
+		logger.WithError(err).Error("Failed to update reminder")
 	}
 
 	logger.Debug("Dispatched reminder")
+
+	return true
+}
+
+// nextTime returns when a recurring reminder should next fire. If the bot
+// was down for a while, missed occurrences are skipped rather than all being
+// sent at once.
+func (p *reminderPlugin) nextTime(r *reminder) (time.Time, error) {
+	loc, err := time.LoadLocation(r.Location)
+	if err != nil {
+		loc = p.location
+	}
+
+	after := r.ReminderTime
+	if now := time.Now(); now.After(after) {
+		after = now
+	}
+
+	return nextScheduled(r.Schedule, after, loc)
+}
+
+// userLocation returns the timezone a user has set, or the default.
+func (p *reminderPlugin) userLocation(nick string) *time.Location {
+	tz := &reminderTimezone{}
+
+	err := p.db.View(func(tx storage.Tx) error {
+		return tx.Bucket("timezones").Get(strings.ToLower(nick), tz)
+	})
+	if err != nil {
+		return p.location
+	}
+
+	loc, err := time.LoadLocation(tz.Location)
+	if err != nil {
+		return p.location
+	}
+
+	return loc
+}
+
+func (p *reminderPlugin) timezoneCommand(b *seabird.Bot, m *irc.Message, zone string) {
+	if zone == "" {
+		b.MentionReply(m, "Your timezone is %s", p.userLocation(m.Prefix.Name))
+		return
+	}
+
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		b.MentionReply(m, "Unknown timezone %q", zone)
+		return
+	}
+
+	err = p.db.Update(func(tx storage.Tx) error {
+		return tx.Bucket("timezones").Put(strings.ToLower(m.Prefix.Name), &reminderTimezone{
+			Nick:     m.Prefix.Name,
+			Location: loc.String(),
+		})
+	})
+	if err != nil {
+		b.MentionReply(m, "Failed to store timezone: %s", err)
+		return
+	}
+
+	b.MentionReply(m, "Timezone set to %s", loc)
 }
 
 // InitialDispatch is used to send private messages to users on connection. We
-// can't queue up the channels yet because we haven't joined them.
+// can't queue up the channels yet because we haven't joined them. The loop
+// only runs as long as this connection.
 func (p *reminderPlugin) InitialDispatch(b *seabird.Bot, m *irc.Message) {
-	go p.remindLoop(b)
+	go p.remindLoop(b, b.Done())
 }
 
 // ParseTime parses the text string and turns it into a time.Duration
 func (p *reminderPlugin) ParseTime(timeStr string) (time.Duration, error) {
-	var ret time.Duration
+	return parseDuration(timeStr)
+}
 
-	for _, match := range timeRegexp.FindAllString(timeStr, -1) {
-		switch match[len(match)-1] {
-		case 's', 'm', 'h':
-			tmp, err := time.ParseDuration(match)
-			if err != nil {
-				return ret, err
-			}
-			ret += tmp
-		case 'd':
-			// We can parse days as if they were hours then just
-			// multiply the result by 24. This will result in some
-			// loss of precision, but it should otherwise be fine.
-			tmp, err := time.ParseDuration(match[:len(match)-1] + "h")
-			if err != nil {
-				return ret, err
-			}
+func (p *reminderPlugin) RemindCommand(b *seabird.Bot, m *irc.Message) {
+	split := strings.SplitN(strings.TrimSpace(m.Trailing()), " ", 2)
 
-			ret += tmp * 24
-		default:
-			return ret, errors.New("Unknown time type")
-		}
+	var arg string
+	if len(split) > 1 {
+		arg = strings.TrimSpace(split[1])
 	}
 
-	return ret, nil
-}
-
-func (p *reminderPlugin) RemindCommand(b *seabird.Bot, m *irc.Message) {
-	split := strings.SplitN(m.Trailing(), " ", 2)
-	if len(split) != 2 {
-		b.MentionReply(m, "Not enough args")
+	switch split[0] {
+	case "tz":
+		p.timezoneCommand(b, m, arg)
+		return
+	case "list":
+		p.listCommand(b, m)
+		return
+	case "cancel":
+		p.cancelCommand(b, m, arg)
+		return
+	case "snooze":
+		p.snoozeCommand(b, m, arg)
 		return
 	}
 
-	dur, err := p.ParseTime(split[0])
+	loc := p.userLocation(m.Prefix.Name)
+
+	// If this isn't a valid reminder, try it as a reminder for someone else.
+	var forNick string
+	spec, err := parseReminderSpec(m.Trailing(), time.Now(), loc)
+	if err != nil && arg != "" {
+		var nickErr error
+		spec, nickErr = parseReminderSpec(arg, time.Now(), loc)
+		if nickErr == nil {
+			forNick = split[0]
+			err = nil
+		}
+	}
 	if err != nil {
-		b.MentionReply(m, "Invalid duration: %s", err)
+		b.MentionReply(m, "%s", err)
 		return
 	}
 
 	r := &reminder{
 		Target:       m.Prefix.Name,
 		TargetType:   privateTarget,
-		Content:      split[1],
-		ReminderTime: time.Now().Add(dur),
+		Content:      spec.Content,
+		ReminderTime: spec.Time,
+		Author:       m.Prefix.Name,
+		Schedule:     spec.Schedule,
+		Location:     loc.String(),
 	}
 
-	if b.FromChannel(m) {
+	if forNick != "" && !strings.EqualFold(forNick, m.Prefix.Name) {
+		_, channel, ok := b.ChannelTarget(m.Params[0])
+		if !ok {
+			b.MentionReply(m, "Reminders for other users must be set in a channel")
+			return
+		}
+
+		r.Target = forNick
+		r.TargetType = userTarget
+		r.Channel = channel
+		r.Content = forNick + ": " + m.Prefix.Name + " asked me to remind you: " + r.Content
+	} else if b.FromChannel(m) {
 		// If it was from a channel, we need to prepend the user's name.
 		r.Target = m.Params[0]
 		r.TargetType = channelTarget
 		r.Content = m.Prefix.Name + ": " + r.Content
 	}
 
-	err = p.db.Update(func(tx *nut.Tx) error {
-		bucket := tx.Bucket("remind_reminders")
+	err = p.db.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("reminders")
+
+		if p.config.MaxPending > 0 && len(p.remindersFor(bucket, m.Prefix.Name)) >= p.config.MaxPending {
+			return fmt.Errorf("You already have %d reminders", p.config.MaxPending)
+		}
 
 		key, innerErr := bucket.NextID()
 		if innerErr != nil {
@@ -279,10 +577,14 @@ func (p *reminderPlugin) RemindCommand(b *seabird.Bot, m *irc.Message) {
 		return
 	}
 
-	b.MentionReply(m, "Event stored")
+	if r.Schedule != "" {
+		b.MentionReply(m, "Event #%s stored, first reminder at %s", r.Key, r.ReminderTime.In(loc).Format(reminderTimeFormat))
+	} else {
+		b.MentionReply(m, "Event #%s stored for %s", r.Key, r.ReminderTime.In(loc).Format(reminderTimeFormat))
+	}
 
 	logger := b.GetLogger()
 	logger.WithField("reminder", r).Debug("Stored reminder")
 
-	p.updateChan <- struct{}{}
+	p.notify()
 }
@@ -0,0 +1,332 @@
+package extra
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/storage"
+	"github.com/go-irc/irc"
+)
+
+const reminderTimeFormat = "2006-01-02 15:04 MST"
+
+// reminderSnoozeWindow is how long a one-time reminder can still be snoozed
+// after it was sent.
+const reminderSnoozeWindow = time.Hour
+
+// remindersFor returns all the pending reminders created by the given nick,
+// oldest first.
+func (p *reminderPlugin) remindersFor(bucket storage.Bucket, nick string) []reminder {
+	var ret []reminder
+
+	v := &reminder{}
+	_ = bucket.ForEach(v, func(key string) error {
+		if strings.EqualFold(v.Author, nick) {
+			ret = append(ret, *v)
+		}
+		return nil
+	})
+
+	return ret
+}
+
+// userPresent returns true if the nick is currently in the given channel.
+func (p *reminderPlugin) userPresent(nick, channel string) bool {
+	if p.tracker == nil {
+		return false
+	}
+
+	user := p.tracker.LookupUser(nick)
+	return user != nil && user.InChannel(channel)
+}
+
+// deliverHandler sends any reminders which were waiting for the sender to
+// show up. They go wherever the user spoke or joined.
+func (p *reminderPlugin) deliverHandler(b *seabird.Bot, m *irc.Message) {
+	if m.Prefix == nil || len(m.Params) < 1 || m.Prefix.Name == b.CurrentNick() {
+		return
+	}
+
+	// Most messages are from people with nothing waiting, so there's no
+	// need to go to the db for them.
+	p.waitingLock.Lock()
+	hasWaiting := p.waiting[strings.ToLower(m.Prefix.Name)]
+	p.waitingLock.Unlock()
+	if !hasWaiting {
+		return
+	}
+
+	var waiting []reminder
+	err := p.db.View(func(tx storage.Tx) error {
+		v := &reminder{}
+		return tx.Bucket("reminders").ForEach(v, func(key string) error {
+			if v.Waiting && v.TargetType == userTarget && strings.EqualFold(v.Target, m.Prefix.Name) {
+				waiting = append(waiting, *v)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		b.GetLogger().WithError(err).Error("Failed to look up waiting reminders")
+		return
+	}
+
+	target := m.Prefix.Name
+	if m.Command == "JOIN" || b.FromChannel(m) {
+		target = m.Params[0]
+	}
+
+	for i := range waiting {
+		p.deliver(b, &waiting[i], target, "")
+	}
+
+	// Let the remind loop rebuild the waiting set now these are gone.
+	p.notify()
+}
+
+// nickHandler keeps reminders for other users pointed at them when they
+// change nicks.
+func (p *reminderPlugin) nickHandler(b *seabird.Bot, m *irc.Message) {
+	if m.Prefix == nil || len(m.Params) < 1 {
+		return
+	}
+
+	oldNick := m.Prefix.Name
+	newNick := m.Params[0]
+
+	err := p.db.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("reminders")
+
+		var renamed []reminder
+		v := &reminder{}
+		err := bucket.ForEach(v, func(key string) error {
+			if v.TargetType == userTarget && strings.EqualFold(v.Target, oldNick) {
+				renamed = append(renamed, *v)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, r := range renamed {
+			r.Target = newNick
+			if err = bucket.Put(r.Key, &r); err != nil {
+				return err
+			}
+
+			if r.Waiting {
+				p.waitingLock.Lock()
+				p.waiting[strings.ToLower(newNick)] = true
+				p.waitingLock.Unlock()
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		b.GetLogger().WithError(err).WithFields(logrus.Fields{
+			"old": oldNick,
+			"new": newNick,
+		}).Warn("Failed to follow nick change")
+	}
+
+	// Clean up the waiting set now the old nick has nothing left.
+	p.notify()
+}
+
+func (p *reminderPlugin) listCommand(b *seabird.Bot, m *irc.Message) {
+	var pending []reminder
+	err := p.db.View(func(tx storage.Tx) error {
+		pending = p.remindersFor(tx.Bucket("reminders"), m.Prefix.Name)
+		return nil
+	})
+	if err != nil {
+		b.MentionReply(m, "Failed to look up reminders: %s", err)
+		return
+	}
+
+	if len(pending) == 0 {
+		b.MentionReply(m, "You have no pending reminders")
+		return
+	}
+
+	// The list can be long and may contain private reminders, so it always
+	// goes to the user directly.
+	loc := p.userLocation(m.Prefix.Name)
+	for _, r := range pending {
+		line := fmt.Sprintf("#%s %s: %s", r.Key, r.ReminderTime.In(loc).Format(reminderTimeFormat), r.Content)
+		if r.Schedule != "" {
+			line += " (" + r.Schedule + ")"
+		}
+		if r.Waiting {
+			line += " (waiting for " + r.Target + ")"
+		}
+
+		b.PrivateReply(m, "%s", line)
+	}
+}
+
+// checkReminderOwner returns an error if the sender of m isn't allowed to
+// change the reminder.
+func checkReminderOwner(b *seabird.Bot, m *irc.Message, r *reminder) error {
+	if strings.EqualFold(r.Author, m.Prefix.Name) || b.IsAdmin(m) {
+		return nil
+	}
+
+	return fmt.Errorf("Reminder #%s belongs to %s", r.Key, r.Author)
+}
+
+func (p *reminderPlugin) cancelCommand(b *seabird.Bot, m *irc.Message, id string) {
+	id = strings.TrimPrefix(id, "#")
+	if id == "" {
+		b.MentionReply(m, "Reminder ID required")
+		return
+	}
+
+	err := p.db.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("reminders")
+
+		r := &reminder{}
+		if err := bucket.Get(id, r); err != nil {
+			return fmt.Errorf("No reminder #%s", id)
+		}
+
+		if err := checkReminderOwner(b, m, r); err != nil {
+			return err
+		}
+
+		return bucket.Delete(id)
+	})
+	if err != nil {
+		b.MentionReply(m, "%s", err)
+		return
+	}
+
+	b.MentionReply(m, "Cancelled reminder #%s", id)
+
+	p.notify()
+}
+
+// snoozeCommand pushes back a pending reminder, or brings back a one-time
+// reminder which was sent recently. If no ID is given, the user's most
+// recently sent reminder is used.
+func (p *reminderPlugin) snoozeCommand(b *seabird.Bot, m *irc.Message, arg string) {
+	args := strings.Fields(arg)
+	if len(args) == 0 || len(args) > 2 {
+		b.MentionReply(m, "Usage: snooze [id] <duration>")
+		return
+	}
+
+	var id string
+	if len(args) == 2 {
+		id = strings.TrimPrefix(args[0], "#")
+	}
+
+	durStr := args[len(args)-1]
+	if !durationRegexp.MatchString(durStr) {
+		b.MentionReply(m, "Invalid duration %q", durStr)
+		return
+	}
+
+	dur, err := parseDuration(durStr)
+	if err != nil {
+		b.MentionReply(m, "%s", err)
+		return
+	}
+
+	r := &reminder{}
+	err = p.db.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket("reminders")
+		fired := tx.Bucket("fired")
+
+		if id == "" {
+			found := p.lastFired(fired, m.Prefix.Name)
+			if found == nil {
+				return errors.New("You have no recent reminders to snooze")
+			}
+			r = found
+		} else if err := bucket.Get(id, r); err == nil {
+			if err = checkReminderOwner(b, m, r); err != nil {
+				return err
+			}
+
+			r.ReminderTime = r.ReminderTime.Add(dur)
+			return bucket.Put(r.Key, r)
+		} else if err = fired.Get(id, r); err != nil || time.Since(r.Fired) > reminderSnoozeWindow {
+			return fmt.Errorf("No reminder #%s", id)
+		}
+
+		if err := checkReminderOwner(b, m, r); err != nil {
+			return err
+		}
+
+		if err := fired.Delete(r.Key); err != nil {
+			return err
+		}
+
+		r.ReminderTime = time.Now().Add(dur)
+		r.Fired = time.Time{}
+
+		return bucket.Put(r.Key, r)
+	})
+	if err != nil {
+		b.MentionReply(m, "%s", err)
+		return
+	}
+
+	b.MentionReply(m, "Reminder #%s snoozed until %s", r.Key, r.ReminderTime.In(p.userLocation(m.Prefix.Name)).Format(reminderTimeFormat))
+
+	p.notify()
+}
+
+// lastFired returns the most recently sent reminder by the given author which
+// can still be snoozed.
+func (p *reminderPlugin) lastFired(bucket storage.Bucket, nick string) *reminder {
+	var ret *reminder
+
+	v := &reminder{}
+	_ = bucket.ForEach(v, func(key string) error {
+		if !strings.EqualFold(v.Author, nick) || time.Since(v.Fired) > reminderSnoozeWindow {
+			return nil
+		}
+
+		if ret == nil || v.Fired.After(ret.Fired) {
+			tmp := *v
+			ret = &tmp
+		}
+
+		return nil
+	})
+
+	return ret
+}
+
+// pruneFired removes sent reminders which are too old to be snoozed.
+func pruneFired(bucket storage.Bucket) error {
+	var expired []string
+
+	v := &reminder{}
+	err := bucket.ForEach(v, func(key string) error {
+		if time.Since(v.Fired) > reminderSnoozeWindow {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range expired {
+		if err = bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,409 @@
+package extra
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// everyPrefix marks a schedule which repeats on a fixed interval rather than
+// a cron expression, the same as most cron libraries.
+const everyPrefix = "@every "
+
+var (
+	clockTimeRegexp = regexp.MustCompile(`^(\d{1,2})(?::(\d{2}))?(am|pm)?$`)
+
+	weekdayNames = map[string]string{
+		"sunday": "0", "sun": "0",
+		"monday": "1", "mon": "1",
+		"tuesday": "2", "tue": "2", "tues": "2",
+		"wednesday": "3", "wed": "3",
+		"thursday": "4", "thu": "4", "thurs": "4",
+		"friday": "5", "fri": "5",
+		"saturday": "6", "sat": "6",
+		"day":     "*",
+		"weekday": "1-5", "weekdays": "1-5",
+		"weekend": "0,6", "weekends": "0,6",
+	}
+)
+
+// reminderSpec is the parsed form of the time part of a remind command.
+type reminderSpec struct {
+	Time     time.Time
+	Schedule string
+	Content  string
+}
+
+// parseReminderSpec parses the start of a remind command and returns when
+// the reminder should first fire, the recurring schedule if there is one, and
+// the rest of the text. The following forms are supported:
+//
+// - 1h30m <message>
+// - at 14:30 <message>
+// - on 2026-11-02 [at] 9am <message>
+// - every 2h <message>
+// - every [day|weekday|weekend|monday|...] at 9:00 <message>
+// - cron <min> <hour> <dom> <month> <dow> <message>
+func parseReminderSpec(text string, now time.Time, loc *time.Location) (*reminderSpec, error) {
+	words := strings.Fields(text)
+	if len(words) < 2 {
+		return nil, errors.New("Not enough args")
+	}
+
+	now = now.In(loc)
+	ret := &reminderSpec{}
+
+	var rest []string
+	switch strings.ToLower(words[0]) {
+	case "at":
+		hour, min, err := parseClockTime(words[1])
+		if err != nil {
+			return nil, err
+		}
+
+		ret.Time = time.Date(now.Year(), now.Month(), now.Day(), hour, min, 0, 0, loc)
+		if !ret.Time.After(now) {
+			ret.Time = ret.Time.AddDate(0, 0, 1)
+		}
+
+		rest = words[2:]
+	case "on":
+		date, err := time.ParseInLocation("2006-01-02", words[1], loc)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid date %q, expected YYYY-MM-DD", words[1])
+		}
+
+		rest = words[2:]
+		if len(rest) > 0 && strings.ToLower(rest[0]) == "at" {
+			rest = rest[1:]
+		}
+
+		// If there's no time, default to the morning.
+		hour, min := 9, 0
+		if len(rest) > 0 {
+			if h, m, clockErr := parseClockTime(rest[0]); clockErr == nil {
+				hour, min = h, m
+				rest = rest[1:]
+			}
+		}
+
+		ret.Time = time.Date(date.Year(), date.Month(), date.Day(), hour, min, 0, 0, loc)
+		if !ret.Time.After(now) {
+			return nil, errors.New("That time has already passed")
+		}
+	case "every":
+		schedule, remaining, err := parseEvery(words[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		ret.Schedule = schedule
+		rest = remaining
+	case "cron":
+		if len(words) < 6 {
+			return nil, errors.New("Cron schedules need 5 fields")
+		}
+
+		ret.Schedule = strings.Join(words[1:6], " ")
+		rest = words[6:]
+	default:
+		if !durationRegexp.MatchString(words[0]) {
+			return nil, fmt.Errorf("Unknown time %q", words[0])
+		}
+
+		dur, err := parseDuration(words[0])
+		if err != nil {
+			return nil, err
+		}
+
+		ret.Time = now.Add(dur)
+		rest = words[1:]
+	}
+
+	if ret.Schedule != "" {
+		next, err := nextScheduled(ret.Schedule, now, loc)
+		if err != nil {
+			return nil, err
+		}
+		ret.Time = next
+	}
+
+	ret.Content = strings.Join(rest, " ")
+	if ret.Content == "" {
+		return nil, errors.New("No message given")
+	}
+
+	return ret, nil
+}
+
+// parseEvery turns the words after "every" into a schedule.
+func parseEvery(words []string) (string, []string, error) {
+	if durationRegexp.MatchString(words[0]) {
+		dur, err := parseDuration(words[0])
+		if err != nil {
+			return "", nil, err
+		}
+
+		if dur < time.Minute {
+			return "", nil, errors.New("Reminders can't repeat more than once a minute")
+		}
+
+		return everyPrefix + dur.String(), words[1:], nil
+	}
+
+	switch strings.ToLower(words[0]) {
+	case "hour":
+		return everyPrefix + time.Hour.String(), words[1:], nil
+	case "minute":
+		return everyPrefix + time.Minute.String(), words[1:], nil
+	}
+
+	dow, ok := weekdayNames[strings.ToLower(words[0])]
+	if !ok {
+		return "", nil, fmt.Errorf("Unknown schedule %q", words[0])
+	}
+
+	if len(words) < 3 || strings.ToLower(words[1]) != "at" {
+		return "", nil, errors.New("Expected a time, like \"every day at 9:00\"")
+	}
+
+	hour, min, err := parseClockTime(words[2])
+	if err != nil {
+		return "", nil, err
+	}
+
+	return fmt.Sprintf("%d %d * * %s", min, hour, dow), words[3:], nil
+}
+
+// parseClockTime parses times like "14:30", "9am" and "9:15pm".
+func parseClockTime(text string) (int, int, error) {
+	match := clockTimeRegexp.FindStringSubmatch(strings.ToLower(text))
+	if match == nil {
+		return 0, 0, fmt.Errorf("Invalid time %q", text)
+	}
+
+	hour, _ := strconv.Atoi(match[1])
+	min := 0
+	if match[2] != "" {
+		min, _ = strconv.Atoi(match[2])
+	}
+
+	if match[3] != "" && (hour < 1 || hour > 12) {
+		return 0, 0, fmt.Errorf("Invalid time %q", text)
+	}
+
+	switch match[3] {
+	case "am":
+		if hour == 12 {
+			hour = 0
+		}
+	case "pm":
+		if hour != 12 {
+			hour += 12
+		}
+	}
+
+	if hour > 23 || min > 59 {
+		return 0, 0, fmt.Errorf("Invalid time %q", text)
+	}
+
+	return hour, min, nil
+}
+
+// nextScheduled returns the next time after the given time that a schedule
+// should fire.
+func nextScheduled(schedule string, after time.Time, loc *time.Location) (time.Time, error) {
+	if strings.HasPrefix(schedule, everyPrefix) {
+		dur, err := time.ParseDuration(strings.TrimPrefix(schedule, everyPrefix))
+		if err != nil {
+			return time.Time{}, err
+		}
+		if dur <= 0 {
+			return time.Time{}, errors.New("Invalid interval")
+		}
+		return after.Add(dur), nil
+	}
+
+	c, err := parseCron(schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return c.next(after.In(loc))
+}
+
+// cronSchedule is a standard 5 field cron expression. Each field is a set of
+// allowed values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+
+	// If both day fields are restricted, either one matching is enough,
+	// like in most cron implementations.
+	domStar, dowStar bool
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("Cron schedules need 5 fields")
+	}
+
+	ret := &cronSchedule{
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+
+	var err error
+	ranges := []struct {
+		dest     *map[int]bool
+		min, max int
+	}{
+		{&ret.minute, 0, 59},
+		{&ret.hour, 0, 23},
+		{&ret.dom, 1, 31},
+		{&ret.month, 1, 12},
+		{&ret.dow, 0, 7},
+	}
+
+	for i, r := range ranges {
+		*r.dest, err = parseCronField(fields[i], r.min, r.max)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cron field %q: %s", fields[i], err)
+		}
+	}
+
+	// Both 0 and 7 mean Sunday.
+	if ret.dow[7] {
+		ret.dow[0] = true
+	}
+
+	return ret, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps,
+// like "1,5-10,*/15".
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	ret := make(map[int]bool)
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx != -1 {
+			var err error
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step < 1 {
+				return nil, errors.New("invalid step")
+			}
+			part = part[:idx]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, errors.New("invalid value")
+			}
+
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, errors.New("invalid value")
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return nil, errors.New("value out of range")
+		}
+
+		for i := lo; i <= hi; i += step {
+			ret[i] = true
+		}
+	}
+
+	return ret, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom[t.Day()]
+	dow := c.dow[int(t.Weekday())]
+
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+// wallClock returns the local date and time of t with the zone stripped, so
+// times can be compared the way they'd read on a clock.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+// next finds the first minute after t which matches the schedule. Rather
+// than checking every minute, it skips ahead by the largest unit which
+// doesn't match.
+//
+// Like most cron implementations, times which are skipped when the clocks go
+// forward don't fire that day, and schedules with a fixed hour only fire
+// once when the clocks go back.
+func (c *cronSchedule) next(t time.Time) (time.Time, error) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	start := wallClock(t)
+	everyHour := len(c.hour) == 24
+
+	// Give up after a few years so impossible schedules like Feb 31st
+	// don't loop forever.
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if !c.month[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !c.dayMatches(t) {
+			// Midnight may not exist when the clocks go forward, in which
+			// case time.Date can hand back a time before t.
+			next := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			if !next.After(t) {
+				next = t.Add(time.Hour)
+			}
+			t = next
+			continue
+		}
+
+		if !c.hour[t.Hour()] {
+			// Step forward in real time rather than with time.Date so
+			// hours skipped by the clocks going forward can't send us
+			// backwards.
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+
+		if !c.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		// If the clocks went back, this hour is a repeat of one we've
+		// already been through.
+		if !everyHour && wallClock(t).Before(start) {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t, nil
+	}
+
+	return time.Time{}, errors.New("Schedule never matches")
+}
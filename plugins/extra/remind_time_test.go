@@ -0,0 +1,302 @@
+package extra
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClockTime(t *testing.T) {
+	var tests = []struct {
+		Input      string
+		Hour, Min  int
+		ShouldFail bool
+	}{
+		{Input: "14:30", Hour: 14, Min: 30},
+		{Input: "0:05", Hour: 0, Min: 5},
+		{Input: "9am", Hour: 9},
+		{Input: "9:15pm", Hour: 21, Min: 15},
+		{Input: "12am", Hour: 0},
+		{Input: "12:30am", Hour: 0, Min: 30},
+		{Input: "12pm", Hour: 12},
+		{Input: "12:45PM", Hour: 12, Min: 45},
+		{Input: "0am", ShouldFail: true},
+		{Input: "13pm", ShouldFail: true},
+		{Input: "24:00", ShouldFail: true},
+		{Input: "12:60", ShouldFail: true},
+		{Input: "noon", ShouldFail: true},
+	}
+
+	for _, test := range tests {
+		hour, min, err := parseClockTime(test.Input)
+		if test.ShouldFail {
+			assert.Error(t, err, test.Input)
+			continue
+		}
+
+		if assert.NoError(t, err, test.Input) {
+			assert.Equal(t, test.Hour, hour, test.Input)
+			assert.Equal(t, test.Min, min, test.Input)
+		}
+	}
+}
+
+func TestParseReminderSpec(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	// This is a Monday.
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		Input      string
+		Loc        *time.Location
+		Time       time.Time
+		Schedule   string
+		Content    string
+		ShouldFail bool
+	}{
+		{Input: "1h30m stretch", Time: now.Add(90 * time.Minute), Content: "stretch"},
+		{Input: "2d check the build", Time: now.Add(48 * time.Hour), Content: "check the build"},
+		{Input: "at 14:30 lunch", Time: time.Date(2026, 10, 19, 14, 30, 0, 0, time.UTC), Content: "lunch"},
+
+		// Times which already passed today are tomorrow.
+		{Input: "at 9am standup", Time: time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC), Content: "standup"},
+		{Input: "at 10:00 now", Time: time.Date(2026, 10, 20, 10, 0, 0, 0, time.UTC), Content: "now"},
+		{Input: "at 12am midnight", Time: time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC), Content: "midnight"},
+		{Input: "at 12pm noon", Time: time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC), Content: "noon"},
+
+		// Times are in the user's timezone.
+		{Input: "at 9am standup", Loc: newYork, Time: time.Date(2026, 10, 19, 9, 0, 0, 0, newYork), Content: "standup"},
+
+		{Input: "on 2026-11-02 at 9:15pm vote", Time: time.Date(2026, 11, 2, 21, 15, 0, 0, time.UTC), Content: "vote"},
+		{Input: "on 2026-11-02 9:15pm vote", Time: time.Date(2026, 11, 2, 21, 15, 0, 0, time.UTC), Content: "vote"},
+		{Input: "on 2026-11-02 vote", Time: time.Date(2026, 11, 2, 9, 0, 0, 0, time.UTC), Content: "vote"},
+		{Input: "on 2026-10-01 too late", ShouldFail: true},
+		{Input: "on 2026-10-19 9am too late", ShouldFail: true},
+		{Input: "on 11/02/2026 vote", ShouldFail: true},
+
+		{Input: "every 2h drink water", Time: now.Add(2 * time.Hour), Schedule: "@every 2h0m0s", Content: "drink water"},
+		{Input: "every hour stretch", Time: now.Add(time.Hour), Schedule: "@every 1h0m0s", Content: "stretch"},
+		{Input: "every 30s spam", ShouldFail: true},
+		{Input: "every weekday at 9am standup", Time: time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC), Schedule: "0 9 * * 1-5", Content: "standup"},
+		{Input: "every friday at 5pm beer", Time: time.Date(2026, 10, 23, 17, 0, 0, 0, time.UTC), Schedule: "0 17 * * 5", Content: "beer"},
+		{Input: "every day 9am standup", ShouldFail: true},
+		{Input: "every blursday at 9am standup", ShouldFail: true},
+
+		{Input: "cron 0 12 * * 0 weekly", Time: time.Date(2026, 10, 25, 12, 0, 0, 0, time.UTC), Schedule: "0 12 * * 0", Content: "weekly"},
+		{Input: "cron 0 12 * * weekly", ShouldFail: true},
+		{Input: "cron 0 25 * * * never", ShouldFail: true},
+
+		{Input: "soon something", ShouldFail: true},
+		{Input: "1h", ShouldFail: true},
+		{Input: "at 9am", ShouldFail: true},
+	}
+
+	for _, test := range tests {
+		loc := test.Loc
+		if loc == nil {
+			loc = time.UTC
+		}
+
+		spec, err := parseReminderSpec(test.Input, now, loc)
+		if test.ShouldFail {
+			assert.Error(t, err, test.Input)
+			continue
+		}
+
+		if assert.NoError(t, err, test.Input) {
+			assert.True(t, test.Time.Equal(spec.Time), "%s: expected %s, got %s", test.Input, test.Time, spec.Time)
+			assert.Equal(t, test.Schedule, spec.Schedule, test.Input)
+			assert.Equal(t, test.Content, spec.Content, test.Input)
+		}
+	}
+}
+
+func TestParseCronField(t *testing.T) {
+	var tests = []struct {
+		Input      string
+		Min, Max   int
+		Expected   []int
+		ShouldFail bool
+	}{
+		{Input: "5", Min: 0, Max: 59, Expected: []int{5}},
+		{Input: "1,5-7", Min: 0, Max: 59, Expected: []int{1, 5, 6, 7}},
+		{Input: "*/15", Min: 0, Max: 59, Expected: []int{0, 15, 30, 45}},
+		{Input: "10/20", Min: 0, Max: 59, Expected: []int{10, 30, 50}},
+		{Input: "5-10/2", Min: 0, Max: 59, Expected: []int{5, 7, 9}},
+		{Input: "*/5", Min: 1, Max: 12, Expected: []int{1, 6, 11}},
+		{Input: "60", Min: 0, Max: 59, ShouldFail: true},
+		{Input: "0", Min: 1, Max: 31, ShouldFail: true},
+		{Input: "5-1", Min: 0, Max: 59, ShouldFail: true},
+		{Input: "*/0", Min: 0, Max: 59, ShouldFail: true},
+		{Input: "1-", Min: 0, Max: 59, ShouldFail: true},
+		{Input: "mon", Min: 0, Max: 7, ShouldFail: true},
+	}
+
+	for _, test := range tests {
+		field, err := parseCronField(test.Input, test.Min, test.Max)
+		if test.ShouldFail {
+			assert.Error(t, err, test.Input)
+			continue
+		}
+
+		expected := make(map[int]bool)
+		for _, v := range test.Expected {
+			expected[v] = true
+		}
+
+		if assert.NoError(t, err, test.Input) {
+			assert.Equal(t, expected, field, test.Input)
+		}
+	}
+
+	field, err := parseCronField("*", 0, 59)
+	assert.NoError(t, err)
+	assert.Len(t, field, 60)
+
+	_, err = parseCron("0 0 * *")
+	assert.Error(t, err)
+}
+
+func TestCronNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	var tests = []struct {
+		Name     string
+		Schedule string
+		Loc      *time.Location
+		After    time.Time
+		Expected time.Time
+	}{
+		{
+			Name:     "ranges and steps",
+			Schedule: "*/20 9-10 * * *",
+			After:    time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC),
+			Expected: time.Date(2026, 10, 19, 10, 20, 0, 0, time.UTC),
+		},
+		{
+			Name:     "ranges and steps roll over",
+			Schedule: "*/20 9-10 * * *",
+			After:    time.Date(2026, 10, 19, 10, 40, 0, 0, time.UTC),
+			Expected: time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:     "seconds are ignored",
+			Schedule: "* * * * *",
+			After:    time.Date(2026, 10, 19, 10, 0, 30, 0, time.UTC),
+			Expected: time.Date(2026, 10, 19, 10, 1, 0, 0, time.UTC),
+		},
+		{
+			Name:     "day of month",
+			Schedule: "0 0 1 * *",
+			After:    time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC),
+			Expected: time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:     "either day field matches",
+			Schedule: "0 12 21 * 5",
+			After:    time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC),
+			Expected: time.Date(2026, 10, 21, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:     "either day field matches after the day of month",
+			Schedule: "0 12 21 * 5",
+			After:    time.Date(2026, 10, 21, 12, 0, 0, 0, time.UTC),
+			Expected: time.Date(2026, 10, 23, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:     "both day fields when one is a star",
+			Schedule: "0 12 * 10 5",
+			After:    time.Date(2026, 10, 24, 0, 0, 0, 0, time.UTC),
+			Expected: time.Date(2026, 10, 30, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:     "7 is sunday",
+			Schedule: "0 0 * * 7",
+			After:    time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC),
+			Expected: time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:     "leap day",
+			Schedule: "0 0 29 2 *",
+			After:    time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC),
+			Expected: time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:     "same time across spring forward",
+			Loc:      newYork,
+			Schedule: "0 12 * * *",
+			After:    time.Date(2026, 3, 7, 12, 0, 0, 0, newYork),
+			Expected: time.Date(2026, 3, 8, 12, 0, 0, 0, newYork),
+		},
+		{
+			Name:     "skipped by spring forward",
+			Loc:      newYork,
+			Schedule: "30 2 * * *",
+			After:    time.Date(2026, 3, 7, 12, 0, 0, 0, newYork),
+			Expected: time.Date(2026, 3, 9, 2, 30, 0, 0, newYork),
+		},
+		{
+			Name:     "first time through fall back",
+			Loc:      newYork,
+			Schedule: "30 1 * * *",
+			After:    time.Date(2026, 11, 1, 0, 0, 0, 0, newYork),
+			Expected: time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC),
+		},
+		{
+			Name:     "not repeated by fall back",
+			Loc:      newYork,
+			Schedule: "30 1 * * *",
+			After:    time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC),
+			Expected: time.Date(2026, 11, 2, 1, 30, 0, 0, newYork),
+		},
+		{
+			Name:     "every hour continues through fall back",
+			Loc:      newYork,
+			Schedule: "*/30 * * * *",
+			After:    time.Date(2026, 11, 1, 5, 45, 0, 0, time.UTC),
+			Expected: time.Date(2026, 11, 1, 6, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, test := range tests {
+		c, err := parseCron(test.Schedule)
+		if !assert.NoError(t, err, test.Name) {
+			continue
+		}
+
+		loc := test.Loc
+		if loc == nil {
+			loc = time.UTC
+		}
+
+		next, err := c.next(test.After.In(loc))
+		if assert.NoError(t, err, test.Name) {
+			assert.True(t, test.Expected.Equal(next), "%s: expected %s, got %s", test.Name, test.Expected, next)
+		}
+	}
+
+	// Schedules which can never match shouldn't loop forever.
+	c, err := parseCron("0 0 31 2 *")
+	require.NoError(t, err)
+	_, err = c.next(time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC))
+	assert.Error(t, err)
+}
+
+func TestNextScheduled(t *testing.T) {
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	next, err := nextScheduled("@every 1h30m0s", now, time.UTC)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(90*time.Minute), next)
+
+	_, err = nextScheduled("@every 0s", now, time.UTC)
+	assert.Error(t, err)
+
+	_, err = nextScheduled("0 0 * *", now, time.UTC)
+	assert.Error(t, err)
+}
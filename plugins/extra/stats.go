@@ -0,0 +1,293 @@
+package extra
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/storage"
+	"github.com/go-irc/irc"
+)
+
+func init() {
+	seabird.RegisterPlugin("stats", newStatsPlugin)
+}
+
+// statsMaxURLs is how many URLs we keep counts for in each channel. When
+// there are more, the least linked ones are dropped.
+const statsMaxURLs = 100
+
+var statsURLRegex = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+type statsConfig struct {
+	// If ReportDir is set, an HTML report will be written there every
+	// ReportInterval (default 1h).
+	ReportDir      string
+	ReportInterval seabird.Duration
+
+	// Exclude is a list of channels which shouldn't be counted, in addition
+	// to any excluded from the chanlog plugin. Glob patterns are allowed.
+	Exclude []string
+}
+
+type statsPlugin struct {
+	db     *storage.Namespace
+	config statsConfig
+}
+
+// ActivityStats are the counts we keep for both channels and users.
+type ActivityStats struct {
+	Messages int
+	Words    int
+
+	// Hours counts messages by the hour of the day they were sent in.
+	Hours [24]int
+}
+
+// ChannelStats is the activity for a whole channel.
+type ChannelStats struct {
+	ActivityStats
+
+	Channel string
+	Since   time.Time
+	URLs    map[string]int
+}
+
+// UserStats is the activity for a single user in a channel.
+type UserStats struct {
+	ActivityStats
+
+	Nick    string
+	Channel string
+	Last    time.Time
+}
+
+func newStatsPlugin(b *seabird.Bot, m *seabird.BasicMux, cm *seabird.CommandMux, store *storage.Store) error {
+	p := &statsPlugin{db: store.Namespace("stats")}
+
+	p.config.ReportInterval.Duration = time.Hour
+	_ = b.Config("stats", &p.config)
+
+	// Channels which aren't logged shouldn't show up in stats either.
+	clc := &chanLogConfig{}
+	if err := b.Config("chanlog", clc); err == nil {
+		p.config.Exclude = append(p.config.Exclude, clc.Exclude...)
+	}
+
+	if p.config.ReportInterval.Duration <= 0 {
+		return fmt.Errorf("stats reportinterval must be positive, got %s", p.config.ReportInterval.Duration)
+	}
+
+	for _, name := range []string{"channels", "users"} {
+		if err := p.db.EnsureBucket(name); err != nil {
+			return err
+		}
+	}
+
+	m.Event("PRIVMSG", p.msgCallback)
+
+	if p.config.ReportDir != "" {
+		m.Event("001", p.startReports)
+	}
+
+	cm.Event("stats", p.statsCallback, &seabird.HelpInfo{
+		Usage:       "[nick]",
+		Description: "Shows activity stats for the channel or a user in it",
+	})
+
+	return nil
+}
+
+func statsUserKey(channel, nick string) string {
+	return strings.ToLower(channel) + " " + strings.ToLower(nick)
+}
+
+func (s *ActivityStats) add(words int, t time.Time) {
+	s.Messages++
+	s.Words += words
+	s.Hours[t.Hour()]++
+}
+
+// busiestHour returns the hour with the most messages.
+func (s *ActivityStats) busiestHour() int {
+	ret := 0
+	for hour, count := range s.Hours {
+		if count > s.Hours[ret] {
+			ret = hour
+		}
+	}
+	return ret
+}
+
+// statsCount is a name with how many times it was counted, used for sorting.
+type statsCount struct {
+	Name  string
+	Count int
+}
+
+// sortedCounts returns the counts in the map, highest first.
+func sortedCounts(counts map[string]int) []statsCount {
+	var ret []statsCount
+	for name, count := range counts {
+		ret = append(ret, statsCount{name, count})
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Name < ret[j].Name
+	})
+
+	return ret
+}
+
+func (p *statsPlugin) msgCallback(b *seabird.Bot, m *irc.Message) {
+	if len(m.Params) < 2 || !b.FromChannel(m) || m.Prefix.Name == "" {
+		return
+	}
+
+	_, channel, _ := b.ChannelTarget(m.Params[0])
+	if channelMatches(p.config.Exclude, channel) {
+		return
+	}
+
+	nick := m.Prefix.Name
+	text := m.Trailing()
+	words := len(strings.Fields(text))
+	now := time.Now()
+
+	err := p.db.Update(func(tx storage.Tx) error {
+		channels := tx.Bucket("channels")
+		users := tx.Bucket("users")
+
+		cs := &ChannelStats{}
+		if err := channels.Get(strings.ToLower(channel), cs); err != nil {
+			cs = &ChannelStats{Channel: channel, Since: now}
+		}
+		if cs.URLs == nil {
+			cs.URLs = make(map[string]int)
+		}
+
+		cs.add(words, now)
+		for _, url := range statsURLRegex.FindAllString(text, -1) {
+			cs.URLs[url]++
+		}
+		pruneStatsURLs(cs.URLs)
+
+		us := &UserStats{}
+		if err := users.Get(statsUserKey(channel, nick), us); err != nil {
+			us = &UserStats{Channel: channel}
+		}
+
+		// Keep the most recent capitalization of the nick.
+		us.Nick = nick
+		us.Last = now
+		us.add(words, now)
+
+		err := channels.Put(strings.ToLower(channel), cs)
+		if err != nil {
+			return err
+		}
+
+		return users.Put(statsUserKey(channel, nick), us)
+	})
+	if err != nil {
+		b.GetLogger().WithError(err).Warn("Failed to update stats")
+	}
+}
+
+// pruneStatsURLs drops the least linked URLs until there are at most
+// statsMaxURLs left.
+func pruneStatsURLs(urls map[string]int) {
+	if len(urls) <= statsMaxURLs {
+		return
+	}
+
+	for _, c := range sortedCounts(urls)[statsMaxURLs:] {
+		delete(urls, c.Name)
+	}
+}
+
+// channelUsers returns the stats for everyone who has spoken in a channel,
+// most active first.
+func channelUsers(tx storage.Tx, channel string) ([]UserStats, error) {
+	var ret []UserStats
+
+	v := &UserStats{}
+	err := storage.ForEachPrefix(tx.Bucket("users"), strings.ToLower(channel)+" ", v, func(string) bool {
+		ret = append(ret, *v)
+		return true
+	})
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Messages > ret[j].Messages
+	})
+
+	return ret, err
+}
+
+func (p *statsPlugin) statsCallback(b *seabird.Bot, m *irc.Message) {
+	_, channel, ok := b.ChannelTarget(m.Params[0])
+	if !ok {
+		b.MentionReply(m, "Must be used in a channel")
+		return
+	}
+
+	if channelMatches(p.config.Exclude, channel) {
+		b.MentionReply(m, "Stats aren't kept for %s", channel)
+		return
+	}
+
+	nick := strings.TrimSpace(m.Trailing())
+
+	cs := &ChannelStats{}
+	us := &UserStats{}
+	var users []UserStats
+	err := p.db.View(func(tx storage.Tx) error {
+		err := tx.Bucket("channels").Get(strings.ToLower(channel), cs)
+		if err != nil {
+			return err
+		}
+
+		if nick != "" {
+			return tx.Bucket("users").Get(statsUserKey(channel, nick), us)
+		}
+
+		users, err = channelUsers(tx, channel)
+		return err
+	})
+	if err != nil {
+		if nick != "" {
+			b.MentionReply(m, "I haven't seen %s say anything in %s", nick, channel)
+		} else {
+			b.MentionReply(m, "No stats for %s yet", channel)
+		}
+		return
+	}
+
+	if nick != "" {
+		b.MentionReply(m, "%s has sent %d messages (%.1f%% of %s) with %d words, most often around %02d:00",
+			us.Nick, us.Messages, 100*float64(us.Messages)/float64(cs.Messages), channel, us.Words, us.busiestHour())
+		return
+	}
+
+	var top []string
+	for i := 0; i < len(users) && i < 3; i++ {
+		top = append(top, fmt.Sprintf("%s (%d)", users[i].Nick, users[i].Messages))
+	}
+
+	reply := fmt.Sprintf("%s: %d messages and %d words from %d users since %s, busiest around %02d:00",
+		channel, cs.Messages, cs.Words, len(users), formatDate(cs.Since), cs.busiestHour())
+	if len(top) > 0 {
+		reply += ", most active: " + strings.Join(top, ", ")
+	}
+	if urls := sortedCounts(cs.URLs); len(urls) > 0 {
+		reply += fmt.Sprintf(", top link: %s (%d)", urls[0].Name, urls[0].Count)
+	}
+
+	b.MentionReply(m, "%s", reply)
+}
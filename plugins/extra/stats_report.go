@@ -0,0 +1,199 @@
+package extra
+
+import (
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/storage"
+	"github.com/go-irc/irc"
+)
+
+// statsReportTopN is how many users and URLs are shown for each channel.
+const statsReportTopN = 10
+
+var statsReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Channel stats</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { padding: 0.2em 0.6em; text-align: left; }
+.bar { background: #4a90d9; height: 1em; }
+</style>
+</head>
+<body>
+<h1>Channel stats</h1>
+<p>Generated {{ .Generated.Format "2006-01-02 15:04 MST" }}</p>
+{{ range .Channels }}
+<h2>{{ .Channel }}</h2>
+<p>{{ .Messages }} messages and {{ .Words }} words since {{ .Since.Format "2006-01-02" }}.</p>
+
+<h3>Activity by hour</h3>
+<table>
+{{ range .Hours }}<tr><td>{{ printf "%02d:00" .Hour }}</td><td>{{ .Count }}</td><td><div class="bar" style="width: {{ .Width }}px"></div></td></tr>
+{{ end }}</table>
+
+<h3>Most active users</h3>
+<table>
+<tr><th>Nick</th><th>Messages</th><th>Words</th><th>Last seen</th></tr>
+{{ range .Users }}<tr><td>{{ .Nick }}</td><td>{{ .Messages }}</td><td>{{ .Words }}</td><td>{{ .Last.Format "2006-01-02 15:04" }}</td></tr>
+{{ end }}</table>
+
+{{ if .URLs }}<h3>Top links</h3>
+<table>
+{{ range .URLs }}<tr><td><a href="{{ .Name }}">{{ .Name }}</a></td><td>{{ .Count }}</td></tr>
+{{ end }}</table>
+{{ end }}
+{{ end }}
+</body>
+</html>
+`))
+
+type statsReportHour struct {
+	Hour  int
+	Count int
+	Width int
+}
+
+type statsReportChannel struct {
+	ChannelStats
+
+	Hours []statsReportHour
+	Users []UserStats
+	URLs  []statsCount
+}
+
+type statsReport struct {
+	Generated time.Time
+	Channels  []statsReportChannel
+}
+
+// startReports writes reports on a schedule for as long as this connection
+// lasts.
+func (p *statsPlugin) startReports(b *seabird.Bot, m *irc.Message) {
+	go p.reportLoop(b, b.Done())
+}
+
+func (p *statsPlugin) reportLoop(b *seabird.Bot, done <-chan struct{}) {
+	logger := b.GetLogger().WithField("dir", p.config.ReportDir)
+
+	ticker := time.NewTicker(p.config.ReportInterval.Duration)
+	defer ticker.Stop()
+
+	for {
+		filename, err := p.writeReport()
+		if err != nil {
+			logger.WithError(err).Error("Failed to write stats report")
+		} else {
+			logger.WithField("file", filename).Debug("Wrote stats report")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// buildReport collects the stats for every channel we know about.
+func (p *statsPlugin) buildReport() (*statsReport, error) {
+	report := &statsReport{Generated: time.Now()}
+
+	err := p.db.View(func(tx storage.Tx) error {
+		var channels []ChannelStats
+
+		v := &ChannelStats{}
+		err := tx.Bucket("channels").ForEach(v, func(key string) error {
+			// Stats from before a channel was excluded are left out too.
+			if !channelMatches(p.config.Exclude, v.Channel) {
+				channels = append(channels, *v)
+			}
+
+			// Decoding into a map merges with what's already there, so
+			// make sure channels don't share URLs.
+			*v = ChannelStats{}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, cs := range channels {
+			rc := statsReportChannel{ChannelStats: cs}
+
+			max := 1
+			for _, count := range cs.Hours {
+				if count > max {
+					max = count
+				}
+			}
+			for hour, count := range cs.Hours {
+				rc.Hours = append(rc.Hours, statsReportHour{hour, count, count * 300 / max})
+			}
+
+			rc.Users, err = channelUsers(tx, cs.Channel)
+			if err != nil {
+				return err
+			}
+			if len(rc.Users) > statsReportTopN {
+				rc.Users = rc.Users[:statsReportTopN]
+			}
+
+			rc.URLs = sortedCounts(cs.URLs)
+			if len(rc.URLs) > statsReportTopN {
+				rc.URLs = rc.URLs[:statsReportTopN]
+			}
+
+			report.Channels = append(report.Channels, rc)
+		}
+
+		return nil
+	})
+
+	return report, err
+}
+
+// writeReport renders the report to index.html in the report dir. It's
+// written to a temp file first so nothing ever sees a partial report.
+func (p *statsPlugin) writeReport() (string, error) {
+	report, err := p.buildReport()
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(p.config.ReportDir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(p.config.ReportDir, ".stats-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	err = statsReportTemplate.Execute(f, report)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// TempFile creates files which only we can read, but the report is
+	// meant to be served.
+	err = os.Chmod(f.Name(), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	filename := filepath.Join(p.config.ReportDir, "index.html")
+	return filename, os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,437 @@
+package extra
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/belak/go-seabird"
+	"github.com/belak/go-seabird/plugins"
+	"github.com/belak/go-seabird/storage"
+	"github.com/go-irc/irc"
+)
+
+func init() {
+	seabird.RegisterPlugin("tell", newTellPlugin)
+}
+
+type tellConfig struct {
+	// Private sends every message to the recipient directly rather than in
+	// the channel they show up in. Messages left in a private message are
+	// always delivered privately.
+	Private bool
+
+	// MaxPerRecipient is the most messages which can be waiting for one
+	// user. 0 means there is no limit.
+	MaxPerRecipient int
+}
+
+type tellPlugin struct {
+	db      *storage.Namespace
+	tracker *plugins.ChannelTracker
+	config  tellConfig
+
+	// accounts maps tracker session IDs to the services account they're
+	// logged in to, as far as we've seen.
+	accountLock sync.Mutex
+	accounts    map[string]string
+}
+
+// TellMessage is a message left for someone who wasn't around.
+type TellMessage struct {
+	ID        string
+	Sender    string
+	Recipient string
+	Channel   string
+	Message   string
+	Time      time.Time
+
+	// Account is set if we knew which account the recipient was logged in
+	// to. The message will only be given to that account.
+	Account string
+
+	// Private messages are only ever delivered in a private message.
+	Private bool
+}
+
+func newTellPlugin(b *seabird.Bot, m *seabird.BasicMux, cm *seabird.CommandMux, store *storage.Store, tracker *plugins.ChannelTracker) error {
+	p := &tellPlugin{
+		db:       store.Namespace("tell"),
+		tracker:  tracker,
+		accounts: make(map[string]string),
+	}
+
+	p.config.MaxPerRecipient = 10
+	_ = b.Config("tell", &p.config)
+
+	for _, name := range []string{"messages", "index"} {
+		if err := p.db.EnsureBucket(name); err != nil {
+			return err
+		}
+	}
+
+	tracker.RegisterSessionCleanupCallback(p.cleanupSession)
+
+	m.Event("PRIVMSG", p.deliverCallback)
+	m.Event("JOIN", p.deliverCallback)
+	m.Event("ACCOUNT", p.deliverCallback)
+
+	cm.Event("tell", p.tellCallback, &seabird.HelpInfo{
+		Usage:       "<nick> <message> | list | cancel <id>",
+		Description: "Leaves a message for someone, delivered when they next speak, join or identify",
+	})
+
+	return nil
+}
+
+// tellKey returns the key for a message in the messages bucket. IDs are zero
+// padded so messages sort in the order they were left.
+func tellKey(id string) string {
+	n, _ := strconv.ParseUint(id, 10, 64)
+	return fmt.Sprintf("%020d", n)
+}
+
+// tellIndexPrefix returns the prefix of the index keys for everything waiting
+// for a nick or account.
+func tellIndexPrefix(nick, account string) string {
+	if account != "" {
+		return "account:" + strings.ToLower(account) + "\x00"
+	}
+	return "nick:" + strings.ToLower(nick) + "\x00"
+}
+
+func tellIndexKey(msg *TellMessage) string {
+	return tellIndexPrefix(msg.Recipient, msg.Account) + tellKey(msg.ID)
+}
+
+// messageAccount returns the account a message says its sender is logged in
+// to, if it says anything at all.
+func messageAccount(m *irc.Message) (string, bool) {
+	var account string
+	var ok bool
+
+	switch {
+	case m.Command == "ACCOUNT" && len(m.Params) > 0:
+		account, ok = m.Params[0], true
+	case m.Command == "JOIN" && len(m.Params) > 2:
+		// extended-join
+		account, ok = m.Params[1], true
+	default:
+		account, ok = m.Tags.GetTag("account")
+	}
+
+	if account == "*" {
+		account = ""
+	}
+
+	return account, ok
+}
+
+// updateAccount remembers the account for the sender of m and returns the
+// best guess at which account they're logged in to.
+func (p *tellPlugin) updateAccount(m *irc.Message) string {
+	account, ok := messageAccount(m)
+
+	user := p.tracker.LookupUser(m.Prefix.Name)
+	if user == nil {
+		return account
+	}
+
+	p.accountLock.Lock()
+	defer p.accountLock.Unlock()
+
+	if !ok {
+		return p.accounts[user.UUID]
+	}
+
+	if account == "" {
+		delete(p.accounts, user.UUID)
+	} else {
+		p.accounts[user.UUID] = account
+	}
+
+	return account
+}
+
+// knownAccount returns the account we last saw the nick using.
+func (p *tellPlugin) knownAccount(nick string) string {
+	user := p.tracker.LookupUser(nick)
+	if user == nil {
+		return ""
+	}
+
+	p.accountLock.Lock()
+	defer p.accountLock.Unlock()
+
+	return p.accounts[user.UUID]
+}
+
+// cleanupSession is called by the tracker with its lock held, so it must not
+// call back into it.
+func (p *tellPlugin) cleanupSession(u *plugins.User) {
+	p.accountLock.Lock()
+	defer p.accountLock.Unlock()
+
+	delete(p.accounts, u.UUID)
+}
+
+func (p *tellPlugin) tellCallback(b *seabird.Bot, m *irc.Message) {
+	split := strings.SplitN(strings.TrimSpace(m.Trailing()), " ", 2)
+
+	var arg string
+	if len(split) > 1 {
+		arg = strings.TrimSpace(split[1])
+	}
+
+	switch split[0] {
+	case "":
+		b.MentionReply(m, "Nick required")
+		return
+	case "list":
+		p.listCallback(b, m)
+		return
+	case "cancel":
+		p.cancelCallback(b, m, arg)
+		return
+	}
+
+	nick := split[0]
+	if arg == "" {
+		b.MentionReply(m, "Message required")
+		return
+	}
+
+	if strings.EqualFold(nick, m.Prefix.Name) || strings.EqualFold(nick, b.CurrentNick()) {
+		b.MentionReply(m, "I'm not passing that along")
+		return
+	}
+
+	msg := &TellMessage{
+		Sender:    m.Prefix.Name,
+		Recipient: nick,
+		Message:   arg,
+		Time:      time.Now(),
+		Account:   p.knownAccount(nick),
+		Private:   !b.FromChannel(m),
+	}
+
+	if _, channel, ok := b.ChannelTarget(m.Params[0]); ok {
+		msg.Channel = channel
+	}
+
+	err := p.db.Update(func(tx storage.Tx) error {
+		messages := tx.Bucket("messages")
+		index := tx.Bucket("index")
+
+		if p.config.MaxPerRecipient > 0 {
+			count := 0
+			var key string
+			err := storage.ForEachPrefix(index, tellIndexPrefix(msg.Recipient, msg.Account), &key, func(string) bool {
+				count++
+				return true
+			})
+			if err != nil {
+				return err
+			}
+
+			if count >= p.config.MaxPerRecipient {
+				return fmt.Errorf("%s already has %d messages waiting", nick, count)
+			}
+		}
+
+		id, err := messages.NextID()
+		if err != nil {
+			return err
+		}
+		msg.ID = id
+
+		err = messages.Put(tellKey(msg.ID), msg)
+		if err != nil {
+			return err
+		}
+
+		return index.Put(tellIndexKey(msg), tellKey(msg.ID))
+	})
+	if err != nil {
+		b.MentionReply(m, "Failed to store message: %s", err)
+		return
+	}
+
+	b.MentionReply(m, "I'll pass that on to %s (#%s)", nick, msg.ID)
+}
+
+func (p *tellPlugin) listCallback(b *seabird.Bot, m *irc.Message) {
+	var pending []TellMessage
+	err := p.db.View(func(tx storage.Tx) error {
+		v := &TellMessage{}
+		return tx.Bucket("messages").ForEach(v, func(key string) error {
+			if strings.EqualFold(v.Sender, m.Prefix.Name) {
+				pending = append(pending, *v)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		b.MentionReply(m, "Failed to look up messages: %s", err)
+		return
+	}
+
+	if len(pending) == 0 {
+		b.MentionReply(m, "You have no messages waiting to be delivered")
+		return
+	}
+
+	// Messages may have been left privately, so the list is always sent
+	// privately.
+	for _, msg := range pending {
+		b.PrivateReply(m, "#%s for %s, %s: %s", msg.ID, msg.Recipient, formatAgo(msg.Time), msg.Message)
+	}
+}
+
+func (p *tellPlugin) cancelCallback(b *seabird.Bot, m *irc.Message, id string) {
+	id = strings.TrimPrefix(id, "#")
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		b.MentionReply(m, "Message ID required")
+		return
+	}
+
+	msg := &TellMessage{}
+	err := p.db.Update(func(tx storage.Tx) error {
+		messages := tx.Bucket("messages")
+
+		if err := messages.Get(tellKey(id), msg); err != nil {
+			return fmt.Errorf("No message #%s", id)
+		}
+
+		if !strings.EqualFold(msg.Sender, m.Prefix.Name) && !b.IsAdmin(m) {
+			return fmt.Errorf("Message #%s was left by %s", id, msg.Sender)
+		}
+
+		return deleteTellMessage(tx, msg)
+	})
+	if err != nil {
+		b.MentionReply(m, "%s", err)
+		return
+	}
+
+	b.MentionReply(m, "Cancelled message #%s for %s", msg.ID, msg.Recipient)
+}
+
+func deleteTellMessage(tx storage.Tx, msg *TellMessage) error {
+	err := tx.Bucket("index").Delete(tellIndexKey(msg))
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket("messages").Delete(tellKey(msg.ID))
+}
+
+// findTellMessages returns every message with an index key under one of the
+// given prefixes.
+func findTellMessages(tx storage.Tx, prefixes []string) ([]*TellMessage, error) {
+	var ret []*TellMessage
+	messages := tx.Bucket("messages")
+
+	for _, prefix := range prefixes {
+		var key string
+		err := storage.ForEachPrefix(tx.Bucket("index"), prefix, &key, func(string) bool {
+			msg := &TellMessage{}
+			if messages.Get(key, msg) == nil {
+				ret = append(ret, msg)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+// deliverCallback sends everything waiting for the sender of m, whether it
+// was left for their nick or their account.
+func (p *tellPlugin) deliverCallback(b *seabird.Bot, m *irc.Message) {
+	if m.Prefix == nil || m.Prefix.Name == "" || m.Prefix.Name == b.CurrentNick() {
+		return
+	}
+
+	nick := m.Prefix.Name
+	account := p.updateAccount(m)
+
+	prefixes := []string{tellIndexPrefix(nick, "")}
+	if account != "" {
+		prefixes = append(prefixes, tellIndexPrefix(nick, account))
+	}
+
+	// Almost everyone has nothing waiting, so check that without taking the
+	// write lock first.
+	var waiting []*TellMessage
+	err := p.db.View(func(tx storage.Tx) error {
+		var err error
+		waiting, err = findTellMessages(tx, prefixes)
+		return err
+	})
+	if err != nil {
+		b.GetLogger().WithError(err).Error("Failed to look up messages")
+		return
+	}
+
+	if len(waiting) == 0 {
+		return
+	}
+
+	// Look them up again now we can write, in case they were delivered in
+	// the meantime.
+	err = p.db.Update(func(tx storage.Tx) error {
+		var err error
+		waiting, err = findTellMessages(tx, prefixes)
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range waiting {
+			if err = deleteTellMessage(tx, msg); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		b.GetLogger().WithError(err).Error("Failed to look up messages")
+		return
+	}
+
+	if len(waiting) == 0 {
+		return
+	}
+
+	// Messages go wherever the user showed up, unless they need to be
+	// private or there's no channel to send them to.
+	var channel string
+	switch {
+	case m.Command == "JOIN" && len(m.Params) > 0:
+		channel = m.Params[0]
+	case m.Command == "PRIVMSG" && b.FromChannel(m):
+		channel = m.Params[0]
+	}
+
+	for _, msg := range waiting {
+		text := fmt.Sprintf("%s left you a message %s: %s", msg.Sender, formatAgo(msg.Time), msg.Message)
+
+		target := nick
+		if channel != "" && !msg.Private && !p.config.Private {
+			target = channel
+			text = nick + ": " + text
+		}
+
+		b.Send(&irc.Message{
+			Prefix:  &irc.Prefix{},
+			Command: "PRIVMSG",
+			Params:  []string{target, text},
+		})
+	}
+}
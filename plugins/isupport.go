@@ -21,9 +21,11 @@ type ISupportPlugin struct {
 func newISupportPlugin(b *seabird.Bot, bm *seabird.BasicMux) *ISupportPlugin {
 	p := &ISupportPlugin{
 		raw: map[string]string{
-			"PREFIX": "(ov)@+",
+			"PREFIX":    "(ov)@+",
+			"CHANTYPES": "#&",
 		},
 	}
+	b.SetISupport(p)
 	bm.Event("005", p.handle005)
 	return p
 }
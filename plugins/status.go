@@ -0,0 +1,166 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/belak/go-seabird"
+)
+
+func init() {
+	seabird.RegisterPlugin("status", newStatusPlugin)
+}
+
+// defaultStatusAddress is used if no address is configured. It only listens
+// locally so the status server isn't exposed by accident.
+const defaultStatusAddress = "127.0.0.1:8080"
+
+type statusConfig struct {
+	Address string
+}
+
+type statusPlugin struct {
+	b       *seabird.Bot
+	tracker *ChannelTracker
+}
+
+type statusResponse struct {
+	Nick       string   `json:"nick"`
+	Registered bool     `json:"registered"`
+	Uptime     string   `json:"uptime"`
+	Channels   []string `json:"channels"`
+	Plugins    []string `json:"plugins"`
+}
+
+func newStatusPlugin(b *seabird.Bot, tracker *ChannelTracker) error {
+	p := &statusPlugin{
+		b:       b,
+		tracker: tracker,
+	}
+
+	sc := &statusConfig{}
+	err := b.Config("status", sc)
+	if err != nil {
+		return err
+	}
+
+	if sc.Address == "" {
+		sc.Address = defaultStatusAddress
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", p.healthHandler)
+	mux.HandleFunc("/status", p.statusHandler)
+	mux.HandleFunc("/metrics", p.metricsHandler)
+
+	logger := b.GetLogger().WithField("addr", sc.Address)
+
+	go func() {
+		logger.Info("Starting status server")
+
+		err := http.ListenAndServe(sc.Address, mux)
+		logger.WithError(err).Error("Status server stopped")
+	}()
+
+	return nil
+}
+
+func (p *statusPlugin) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if !p.b.Registered() {
+		http.Error(w, "not connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+func (p *statusPlugin) statusHandler(w http.ResponseWriter, r *http.Request) {
+	resp := statusResponse{
+		Registered: p.b.Registered(),
+		Uptime:     time.Since(p.b.StartTime()).String(),
+		Channels:   []string{},
+		Plugins:    p.b.Plugins(),
+	}
+
+	if resp.Registered {
+		resp.Nick = p.b.CurrentNick()
+	}
+
+	for _, c := range p.tracker.Channels() {
+		resp.Channels = append(resp.Channels, c.Name)
+	}
+	sort.Strings(resp.Channels)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// metricsHandler writes out the bot metrics in the prometheus text format.
+func (p *statusPlugin) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	snap := p.b.Metrics().Snapshot()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "seabird_messages_in_total", "counter", "Messages received from the server.", snap.MessagesIn)
+	writeMetric(w, "seabird_messages_out_total", "counter", "Messages sent to the server.", snap.MessagesOut)
+	writeMetric(w, "seabird_handler_errors_total", "counter", "Panics recovered from message handlers.", snap.HandlerErrors)
+	writeMetric(w, "seabird_reconnects_total", "counter", "Number of times the bot has reconnected.", snap.Reconnects)
+
+	var registered uint64
+	if p.b.Registered() {
+		registered = 1
+	}
+	writeMetric(w, "seabird_registered", "gauge", "Whether the bot is connected and registered.", registered)
+	writeMetric(w, "seabird_uptime_seconds", "gauge", "Seconds since the bot started.", uint64(time.Since(p.b.StartTime()).Seconds()))
+
+	fmt.Fprintln(w, "# HELP seabird_commands_total Commands executed by name.")
+	fmt.Fprintln(w, "# TYPE seabird_commands_total counter")
+	for _, name := range sortedKeys(snap.Commands) {
+		fmt.Fprintf(w, "seabird_commands_total{command=%q} %d\n", escapeLabel(name), snap.Commands[name])
+	}
+
+	var handlerNames []string
+	for k := range snap.Handlers {
+		handlerNames = append(handlerNames, k)
+	}
+	sort.Strings(handlerNames)
+
+	fmt.Fprintln(w, "# HELP seabird_handler_duration_seconds Time spent handling messages by IRC command.")
+	fmt.Fprintln(w, "# TYPE seabird_handler_duration_seconds summary")
+	for _, name := range handlerNames {
+		t := snap.Handlers[name]
+		fmt.Fprintf(w, "seabird_handler_duration_seconds_sum{command=%q} %f\n", escapeLabel(name), t.Total.Seconds())
+		fmt.Fprintf(w, "seabird_handler_duration_seconds_count{command=%q} %d\n", escapeLabel(name), t.Count)
+	}
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	var ret []string
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// escapeLabel strips characters from label values which %q would otherwise
+// escape in a way prometheus doesn't understand.
+func escapeLabel(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,328 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DumpVersion is the version of the export format written by Export. Import
+// will refuse to load dumps with a different version.
+const DumpVersion = 1
+
+const (
+	recordHeader = "header"
+	recordSchema = "schema"
+	recordBucket = "bucket"
+	recordValue  = "value"
+
+	backupPrefix = "seabird-"
+	backupSuffix = ".jsonl"
+)
+
+// dumpRecord is a single line of an export. Every line has a Type and only
+// the fields relevant to that type are filled in.
+type dumpRecord struct {
+	Type string `json:"type"`
+
+	// Header
+	Version int       `json:"version,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+
+	// Schema and bucket
+	Namespace     string `json:"namespace,omitempty"`
+	SchemaVersion int    `json:"schema_version,omitempty"`
+	Name          string `json:"name,omitempty"`
+
+	// Bucket. Sequence is the last ID handed out by NextID. It may be
+	// missing from older dumps.
+	Sequence uint64 `json:"sequence,omitempty"`
+
+	// Bucket and value
+	Bucket string          `json:"bucket,omitempty"`
+	Key    string          `json:"key,omitempty"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+// Export writes every namespaced bucket in the store to w as JSON lines. The
+// whole export is done in a single read transaction, so it is safe to run
+// while the bot is using the store.
+func (s *Store) Export(w io.Writer) error {
+	enc := json.NewEncoder(w)
+
+	return s.View(func(tx Tx) error {
+		err := enc.Encode(&dumpRecord{
+			Type:    recordHeader,
+			Version: DumpVersion,
+			Created: time.Now().UTC(),
+		})
+		if err != nil {
+			return err
+		}
+
+		version := &schemaVersion{}
+		err = tx.Bucket(schemaBucket).ForEach(version, func(key string) error {
+			return enc.Encode(&dumpRecord{
+				Type:          recordSchema,
+				Namespace:     version.Namespace,
+				SchemaVersion: version.Version,
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		var buckets []bucketInfo
+		info := &bucketInfo{}
+		err = tx.Bucket(bucketsBucket).ForEach(info, func(key string) error {
+			buckets = append(buckets, *info)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, info := range buckets {
+			fullName := bucketName(info.Namespace, info.Name)
+
+			seq, err := tx.Bucket(fullName).Sequence()
+			if err != nil {
+				return err
+			}
+
+			err = enc.Encode(&dumpRecord{
+				Type:      recordBucket,
+				Bucket:    fullName,
+				Namespace: info.Namespace,
+				Name:      info.Name,
+				Sequence:  seq,
+			})
+			if err != nil {
+				return err
+			}
+
+			var raw json.RawMessage
+			err = tx.Bucket(fullName).ForEach(&raw, func(key string) error {
+				return enc.Encode(&dumpRecord{
+					Type:   recordValue,
+					Bucket: fullName,
+					Key:    key,
+					Value:  raw,
+				})
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Import loads a dump written by Export into the store, replacing everything
+// in it. All buckets and schema versions are cleared first, so nothing stale
+// is left behind. All values are written in a single transaction, so a bad
+// dump won't leave the store half imported. Each bucket's sequence is
+// restored so NextID doesn't hand out IDs which are already used. Older dumps
+// don't have it, so it's never set lower than the highest numeric key.
+// Migrations should be run after importing in case the dump is from an older
+// version.
+func (s *Store) Import(r io.Reader) error {
+	var records []*dumpRecord
+	buckets := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		rec := &dumpRecord{}
+		err := json.Unmarshal(scanner.Bytes(), rec)
+		if err != nil {
+			return fmt.Errorf("Line %d: %s", line, err)
+		}
+
+		switch rec.Type {
+		case recordHeader:
+			if line != 1 {
+				return fmt.Errorf("Line %d: unexpected header", line)
+			}
+			if rec.Version != DumpVersion {
+				return fmt.Errorf("Unsupported dump version %d", rec.Version)
+			}
+		case recordSchema:
+			if rec.Namespace == "" {
+				return fmt.Errorf("Line %d: schema missing namespace", line)
+			}
+		case recordBucket:
+			if rec.Namespace == "" || rec.Name == "" || rec.Bucket != bucketName(rec.Namespace, rec.Name) {
+				return fmt.Errorf("Line %d: invalid bucket %q", line, rec.Bucket)
+			}
+			buckets[rec.Bucket] = true
+		case recordValue:
+			if !buckets[rec.Bucket] {
+				return fmt.Errorf("Line %d: value for unknown bucket %q", line, rec.Bucket)
+			}
+		default:
+			return fmt.Errorf("Line %d: unknown record type %q", line, rec.Type)
+		}
+
+		if line == 1 && rec.Type != recordHeader {
+			return errors.New("Dump is missing a header")
+		}
+
+		records = append(records, rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(records) == 0 {
+		return errors.New("Dump is empty")
+	}
+
+	for _, rec := range records {
+		if rec.Type != recordBucket {
+			continue
+		}
+
+		err := s.ensureNamespacedBucket(rec.Namespace, rec.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	existing, err := s.Buckets()
+	if err != nil {
+		return err
+	}
+
+	return s.Update(func(tx Tx) error {
+		for _, name := range append(existing, schemaBucket) {
+			if err := ClearBucket(tx, name); err != nil {
+				return err
+			}
+		}
+
+		sequences := make(map[string]uint64)
+
+		for _, rec := range records {
+			var err error
+
+			switch rec.Type {
+			case recordBucket:
+				if rec.Sequence > sequences[rec.Bucket] {
+					sequences[rec.Bucket] = rec.Sequence
+				}
+			case recordSchema:
+				err = tx.Bucket(schemaBucket).Put(rec.Namespace, &schemaVersion{
+					Namespace: rec.Namespace,
+					Version:   rec.SchemaVersion,
+				})
+			case recordValue:
+				err = tx.Bucket(rec.Bucket).Put(rec.Key, rec.Value)
+
+				if id, parseErr := strconv.ParseUint(rec.Key, 10, 64); parseErr == nil && id > sequences[rec.Bucket] {
+					sequences[rec.Bucket] = id
+				}
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		for name, seq := range sequences {
+			if err := tx.Bucket(name).SetSequence(seq); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Backup exports the store to a timestamped file in dir and then removes all
+// but the newest keep backups. If keep is less than 1, no backups will be
+// removed. The filename of the new backup is returned.
+func (s *Store) Backup(dir string, keep int) (string, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	// Write to a temp file first so a failed backup never looks like a
+	// complete one.
+	f, err := ioutil.TempFile(dir, ".backup-")
+	if err != nil {
+		return "", err
+	}
+
+	err = s.Export(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	filename := filepath.Join(dir, backupPrefix+time.Now().UTC().Format("20060102-150405")+backupSuffix)
+	err = os.Rename(f.Name(), filename)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	if keep < 1 {
+		return filename, nil
+	}
+
+	return filename, pruneBackups(dir, keep)
+}
+
+func pruneBackups(dir string, keep int) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, f := range files {
+		name := f.Name()
+		if f.Mode().IsRegular() && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			backups = append(backups, name)
+		}
+	}
+
+	if len(backups) <= keep {
+		return nil
+	}
+
+	// The timestamp format sorts in order, so the oldest backups come first.
+	sort.Strings(backups)
+	for _, name := range backups[:len(backups)-keep] {
+		err = os.Remove(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	s, err := NewStore(NewMemoryBackend())
+	require.NoError(t, err)
+
+	ns := s.Namespace("dump")
+	require.NoError(t, ns.EnsureBucket("values"))
+	err = ns.Update(func(tx Tx) error {
+		bucket := tx.Bucket("values")
+		if innerErr := bucket.Put("a", &testValue{"a", 1}); innerErr != nil {
+			return innerErr
+		}
+		return bucket.Put("b", &testValue{"b", 2})
+	})
+	require.NoError(t, err)
+
+	err = s.Update(func(tx Tx) error {
+		return tx.Bucket(schemaBucket).Put("dump", &schemaVersion{"dump", 3})
+	})
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, s.Export(buf))
+
+	// Anything already in the store should be replaced.
+	s2, err := NewStore(NewMemoryBackend())
+	require.NoError(t, err)
+	require.NoError(t, s2.Namespace("dump").EnsureBucket("values"))
+	err = s2.Namespace("dump").Update(func(tx Tx) error {
+		return tx.Bucket("values").Put("stale", &testValue{"stale", 1})
+	})
+	require.NoError(t, err)
+	err = s2.Update(func(tx Tx) error {
+		return tx.Bucket(schemaBucket).Put("other", &schemaVersion{"other", 1})
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, s2.Import(bytes.NewReader(buf.Bytes())))
+
+	err = s2.Namespace("dump").View(func(tx Tx) error {
+		return tx.Bucket("values").Get("stale", &testValue{})
+	})
+	assert.Equal(t, ErrNotFound, err)
+
+	version, err := s2.SchemaVersion("other")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, version)
+
+	out := &testValue{}
+	err = s2.Namespace("dump").View(func(tx Tx) error {
+		return tx.Bucket("values").Get("b", out)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &testValue{"b", 2}, out)
+
+	buckets, err := s2.Buckets()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dump_values"}, buckets)
+
+	version, err = s2.SchemaVersion("dump")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, version)
+
+	// Bad dumps should be rejected without writing anything
+	for _, dump := range []string{
+		"",
+		`{"type":"header","version":2}`,
+		`{"type":"bucket","bucket":"dump_values","namespace":"dump","name":"values"}`,
+		`{"type":"header","version":1}` + "\n" + `{"type":"value","bucket":"other","key":"a","value":{}}`,
+		`{"type":"header","version":1}` + "\n" + `{"type":"schema","namespace":"other","schema_version":1}` + "\n" + `not json`,
+	} {
+		s3, err := NewStore(NewMemoryBackend())
+		require.NoError(t, err)
+		assert.Error(t, s3.Import(strings.NewReader(dump)))
+
+		version, err := s3.SchemaVersion("other")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, version)
+	}
+}
+
+func TestImportSequence(t *testing.T) {
+	s, err := NewStore(NewMemoryBackend())
+	require.NoError(t, err)
+
+	ns := s.Namespace("dump")
+	require.NoError(t, ns.EnsureBucket("values"))
+	err = ns.Update(func(tx Tx) error {
+		bucket := tx.Bucket("values")
+		for i := 0; i < 3; i++ {
+			id, innerErr := bucket.NextID()
+			if innerErr != nil {
+				return innerErr
+			}
+
+			// Keys don't have to be the IDs themselves.
+			if innerErr = bucket.Put("value-"+id, &testValue{id, i}); innerErr != nil {
+				return innerErr
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, s.Export(buf))
+
+	var tests = []struct {
+		Name     string
+		Dump     string
+		Expected string
+	}{
+		{"round trip", buf.String(), "4"},
+		{
+			"older dump without a sequence",
+			`{"type":"header","version":1}
+{"type":"bucket","bucket":"dump_values","namespace":"dump","name":"values"}
+{"type":"value","bucket":"dump_values","key":"00000000000000000007","value":{}}
+{"type":"value","bucket":"dump_values","key":"00000000000000000002","value":{}}`,
+			"8",
+		},
+	}
+
+	for _, test := range tests {
+		s2, err := NewStore(NewMemoryBackend())
+		require.NoError(t, err)
+		require.NoError(t, s2.Import(strings.NewReader(test.Dump)), test.Name)
+
+		var id string
+		err = s2.Namespace("dump").Update(func(tx Tx) error {
+			var innerErr error
+			id, innerErr = tx.Bucket("values").NextID()
+			return innerErr
+		})
+		assert.NoError(t, err, test.Name)
+		assert.Equal(t, test.Expected, id, test.Name)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seabird-backup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewStore(NewMemoryBackend())
+	require.NoError(t, err)
+
+	filename, err := s.Backup(dir, 2)
+	require.NoError(t, err)
+
+	// Fake a few older backups to make sure they get cleaned up.
+	for _, name := range []string{"seabird-20000101-000000.jsonl", "seabird-20000102-000000.jsonl", "notes.txt"} {
+		require.NoError(t, ioutil.WriteFile(dir+"/"+name, nil, 0600))
+	}
+
+	_, err = s.Backup(dir, 2)
+	require.NoError(t, err)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	assert.Len(t, names, 3)
+	assert.Contains(t, names, "notes.txt")
+	assert.NotContains(t, names, "seabird-20000101-000000.jsonl")
+
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), `{"type":"header"`))
+}
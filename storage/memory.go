@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// memoryBackend is a simple in-memory Backend. It's mostly useful for tests.
+type memoryBackend struct {
+	lock    *sync.RWMutex
+	buckets map[string]*memoryBucket
+}
+
+type memoryBucket struct {
+	Values   map[string][]byte
+	Sequence uint64
+}
+
+type memoryTx struct {
+	buckets  map[string]*memoryBucket
+	writable bool
+}
+
+type memoryBucketTx struct {
+	bucket   *memoryBucket
+	writable bool
+}
+
+// NewMemoryBackend returns a Backend which only stores data in memory.
+func NewMemoryBackend() Backend {
+	return &memoryBackend{
+		lock:    &sync.RWMutex{},
+		buckets: make(map[string]*memoryBucket),
+	}
+}
+
+func (b *memoryBackend) EnsureBucket(name string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.buckets[name]; !ok {
+		b.buckets[name] = &memoryBucket{Values: make(map[string][]byte)}
+	}
+
+	return nil
+}
+
+func (b *memoryBackend) View(fn func(tx Tx) error) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return fn(&memoryTx{buckets: b.buckets})
+}
+
+func (b *memoryBackend) Update(fn func(tx Tx) error) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Work on a copy so we can throw it away if anything fails.
+	buckets := make(map[string]*memoryBucket, len(b.buckets))
+	for name, bucket := range b.buckets {
+		values := make(map[string][]byte, len(bucket.Values))
+		for k, v := range bucket.Values {
+			values[k] = v
+		}
+		buckets[name] = &memoryBucket{Values: values, Sequence: bucket.Sequence}
+	}
+
+	err := fn(&memoryTx{buckets: buckets, writable: true})
+	if err != nil {
+		return err
+	}
+
+	b.buckets = buckets
+
+	return nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
+
+func (t *memoryTx) Bucket(name string) Bucket {
+	bucket, ok := t.buckets[name]
+	if !ok {
+		return nil
+	}
+	return &memoryBucketTx{bucket: bucket, writable: t.writable}
+}
+
+func (b *memoryBucketTx) Get(key string, v interface{}) error {
+	data, ok := b.bucket.Values[key]
+	if !ok {
+		return ErrNotFound
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func (b *memoryBucketTx) Put(key string, v interface{}) error {
+	if !b.writable {
+		return errors.New("Transaction is read-only")
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	b.bucket.Values[key] = data
+
+	return nil
+}
+
+func (b *memoryBucketTx) Delete(key string) error {
+	if !b.writable {
+		return errors.New("Transaction is read-only")
+	}
+
+	delete(b.bucket.Values, key)
+
+	return nil
+}
+
+func (b *memoryBucketTx) NextID() (string, error) {
+	if !b.writable {
+		return "", errors.New("Transaction is read-only")
+	}
+
+	b.bucket.Sequence++
+
+	return strconv.FormatUint(b.bucket.Sequence, 10), nil
+}
+
+func (b *memoryBucketTx) Sequence() (uint64, error) {
+	return b.bucket.Sequence, nil
+}
+
+func (b *memoryBucketTx) SetSequence(seq uint64) error {
+	if !b.writable {
+		return errors.New("Transaction is read-only")
+	}
+
+	b.bucket.Sequence = seq
+
+	return nil
+}
+
+func (b *memoryBucketTx) ForEach(v interface{}, fn func(key string) error) error {
+	return b.ForEachPrefix("", v, fn)
+}
+
+func (b *memoryBucketTx) ForEachPrefix(prefix string, v interface{}, fn func(key string) error) error {
+	var keys []string
+	for k := range b.bucket.Values {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		// The callback may have deleted keys we haven't gotten to yet.
+		data, ok := b.bucket.Values[key]
+		if !ok {
+			continue
+		}
+
+		err := json.Unmarshal(data, v)
+		if err != nil {
+			return err
+		}
+
+		err = fn(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
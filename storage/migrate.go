@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A Migration moves a namespace's data from one schema version to the
+// next. Migrations are run in order of their version at startup and each one
+// is run in its own transaction along with the schema version update.
+type Migration struct {
+	Version     int
+	Description string
+
+	// Buckets lists the raw (un-namespaced) bucket names which need to exist
+	// before the migration is run. This includes any legacy buckets which
+	// are being moved.
+	Buckets []string
+
+	Migrate func(tx Tx) error
+}
+
+var (
+	migrationLock = &sync.Mutex{}
+	migrations    = make(map[string][]Migration)
+)
+
+// RegisterMigration registers a Migration for the given namespace. It will
+// panic if multiple migrations are registered with the same version for a
+// namespace. This is meant to be called from a plugin's init function.
+func RegisterMigration(namespace string, m Migration) {
+	migrationLock.Lock()
+	defer migrationLock.Unlock()
+
+	if m.Version < 1 {
+		panic(fmt.Sprintf("Invalid migration version %d for %q", m.Version, namespace))
+	}
+
+	for _, existing := range migrations[namespace] {
+		if existing.Version == m.Version {
+			panic(fmt.Sprintf("Migration version %d for %q registered twice", m.Version, namespace))
+		}
+	}
+
+	migrations[namespace] = append(migrations[namespace], m)
+}
+
+// Migrate runs all registered migrations which haven't been applied yet. It
+// will return an error if the database has a newer schema than any of the
+// registered migrations, as that usually means an older version of the bot
+// is being run against a newer database.
+func (s *Store) Migrate() error {
+	migrationLock.Lock()
+	defer migrationLock.Unlock()
+
+	var namespaces []string
+	for k := range migrations {
+		namespaces = append(namespaces, k)
+	}
+	sort.Strings(namespaces)
+
+	for _, namespace := range namespaces {
+		err := s.migrateNamespace(namespace, migrations[namespace])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) migrateNamespace(namespace string, nsMigrations []Migration) error {
+	current, err := s.SchemaVersion(namespace)
+	if err != nil {
+		return err
+	}
+
+	sorted := make([]Migration, len(nsMigrations))
+	copy(sorted, nsMigrations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+
+	if latest := sorted[len(sorted)-1].Version; current > latest {
+		return fmt.Errorf("Schema for %q is at version %d but only version %d is supported", namespace, current, latest)
+	}
+
+	for _, m := range sorted {
+		if m.Version <= current {
+			continue
+		}
+
+		for _, name := range m.Buckets {
+			err = s.EnsureBucket(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = s.Update(func(tx Tx) error {
+			if m.Migrate != nil {
+				if innerErr := m.Migrate(tx); innerErr != nil {
+					return innerErr
+				}
+			}
+
+			return tx.Bucket(schemaBucket).Put(namespace, &schemaVersion{
+				Namespace: namespace,
+				Version:   m.Version,
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("Migration %d for %q (%s) failed: %s", m.Version, namespace, m.Description, err)
+		}
+	}
+
+	return nil
+}
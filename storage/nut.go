@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/belak/nut"
+)
+
+// NutOpenTimeout is how long OpenNut will wait for another process to close
+// the database.
+var NutOpenTimeout = 5 * time.Second
+
+// nutSequenceBucket stores the last ID handed out for each bucket. nut
+// doesn't let us read or change bolt's own sequence, so we keep track of it
+// ourselves.
+const nutSequenceBucket = "_sequences"
+
+// nutBatchSize is how many values are read at a time when iterating over a
+// bucket.
+const nutBatchSize = 100
+
+type nutBackend struct {
+	db *nut.DB
+}
+
+type nutTx struct {
+	tx *nut.Tx
+}
+
+type nutBucket struct {
+	tx     *nut.Tx
+	name   string
+	bucket *nut.Bucket
+}
+
+// OpenNut opens a nut (bolt) database with the given filename and returns it
+// as a Backend. Only one process can have the database open at a time, so
+// this will give up if it's locked for longer than NutOpenTimeout.
+func OpenNut(filename string) (Backend, error) {
+	type result struct {
+		db  *nut.DB
+		err error
+	}
+
+	// bolt will wait on the file lock forever, so we wait for it in the
+	// background.
+	done := make(chan result, 1)
+	go func() {
+		db, err := nut.Open(filename, 0700)
+		done <- result{db, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		return NewNutBackend(r.db), nil
+	case <-time.After(NutOpenTimeout):
+		// If the lock is released later, we don't want to keep it.
+		go func() {
+			if r := <-done; r.err == nil {
+				r.db.Close()
+			}
+		}()
+
+		return nil, fmt.Errorf("Timed out after %s waiting for %s to be unlocked. Is the bot running?", NutOpenTimeout, filename)
+	}
+}
+
+// NewNutBackend wraps an already open nut database.
+func NewNutBackend(db *nut.DB) Backend {
+	return &nutBackend{db: db}
+}
+
+// NutDB returns the nut database behind a Backend, or nil if it isn't using
+// the nut driver. This is only meant for older plugins which use nut
+// directly.
+func NutDB(b Backend) *nut.DB {
+	if nb, ok := b.(*nutBackend); ok {
+		return nb.db
+	}
+
+	return nil
+}
+
+func (b *nutBackend) EnsureBucket(name string) error {
+	err := b.db.EnsureBucket(nutSequenceBucket)
+	if err != nil {
+		return err
+	}
+
+	return b.db.EnsureBucket(name)
+}
+
+func (b *nutBackend) View(fn func(tx Tx) error) error {
+	return b.db.View(func(tx *nut.Tx) error {
+		return fn(&nutTx{tx})
+	})
+}
+
+func (b *nutBackend) Update(fn func(tx Tx) error) error {
+	return b.db.Update(func(tx *nut.Tx) error {
+		return fn(&nutTx{tx})
+	})
+}
+
+func (b *nutBackend) Close() error {
+	return b.db.Close()
+}
+
+func (t *nutTx) Bucket(name string) Bucket {
+	return &nutBucket{tx: t.tx, name: name, bucket: t.tx.Bucket(name)}
+}
+
+func (b *nutBucket) Get(key string, v interface{}) error {
+	err := b.bucket.Get(key, v)
+	if err != nil && !b.exists(key) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// exists is used to tell the difference between missing keys and values
+// which failed to decode, since nut doesn't.
+func (b *nutBucket) exists(key string) bool {
+	var raw json.RawMessage
+	found, err := b.bucket.Cursor().Seek(key, &raw)
+	return err == nil && found == key
+}
+
+func (b *nutBucket) Put(key string, v interface{}) error {
+	return b.bucket.Put(key, v)
+}
+
+func (b *nutBucket) Delete(key string) error {
+	return b.bucket.Delete(key)
+}
+
+func (b *nutBucket) NextID() (string, error) {
+	seq, err := b.Sequence()
+	if err != nil {
+		return "", err
+	}
+
+	if seq == 0 {
+		// Buckets from before we tracked the sequence may already have
+		// used IDs from bolt's, so we carry on from there.
+		id, err := b.bucket.NextID()
+		if err != nil {
+			return "", err
+		}
+
+		seq, err = strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		seq++
+	}
+
+	err = b.SetSequence(seq)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatUint(seq, 10), nil
+}
+
+func (b *nutBucket) Sequence() (uint64, error) {
+	sequences := b.tx.Bucket(nutSequenceBucket)
+	if sequences == nil {
+		return 0, nil
+	}
+
+	var seq uint64
+	err := sequences.Get(b.name, &seq)
+	if err != nil {
+		// Missing and undecodable sequences are treated the same, since
+		// nut doesn't tell them apart.
+		return 0, nil
+	}
+
+	return seq, nil
+}
+
+func (b *nutBucket) SetSequence(seq uint64) error {
+	sequences := b.tx.Bucket(nutSequenceBucket)
+	if sequences == nil {
+		return fmt.Errorf("Bucket %q does not exist", nutSequenceBucket)
+	}
+
+	return sequences.Put(b.name, seq)
+}
+
+func (b *nutBucket) ForEach(v interface{}, fn func(key string) error) error {
+	return b.ForEachPrefix("", v, fn)
+}
+
+func (b *nutBucket) ForEachPrefix(prefix string, v interface{}, fn func(key string) error) error {
+	// Values are read a batch at a time and the callback is only run once
+	// we're done with the cursor. Bolt cursors can skip items if the bucket
+	// is modified while they're in use.
+	start, after := prefix, false
+	for {
+		keys, values := b.scanBatch(prefix, start, after)
+
+		for i, key := range keys {
+			if err := json.Unmarshal(values[i], v); err != nil {
+				return err
+			}
+
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+
+		if len(keys) < nutBatchSize {
+			return nil
+		}
+
+		start, after = keys[len(keys)-1], true
+	}
+}
+
+// scanBatch reads up to nutBatchSize raw values with the given prefix,
+// starting at start. If after is true, start itself is skipped.
+func (b *nutBucket) scanBatch(prefix, start string, after bool) ([]string, []json.RawMessage) {
+	var keys []string
+	var values []json.RawMessage
+
+	cursor := b.bucket.Cursor()
+
+	// The cursor returns an error when it runs out of items, so that's the
+	// only thing we need to check for.
+	var raw json.RawMessage
+	key, err := cursor.Seek(start, &raw)
+	if err == nil && after && key == start {
+		raw = nil
+		key, err = cursor.Next(&raw)
+	}
+
+	for ; err == nil && strings.HasPrefix(key, prefix) && len(keys) < nutBatchSize; key, err = cursor.Next(&raw) {
+		keys = append(keys, key)
+		values = append(values, raw)
+
+		// Decoding reuses the buffer, so make sure we get a new one.
+		raw = nil
+	}
+
+	return keys, values
+}
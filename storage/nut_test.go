@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNutBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seabird-storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	b, err := Open("nut", filepath.Join(dir, "test.db"))
+	require.NoError(t, err)
+
+	testBackend(t, b)
+}
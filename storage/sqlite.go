@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	// Load the sqlite driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS buckets (
+	name     TEXT PRIMARY KEY,
+	sequence INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS kv (
+	bucket TEXT NOT NULL,
+	key    TEXT NOT NULL,
+	value  BLOB NOT NULL,
+	PRIMARY KEY (bucket, key)
+);
+`
+
+// sqliteBatchSize is how many rows are read at a time when iterating over a
+// bucket.
+const sqliteBatchSize = 100
+
+type sqliteBackend struct {
+	db *sql.DB
+}
+
+type sqliteTx struct {
+	tx       *sql.Tx
+	writable bool
+}
+
+type sqliteBucket struct {
+	tx   *sqliteTx
+	name string
+}
+
+// OpenSQLite opens a sqlite database with the given filename and returns it
+// as a Backend. Values are stored as JSON, the same as with nut.
+func OpenSQLite(filename string) (Backend, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite only allows a single writer, so rather than dealing with busy
+	// errors, we only ever use one connection.
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteBackend{db: db}, nil
+}
+
+func (b *sqliteBackend) EnsureBucket(name string) error {
+	_, err := b.db.Exec("INSERT OR IGNORE INTO buckets (name) VALUES (?)", name)
+	return err
+}
+
+func (b *sqliteBackend) View(fn func(tx Tx) error) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Nothing is written in a View, so we always roll back.
+	defer tx.Rollback()
+
+	return fn(&sqliteTx{tx: tx})
+}
+
+func (b *sqliteBackend) Update(fn func(tx Tx) error) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(&sqliteTx{tx: tx, writable: true})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (b *sqliteBackend) Close() error {
+	return b.db.Close()
+}
+
+func (t *sqliteTx) Bucket(name string) Bucket {
+	return &sqliteBucket{tx: t, name: name}
+}
+
+func (b *sqliteBucket) checkWritable() error {
+	if !b.tx.writable {
+		return errors.New("Transaction is read-only")
+	}
+	return nil
+}
+
+func (b *sqliteBucket) Get(key string, v interface{}) error {
+	var data []byte
+	err := b.tx.tx.QueryRow("SELECT value FROM kv WHERE bucket = ? AND key = ?", b.name, key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func (b *sqliteBucket) Put(key string, v interface{}) error {
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.tx.tx.Exec("INSERT OR REPLACE INTO kv (bucket, key, value) VALUES (?, ?, ?)", b.name, key, data)
+	return err
+}
+
+func (b *sqliteBucket) Delete(key string) error {
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	_, err := b.tx.tx.Exec("DELETE FROM kv WHERE bucket = ? AND key = ?", b.name, key)
+	return err
+}
+
+func (b *sqliteBucket) NextID() (string, error) {
+	if err := b.checkWritable(); err != nil {
+		return "", err
+	}
+
+	_, err := b.tx.tx.Exec("UPDATE buckets SET sequence = sequence + 1 WHERE name = ?", b.name)
+	if err != nil {
+		return "", err
+	}
+
+	var seq uint64
+	err = b.tx.tx.QueryRow("SELECT sequence FROM buckets WHERE name = ?", b.name).Scan(&seq)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatUint(seq, 10), nil
+}
+
+func (b *sqliteBucket) Sequence() (uint64, error) {
+	var seq uint64
+	err := b.tx.tx.QueryRow("SELECT sequence FROM buckets WHERE name = ?", b.name).Scan(&seq)
+	return seq, err
+}
+
+func (b *sqliteBucket) SetSequence(seq uint64) error {
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	_, err := b.tx.tx.Exec("UPDATE buckets SET sequence = ? WHERE name = ?", seq, b.name)
+	return err
+}
+
+func (b *sqliteBucket) ForEach(v interface{}, fn func(key string) error) error {
+	return b.ForEachPrefix("", v, fn)
+}
+
+func (b *sqliteBucket) ForEachPrefix(prefix string, v interface{}, fn func(key string) error) error {
+	end := prefixEnd(prefix)
+
+	// Rows are read a batch at a time so the callback is free to modify the
+	// bucket while we're iterating, without having to load every row up
+	// front.
+	start, after := prefix, false
+	for {
+		results, err := b.scanBatch(start, after, end)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range results {
+			if err = json.Unmarshal(r.data, v); err != nil {
+				return err
+			}
+
+			if err = fn(r.key); err != nil {
+				return err
+			}
+		}
+
+		if len(results) < sqliteBatchSize {
+			return nil
+		}
+
+		start, after = results[len(results)-1].key, true
+	}
+}
+
+type sqliteRow struct {
+	key  string
+	data []byte
+}
+
+// scanBatch reads up to sqliteBatchSize rows in key order starting at start.
+// If after is true, start itself is skipped. If end isn't empty, only keys
+// before it are returned.
+func (b *sqliteBucket) scanBatch(start string, after bool, end string) ([]sqliteRow, error) {
+	query := "SELECT key, value FROM kv WHERE bucket = ? AND key >= ?"
+	if after {
+		query = "SELECT key, value FROM kv WHERE bucket = ? AND key > ?"
+	}
+
+	args := []interface{}{b.name, start}
+	if end != "" {
+		query += " AND key < ?"
+		args = append(args, end)
+	}
+
+	query += " ORDER BY key LIMIT " + strconv.Itoa(sqliteBatchSize)
+
+	rows, err := b.tx.tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []sqliteRow
+	for rows.Next() {
+		var r sqliteRow
+		if err = rows.Scan(&r.key, &r.data); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+
+	return results, rows.Err()
+}
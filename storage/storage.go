@@ -0,0 +1,333 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrNotFound is returned by backends which can tell the difference between
+// a missing key and other errors.
+var ErrNotFound = errors.New("Key not found")
+
+const (
+	// bucketsBucket keeps track of every namespaced bucket which has been
+	// created so we can find them again for exports.
+	bucketsBucket = "_buckets"
+
+	// schemaBucket stores the current schema version for each namespace.
+	schemaBucket = "_schema"
+)
+
+// Backend is the interface a database driver needs to implement to be used
+// for plugin storage. Values are arbitrary structs which the backend is
+// responsible for encoding, generally as JSON.
+type Backend interface {
+	// EnsureBucket will create the given bucket if it doesn't already
+	// exist.
+	EnsureBucket(name string) error
+
+	// View runs the given function in a read-only transaction.
+	View(fn func(tx Tx) error) error
+
+	// Update runs the given function in a read-write transaction. If the
+	// function returns an error, the transaction will be rolled back.
+	Update(fn func(tx Tx) error) error
+
+	// Close cleans up any resources used by the backend.
+	Close() error
+}
+
+// Tx represents a transaction on a Backend.
+type Tx interface {
+	// Bucket returns the bucket with the given name. The bucket must have
+	// been created with EnsureBucket first.
+	Bucket(name string) Bucket
+}
+
+// Bucket is a collection of keys and values.
+type Bucket interface {
+	// Get decodes the value for the given key into v.
+	Get(key string, v interface{}) error
+
+	// Put encodes v and stores it under the given key.
+	Put(key string, v interface{}) error
+
+	// Delete removes the given key.
+	Delete(key string) error
+
+	// NextID returns a new unique key for this bucket.
+	NextID() (string, error)
+
+	// Sequence returns the last ID handed out by NextID, or 0 if there
+	// hasn't been one.
+	Sequence() (uint64, error)
+
+	// SetSequence changes the last ID handed out by NextID. This is used
+	// when importing, so new IDs don't overwrite imported values.
+	SetSequence(seq uint64) error
+
+	// ForEach decodes every value in the bucket into v, in key order, and
+	// calls fn with the key. v will be overwritten on every iteration, so
+	// any values which are kept need to be copied. If fn returns an error,
+	// iteration stops and the error is returned.
+	ForEach(v interface{}, fn func(key string) error) error
+
+	// ForEachPrefix is the same as ForEach, but it only visits keys starting
+	// with prefix. Backends seek straight to the prefix, so this doesn't
+	// need to look at any other keys.
+	ForEachPrefix(prefix string, v interface{}, fn func(key string) error) error
+}
+
+// Open opens a Backend with the given driver. Supported drivers are "nut"
+// (the default) and "sqlite".
+func Open(driver, filename string) (Backend, error) {
+	switch driver {
+	case "", "nut", "bolt":
+		return OpenNut(filename)
+	case "sqlite", "sqlite3":
+		return OpenSQLite(filename)
+	}
+
+	return nil, fmt.Errorf("Unknown storage driver %q", driver)
+}
+
+type bucketInfo struct {
+	Name      string
+	Namespace string
+}
+
+type schemaVersion struct {
+	Namespace string
+	Version   int
+}
+
+// Store wraps a Backend and is what gets handed to plugins. Each plugin
+// should use its own Namespace rather than accessing the Backend directly.
+type Store struct {
+	Backend
+
+	lock    *sync.Mutex
+	ensured map[string]bool
+}
+
+// NewStore wraps the given backend in a Store.
+func NewStore(b Backend) (*Store, error) {
+	s := &Store{
+		Backend: b,
+		lock:    &sync.Mutex{},
+		ensured: make(map[string]bool),
+	}
+
+	for _, name := range []string{bucketsBucket, schemaBucket} {
+		err := b.EnsureBucket(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Namespace returns a handle to a plugin's data. All buckets used through
+// the Namespace are kept separate from other plugins.
+func (s *Store) Namespace(name string) *Namespace {
+	return &Namespace{store: s, name: name}
+}
+
+// Buckets returns the full names of all buckets created through a Namespace.
+func (s *Store) Buckets() ([]string, error) {
+	var ret []string
+
+	err := s.View(func(tx Tx) error {
+		info := &bucketInfo{}
+		return tx.Bucket(bucketsBucket).ForEach(info, func(key string) error {
+			ret = append(ret, key)
+			return nil
+		})
+	})
+
+	sort.Strings(ret)
+
+	return ret, err
+}
+
+// SchemaVersion returns the current schema version for the given namespace.
+// If no migrations have been run, it will be 0.
+func (s *Store) SchemaVersion(namespace string) (int, error) {
+	var ret int
+
+	err := s.View(func(tx Tx) error {
+		ret, _ = getSchemaVersion(tx, namespace)
+		return nil
+	})
+
+	return ret, err
+}
+
+func getSchemaVersion(tx Tx, namespace string) (int, bool) {
+	v := &schemaVersion{}
+	err := tx.Bucket(schemaBucket).Get(namespace, v)
+	if err != nil {
+		return 0, false
+	}
+	return v.Version, true
+}
+
+func (s *Store) ensureNamespacedBucket(namespace, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fullName := bucketName(namespace, name)
+	if s.ensured[fullName] {
+		return nil
+	}
+
+	err := s.EnsureBucket(fullName)
+	if err != nil {
+		return err
+	}
+
+	err = s.Update(func(tx Tx) error {
+		return tx.Bucket(bucketsBucket).Put(fullName, &bucketInfo{
+			Name:      name,
+			Namespace: namespace,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	s.ensured[fullName] = true
+
+	return nil
+}
+
+func bucketName(namespace, name string) string {
+	return namespace + "_" + name
+}
+
+// Namespace is a view of a Store which only has access to a single plugin's
+// buckets.
+type Namespace struct {
+	store *Store
+	name  string
+}
+
+// Name returns the name of this namespace.
+func (n *Namespace) Name() string {
+	return n.name
+}
+
+// EnsureBucket will create the given bucket in this namespace if it doesn't
+// already exist.
+func (n *Namespace) EnsureBucket(name string) error {
+	return n.store.ensureNamespacedBucket(n.name, name)
+}
+
+// View runs the given function in a read-only transaction.
+func (n *Namespace) View(fn func(tx Tx) error) error {
+	return n.store.View(func(tx Tx) error {
+		return fn(&namespacedTx{tx, n.name})
+	})
+}
+
+// Update runs the given function in a read-write transaction.
+func (n *Namespace) Update(fn func(tx Tx) error) error {
+	return n.store.Update(func(tx Tx) error {
+		return fn(&namespacedTx{tx, n.name})
+	})
+}
+
+type namespacedTx struct {
+	tx        Tx
+	namespace string
+}
+
+func (t *namespacedTx) Bucket(name string) Bucket {
+	return t.tx.Bucket(bucketName(t.namespace, name))
+}
+
+// errStopIteration is used to stop a ForEach early.
+var errStopIteration = errors.New("Stop iteration")
+
+// ForEachPrefix calls fn for every key in the bucket starting with prefix, in
+// key order, until fn returns false. Like ForEach, v is overwritten with each
+// value.
+func ForEachPrefix(bucket Bucket, prefix string, v interface{}, fn func(key string) bool) error {
+	err := bucket.ForEachPrefix(prefix, v, func(key string) error {
+		if !fn(key) {
+			return errStopIteration
+		}
+
+		return nil
+	})
+
+	if err == errStopIteration {
+		err = nil
+	}
+
+	return err
+}
+
+// prefixEnd returns the first key after every key starting with prefix, or
+// an empty string if there isn't one.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+
+	return ""
+}
+
+// CopyBucket copies all the raw values from one bucket to another. This is
+// mostly useful for migrations.
+func CopyBucket(tx Tx, from, to string) error {
+	dest := tx.Bucket(to)
+
+	var raw json.RawMessage
+	return tx.Bucket(from).ForEach(&raw, func(key string) error {
+		return dest.Put(key, raw)
+	})
+}
+
+// ClearBucket removes all keys from the given bucket.
+func ClearBucket(tx Tx, name string) error {
+	bucket := tx.Bucket(name)
+
+	var keys []string
+	var raw json.RawMessage
+	err := bucket.ForEach(&raw, func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err = bucket.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MoveBucket moves all values from one bucket to another, leaving the
+// original bucket empty.
+func MoveBucket(tx Tx, from, to string) error {
+	err := CopyBucket(tx, from, to)
+	if err != nil {
+		return err
+	}
+
+	return ClearBucket(tx, from)
+}
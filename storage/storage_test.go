@@ -0,0 +1,393 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testValue struct {
+	Name  string
+	Score int
+}
+
+func TestNamespace(t *testing.T) {
+	s, err := NewStore(NewMemoryBackend())
+	require.NoError(t, err)
+
+	ns1 := s.Namespace("ns1")
+	ns2 := s.Namespace("ns2")
+
+	require.NoError(t, ns1.EnsureBucket("values"))
+	require.NoError(t, ns2.EnsureBucket("values"))
+
+	err = ns1.Update(func(tx Tx) error {
+		return tx.Bucket("values").Put("hello", &testValue{"hello", 42})
+	})
+	require.NoError(t, err)
+
+	// The value should only exist in the first namespace
+	out := &testValue{}
+	err = ns1.View(func(tx Tx) error {
+		return tx.Bucket("values").Get("hello", out)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &testValue{"hello", 42}, out)
+
+	err = ns2.View(func(tx Tx) error {
+		return tx.Bucket("values").Get("hello", out)
+	})
+	assert.Equal(t, ErrNotFound, err)
+
+	buckets, err := s.Buckets()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ns1_values", "ns2_values"}, buckets)
+
+	// Failed updates should be rolled back
+	err = ns1.Update(func(tx Tx) error {
+		innerErr := tx.Bucket("values").Put("hello", &testValue{"hello", 0})
+		if innerErr != nil {
+			return innerErr
+		}
+		return errors.New("Rollback")
+	})
+	assert.Error(t, err)
+
+	err = ns1.View(func(tx Tx) error {
+		return tx.Bucket("values").Get("hello", out)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 42, out.Score)
+}
+
+func TestMigrate(t *testing.T) {
+	s, err := NewStore(NewMemoryBackend())
+	require.NoError(t, err)
+
+	// Set up some legacy data
+	require.NoError(t, s.EnsureBucket("legacy"))
+	err = s.Update(func(tx Tx) error {
+		return tx.Bucket("legacy").Put("hello", &testValue{"hello", 1})
+	})
+	require.NoError(t, err)
+
+	var runs int
+	RegisterMigration("migrate_test", Migration{
+		Version:     2,
+		Description: "Double scores",
+		Buckets:     []string{"migrate_test_values"},
+		Migrate: func(tx Tx) error {
+			runs++
+
+			bucket := tx.Bucket("migrate_test_values")
+
+			var values []testValue
+			v := &testValue{}
+			err := bucket.ForEach(v, func(key string) error {
+				values = append(values, *v)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, v := range values {
+				v.Score *= 2
+				if err = bucket.Put(v.Name, &v); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	})
+	RegisterMigration("migrate_test", Migration{
+		Version:     1,
+		Description: "Move legacy bucket",
+		Buckets:     []string{"legacy", "migrate_test_values"},
+		Migrate: func(tx Tx) error {
+			runs++
+			return MoveBucket(tx, "legacy", "migrate_test_values")
+		},
+	})
+
+	assert.Panics(t, func() {
+		RegisterMigration("migrate_test", Migration{Version: 1})
+	})
+
+	require.NoError(t, s.Migrate())
+	assert.Equal(t, 2, runs)
+
+	version, err := s.SchemaVersion("migrate_test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version)
+
+	ns := s.Namespace("migrate_test")
+	out := &testValue{}
+	err = ns.View(func(tx Tx) error {
+		return tx.Bucket("values").Get("hello", out)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, out.Score)
+
+	err = s.View(func(tx Tx) error {
+		return tx.Bucket("legacy").Get("hello", out)
+	})
+	assert.Equal(t, ErrNotFound, err)
+
+	// Running again shouldn't do anything
+	require.NoError(t, s.Migrate())
+	assert.Equal(t, 2, runs)
+
+	// A newer schema than we know about should fail
+	err = s.Update(func(tx Tx) error {
+		return tx.Bucket(schemaBucket).Put("migrate_test", &schemaVersion{"migrate_test", 3})
+	})
+	require.NoError(t, err)
+	assert.Error(t, s.Migrate())
+}
+
+// testBackend runs a basic set of tests which every Backend should pass.
+func testBackend(t *testing.T, b Backend) {
+	require.NoError(t, b.EnsureBucket("test"))
+	require.NoError(t, b.EnsureBucket("test"))
+
+	// Writes shouldn't work in a View
+	err := b.View(func(tx Tx) error {
+		return tx.Bucket("test").Put("hello", &testValue{"hello", 1})
+	})
+	assert.Error(t, err)
+
+	var ids []string
+	err = b.Update(func(tx Tx) error {
+		bucket := tx.Bucket("test")
+		for _, name := range []string{"c", "a", "b"} {
+			if innerErr := bucket.Put(name, &testValue{name, len(name)}); innerErr != nil {
+				return innerErr
+			}
+		}
+
+		for i := 0; i < 2; i++ {
+			id, innerErr := bucket.NextID()
+			if innerErr != nil {
+				return innerErr
+			}
+			ids = append(ids, id)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Len(t, ids, 2)
+	assert.NotEqual(t, ids[0], ids[1])
+
+	// The sequence should pick up where it was set.
+	err = b.View(func(tx Tx) error {
+		seq, innerErr := tx.Bucket("test").Sequence()
+		assert.Equal(t, ids[1], strconv.FormatUint(seq, 10))
+		assert.Error(t, tx.Bucket("test").SetSequence(10))
+		return innerErr
+	})
+	assert.NoError(t, err)
+
+	err = b.Update(func(tx Tx) error {
+		bucket := tx.Bucket("test")
+		if innerErr := bucket.SetSequence(10); innerErr != nil {
+			return innerErr
+		}
+
+		id, innerErr := bucket.NextID()
+		assert.Equal(t, "11", id)
+		return innerErr
+	})
+	assert.NoError(t, err)
+
+	// ForEach should go through keys in order
+	var keys []string
+	err = b.View(func(tx Tx) error {
+		v := &testValue{}
+		return tx.Bucket("test").ForEach(v, func(key string) error {
+			assert.Equal(t, key, v.Name)
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+
+	// Deleting while iterating should be safe and rollback should work
+	err = b.Update(func(tx Tx) error {
+		bucket := tx.Bucket("test")
+		v := &testValue{}
+		innerErr := bucket.ForEach(v, func(key string) error {
+			return bucket.Delete(key)
+		})
+		if innerErr != nil {
+			return innerErr
+		}
+		return errors.New("Rollback")
+	})
+	assert.Error(t, err)
+
+	out := &testValue{}
+	err = b.View(func(tx Tx) error {
+		return tx.Bucket("test").Get("a", out)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &testValue{"a", 1}, out)
+
+	err = b.Update(func(tx Tx) error {
+		return tx.Bucket("test").Delete("a")
+	})
+	assert.NoError(t, err)
+
+	err = b.View(func(tx Tx) error {
+		return tx.Bucket("test").Get("a", out)
+	})
+	assert.Equal(t, ErrNotFound, err)
+
+	// Deleting every key while iterating shouldn't skip any of them.
+	err = b.Update(func(tx Tx) error {
+		bucket := tx.Bucket("test")
+		v := &testValue{}
+		return bucket.ForEach(v, func(key string) error {
+			return bucket.Delete(key)
+		})
+	})
+	assert.NoError(t, err)
+
+	keys = nil
+	err = b.View(func(tx Tx) error {
+		v := &testValue{}
+		return tx.Bucket("test").ForEach(v, func(key string) error {
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	testBackendPrefix(t, b)
+
+	assert.NoError(t, b.Close())
+}
+
+// testBackendPrefix makes sure prefix iteration only returns matching keys,
+// even when there are more than fit in a single batch.
+func testBackendPrefix(t *testing.T, b Backend) {
+	require.NoError(t, b.EnsureBucket("prefix"))
+
+	var expected []string
+	err := b.Update(func(tx Tx) error {
+		bucket := tx.Bucket("prefix")
+		for _, key := range []string{"a", "b", "b\xff", "c"} {
+			if innerErr := bucket.Put(key, &testValue{key, 0}); innerErr != nil {
+				return innerErr
+			}
+		}
+
+		for i := 0; i < 250; i++ {
+			key := fmt.Sprintf("b %03d", i)
+			expected = append(expected, key)
+			if innerErr := bucket.Put(key, &testValue{key, i}); innerErr != nil {
+				return innerErr
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	var keys []string
+	err = b.View(func(tx Tx) error {
+		v := &testValue{}
+		return tx.Bucket("prefix").ForEachPrefix("b ", v, func(key string) error {
+			assert.Equal(t, key, v.Name)
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, keys)
+
+	// Keys ending in 0xff need special handling to find the end of the
+	// prefix.
+	keys = nil
+	err = b.View(func(tx Tx) error {
+		v := &testValue{}
+		return tx.Bucket("prefix").ForEachPrefix("b\xff", v, func(key string) error {
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b\xff"}, keys)
+
+	// Deleting everything in a prefix should leave everything else alone.
+	err = b.Update(func(tx Tx) error {
+		bucket := tx.Bucket("prefix")
+		v := &testValue{}
+		return bucket.ForEachPrefix("b", v, func(key string) error {
+			return bucket.Delete(key)
+		})
+	})
+	assert.NoError(t, err)
+
+	keys = nil
+	err = b.View(func(tx Tx) error {
+		v := &testValue{}
+		return tx.Bucket("prefix").ForEach(v, func(key string) error {
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, keys)
+}
+
+func TestMemoryBackend(t *testing.T) {
+	testBackend(t, NewMemoryBackend())
+}
+
+func TestForEachPrefix(t *testing.T) {
+	b := NewMemoryBackend()
+	require.NoError(t, b.EnsureBucket("test"))
+
+	err := b.Update(func(tx Tx) error {
+		bucket := tx.Bucket("test")
+		for _, key := range []string{"a", "b 1", "b 2", "b 3", "bb", "c"} {
+			if innerErr := bucket.Put(key, &testValue{key, 0}); innerErr != nil {
+				return innerErr
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	var keys []string
+	err = b.View(func(tx Tx) error {
+		v := &testValue{}
+		return ForEachPrefix(tx.Bucket("test"), "b ", v, func(key string) bool {
+			keys = append(keys, v.Name)
+			return true
+		})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b 1", "b 2", "b 3"}, keys)
+
+	// Returning false should stop early
+	keys = nil
+	err = b.View(func(tx Tx) error {
+		v := &testValue{}
+		return ForEachPrefix(tx.Bucket("test"), "b", v, func(key string) bool {
+			keys = append(keys, key)
+			return len(keys) < 2
+		})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b 1", "b 2"}, keys)
+}
@@ -16,6 +16,8 @@ name = "Seabird Bot"
 pass = "password"
 
 prefix = "!"
+
+disablecaps = true
 `
 
 var expectedBaseOutput = []string{